@@ -0,0 +1,201 @@
+package yoman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/domac/yoman/config"
+	"github.com/domac/yoman/core"
+	"github.com/domac/yoman/snmp"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//网络发现探测的oid
+const (
+	Oid_SysDescr    = "1.3.6.1.2.1.1.1.0"
+	Oid_SysObjectID = "1.3.6.1.2.1.1.2.0"
+	Oid_SysName     = "1.3.6.1.2.1.1.5.0"
+)
+
+//sysObjectID 1.3.6.1.4.1.<企业号> 对应的厂商 (IANA Private Enterprise Numbers)
+var enterpriseVendors = map[int]string{
+	2:     "ibm",
+	9:     "cisco",
+	11:    "hp",
+	43:    "3com",
+	171:   "dlink",
+	311:   "microsoft",
+	674:   "dell",
+	890:   "zyxel",
+	1588:  "brocade",
+	1916:  "extreme",
+	1991:  "foundry",
+	2011:  "huawei",
+	2620:  "checkpoint",
+	2636:  "juniper",
+	3375:  "f5",
+	3902:  "zte",
+	4526:  "netgear",
+	4881:  "ruijie",
+	5624:  "enterasys",
+	6027:  "force10",
+	6486:  "alcatel",
+	6527:  "nokia",
+	8072:  "net-snmp",
+	11863: "tplink",
+	12356: "fortinet",
+	14823: "aruba",
+	14988: "mikrotik",
+	25461: "paloalto",
+	25506: "h3c",
+	30065: "arista",
+	41112: "ubiquiti",
+}
+
+var enterprisesOid = snmp.MustParseOid("1.3.6.1.4.1")
+
+//根据sysObjectID识别厂商, 未知的企业号返回 enterprise-<企业号>
+func VendorFromObjectID(oid snmp.Oid) string {
+	if len(oid) <= len(enterprisesOid) || !oid.Within(enterprisesOid) {
+		return ""
+	}
+	number := oid[len(enterprisesOid)]
+	if vendor, ok := enterpriseVendors[number]; ok {
+		return vendor
+	}
+	return fmt.Sprintf("enterprise-%d", number)
+}
+
+//单个地址的探测任务
+type ProbeJob struct {
+	Host        string
+	Communities []string
+	Timeout     int
+	Retries     int
+}
+
+func NewProbeJob(host string, communities []string, timeout int, retries int) *ProbeJob {
+	return &ProbeJob{
+		Host:        host,
+		Communities: communities,
+		Timeout:     timeout,
+		Retries:     retries,
+	}
+}
+
+func (j *ProbeJob) String() string {
+	return j.Host
+}
+
+//依次尝试候选community, 第一个有响应的作为设备的community, 没有响应时返回nil
+func (j *ProbeJob) Run(ctx context.Context) (core.Result, error) {
+	oids := []snmp.Oid{
+		snmp.MustParseOid(Oid_SysObjectID),
+		snmp.MustParseOid(Oid_SysName),
+		snmp.MustParseOid(Oid_SysDescr),
+	}
+	for _, community := range j.Communities {
+		sw := config.Switch{Host: j.Host, Community: community}
+		wsnmp, err := NewSNMPClient(sw, j.Timeout, j.Retries)
+		if err != nil {
+			continue
+		}
+		stop := closeOnCancel(ctx, wsnmp)
+		values, err := wsnmp.GetMultiple(oids)
+		stop()
+		wsnmp.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+		if objectID, ok := values[oids[0].String()].(snmp.Oid); ok {
+			sw.SysObjectID = objectID.String()
+			sw.Vendor = VendorFromObjectID(objectID)
+		}
+		if name, ok := values[oids[1].String()].(string); ok {
+			sw.Name = name
+		}
+		if descr, ok := values[oids[2].String()].(string); ok {
+			sw.SysDescr = descr
+		}
+		return &sw, nil
+	}
+	return nil, nil
+}
+
+//扫描地址段, 通过调度器并发探测, 返回有响应的设备(按地址排序)
+func Discover(cidrs []string, communities []string, workers int, timeout int, retries int) ([]config.Switch, error) {
+	hosts := []string{}
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		ips, err := core.ExpandCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, ips...)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no address to discover")
+	}
+	if workers > len(hosts) {
+		workers = len(hosts)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mpwg  sync.WaitGroup
+		mutex sync.Mutex
+	)
+	found := []config.Switch{}
+
+	d := core.NewDispatcherWithMQ(workers, workers, &wg, &mpwg)
+	d.SetMF(func(task core.Task) {
+		sw, ok := task.Result.(*config.Switch)
+		if !ok || sw == nil {
+			return
+		}
+		mutex.Lock()
+		found = append(found, *sw)
+		mutex.Unlock()
+		fmt.Printf("发现设备 %s (%s %s) \n", sw.Host, sw.Vendor, sw.Name)
+	})
+	d.Run()
+	defer d.Stop()
+
+	start := time.Now()
+	for _, host := range hosts {
+		d.SubmitTask(core.NewTask(NewProbeJob(host, communities, timeout, retries)))
+	}
+	wg.Wait()
+	mpwg.Wait()
+	fmt.Printf("扫描地址 %d 个, 发现设备 %d 台, 耗时 (秒) : %v \n", len(hosts), len(found), time.Since(start).Seconds())
+
+	sortByAddress(found)
+	return found, nil
+}
+
+//按IPv4地址的数值排序, 而非字符串顺序
+func sortByAddress(switches []config.Switch) {
+	sort.Slice(switches, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(switches[i].Host).To4(), net.ParseIP(switches[j].Host).To4()) < 0
+	})
+}
+
+//写入交换机数据文件, 可以直接作为 -datafile 使用
+func WriteSwitchFile(fileName string, switches []config.Switch) error {
+	data, err := json.MarshalIndent(switches, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(data, '\n'), 0644)
+}
@@ -0,0 +1,65 @@
+package yoman
+
+import (
+	"context"
+	"github.com/domac/yoman/config"
+	"github.com/domac/yoman/snmp"
+	"strings"
+	"testing"
+)
+
+func TestVendorFromObjectID(t *testing.T) {
+	cases := map[string]string{
+		"1.3.6.1.4.1.9.1.1208":     "cisco",
+		"1.3.6.1.4.1.2011.2.23.96": "huawei",
+		"1.3.6.1.4.1.25506.1.1":    "h3c",
+		"1.3.6.1.4.1.8072.3.2.10":  "net-snmp",
+		"1.3.6.1.4.1.99999.1":      "enterprise-99999",
+		"1.3.6.1.4.1.9":            "cisco",
+		"1.3.6.1.4.1":              "",
+		"1.3.6.1.2.1.1":            "",
+		"1.3.6.1.4.2.9.1":          "",
+	}
+	for oid, want := range cases {
+		if got := VendorFromObjectID(snmp.MustParseOid(oid)); got != want {
+			t.Errorf("%s: vendor %q, want %q", oid, got, want)
+		}
+	}
+}
+
+func TestSortByAddress(t *testing.T) {
+	switches := []config.Switch{{Host: "10.0.0.10"}, {Host: "10.0.1.2"}, {Host: "10.0.0.9"}, {Host: "9.255.255.255"}}
+	sortByAddress(switches)
+	hosts := []string{}
+	for _, sw := range switches {
+		hosts = append(hosts, sw.Host)
+	}
+	if got := strings.Join(hosts, ","); got != "9.255.255.255,10.0.0.9,10.0.0.10,10.0.1.2" {
+		t.Fatalf("sorted %s", got)
+	}
+}
+
+//依次尝试候选community, 使用第一个有响应的
+func TestProbeJob(t *testing.T) {
+	a := startSwitch(t, 1)
+	a.Load([]snmp.SNMPValue{
+		{Oid: snmp.MustParseOid(Oid_SysObjectID), Value: snmp.MustParseOid("1.3.6.1.4.1.2011.2.23.96")},
+		{Oid: snmp.MustParseOid(Oid_SysName), Value: "core-1"},
+		{Oid: snmp.MustParseOid(Oid_SysDescr), Value: "Huawei Versatile Routing Platform"},
+	})
+	host := a.Addr().String()
+
+	res, err := NewProbeJob(host, []string{"private", "public"}, 100, 0).Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw, ok := res.(*config.Switch)
+	if !ok || sw.Community != "public" || sw.Vendor != "huawei" || sw.Name != "core-1" || sw.SysObjectID != ".1.3.6.1.4.1.2011.2.23.96" {
+		t.Fatalf("probe result %+v", res)
+	}
+
+	//没有响应时返回nil
+	if res, err := NewProbeJob(host, []string{"private"}, 100, 0).Run(context.Background()); err != nil || res != nil {
+		t.Fatalf("probe result %v, err %v", res, err)
+	}
+}
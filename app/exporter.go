@@ -0,0 +1,236 @@
+package yoman
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/domac/yoman/core"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Prometheus指标导出: 保存最近一次采集的原始计数, 以文本格式暴露在 /metrics
+type Exporter struct {
+	mutex      sync.RWMutex
+	samples    map[string]*SwitchResult //host|port|oid -> 最近的原始采集结果
+	sampleSeen map[string]time.Time     //样本最近一次更新的时间
+	duration   map[string]time.Duration //host|oid -> 最近一次采集耗时
+	pollSeen   map[string]time.Time
+	expiry     time.Duration    //超过该时长没有更新的样本不再导出, 0表示一直保留
+	dispatcher *core.Dispatcher //任务计数来自调度器的统计
+}
+
+func NewExporter() *Exporter {
+	return &Exporter{
+		samples:    make(map[string]*SwitchResult),
+		sampleSeen: make(map[string]time.Time),
+		duration:   make(map[string]time.Duration),
+		pollSeen:   make(map[string]time.Time),
+	}
+}
+
+//设置样本的保留时长: 不再采集的设备(例如从数据文件中移除)的样本超过该时长后删除
+func (e *Exporter) SetExpiry(d time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.expiry = d
+}
+
+//设置采集任务的调度器
+func (e *Exporter) SetDispatcher(d *core.Dispatcher) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.dispatcher = d
+}
+
+//记录原始采集结果(在速率换算之前)
+func (e *Exporter) Observe(s *SwitchResult) {
+	if oidDirection(s.Oid) == "" {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	key := rateKey(s)
+	e.samples[key] = s
+	e.sampleSeen[key] = time.Now()
+}
+
+//记录单台交换机的采集耗时
+func (e *Exporter) ObservePoll(host, oid string, d time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.duration[host+"|"+oid] = d
+	e.pollSeen[host+"|"+oid] = time.Now()
+}
+
+//删除过期的样本
+func (e *Exporter) evict() {
+	if e.expiry <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-e.expiry)
+	for k, t := range e.sampleSeen {
+		if t.Before(deadline) {
+			delete(e.samples, k)
+			delete(e.sampleSeen, k)
+		}
+	}
+	for k, t := range e.pollSeen {
+		if t.Before(deadline) {
+			delete(e.duration, k)
+			delete(e.pollSeen, k)
+		}
+	}
+}
+
+//与Property一致的出入站判断
+func oidDirection(oid string) string {
+	if !*Debug {
+		if oid == Oid_Inbound {
+			return "in"
+		} else if oid == Oid_Outbound {
+			return "out"
+		}
+	} else {
+		if strings.Contains(oid, Oid_Inbound) {
+			return "in"
+		} else if strings.Contains(oid, Oid_Outbound) {
+			return "out"
+		}
+	}
+	return ""
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(e.Render())
+}
+
+//按Prometheus文本格式输出全部指标
+func (e *Exporter) Render() []byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.evict()
+
+	buf := &bytes.Buffer{}
+
+	writeHeader(buf, "yoman_interface_octets_total", "counter", "Interface octet counters collected via SNMP.")
+	keys := make([]string, 0, len(e.samples))
+	for k := range e.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := e.samples[k]
+		value, err := strconv.ParseUint(s.SFlow, 10, 64)
+		if err != nil {
+			continue
+		}
+		writeSample(buf, "yoman_interface_octets_total", [][2]string{
+			{"host", s.Shost},
+			{"port", s.SPort},
+			{"ifName", s.IfName},
+			{"direction", oidDirection(s.Oid)},
+			{"oid", s.Oid},
+		}, strconv.FormatUint(value, 10))
+	}
+
+	if e.dispatcher != nil {
+		st := e.dispatcher.Stats()
+		//取消的任务同时计入任务数和错误数, 错误数不会超过任务数
+		writeHeader(buf, "yoman_snmp_errors_total", "counter", "Number of failed or cancelled SNMP jobs.")
+		writeSample(buf, "yoman_snmp_errors_total", nil, strconv.FormatUint(st.Failed+st.Cancelled, 10))
+
+		writeHeader(buf, "yoman_snmp_jobs_total", "counter", "Number of finished SNMP jobs, including failed and cancelled ones.")
+		writeSample(buf, "yoman_snmp_jobs_total", nil, strconv.FormatUint(st.Completed+st.Failed+st.Cancelled, 10))
+
+		writeHeader(buf, "yoman_dispatcher_queue_depth", "gauge", "Number of SNMP jobs waiting in the dispatcher queue.")
+		writeSample(buf, "yoman_dispatcher_queue_depth", nil, strconv.Itoa(st.QueueDepth+st.Waiting))
+
+		writeHeader(buf, "yoman_dispatcher_busy_executors", "gauge", "Number of executors running an SNMP job.")
+		writeSample(buf, "yoman_dispatcher_busy_executors", nil, strconv.Itoa(st.BusyExecutors))
+	}
+
+	writeHeader(buf, "yoman_poll_duration_seconds", "gauge", "Duration of the latest SNMP poll per switch.")
+	keys = keys[:0]
+	for k := range e.duration {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		host, oid := splitKey(k)
+		writeSample(buf, "yoman_poll_duration_seconds", [][2]string{
+			{"host", host},
+			{"oid", oid},
+		}, strconv.FormatFloat(e.duration[k].Seconds(), 'f', -1, 64))
+	}
+	return buf.Bytes()
+}
+
+//拆分 host|oid 形式的键
+func splitKey(key string) (string, string) {
+	index := strings.Index(key, "|")
+	if index < 0 {
+		return key, ""
+	}
+	return key[:index], key[index+1:]
+}
+
+func writeHeader(buf *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeSample(buf *bytes.Buffer, name string, labels [][2]string, value string) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(l[0])
+			buf.WriteString(`="`)
+			buf.WriteString(escapeLabelValue(l[1]))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+//启动调试服务, 以JSON格式输出调度器统计 /debug/dispatcher 和计划采集状态 /debug/schedules
+func StartDebugServer(addr string, d *core.Dispatcher, s *core.Scheduler) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/dispatcher", d)
+	if s != nil {
+		mux.Handle("/debug/schedules", s)
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("调试接口启动失败 : %s \n", err)
+		}
+	}()
+}
+
+//启动指标导出服务
+func StartExporter(addr string, e *Exporter) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("指标导出服务启动失败 : %s \n", err)
+		}
+	}()
+}
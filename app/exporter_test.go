@@ -0,0 +1,79 @@
+package yoman
+
+import (
+	"github.com/domac/yoman/core"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporterRender(t *testing.T) {
+	e := NewExporter()
+	e.Observe(&SwitchResult{Shost: "10.0.0.1", SPort: "1", SFlow: "1000", Oid: Oid_Inbound, IfName: `Gi0/1 "uplink"`})
+	e.Observe(&SwitchResult{Shost: "10.0.0.1", SPort: "1", SFlow: "2000", Oid: Oid_Outbound, IfName: "a\\b\nc"})
+	//不是数字的值和其他oid不导出
+	e.Observe(&SwitchResult{Shost: "10.0.0.2", SPort: "1", SFlow: "n/a", Oid: Oid_Inbound})
+	e.Observe(&SwitchResult{Shost: "10.0.0.2", SPort: "1", SFlow: "1", Oid: Oid_IfName})
+	e.ObservePoll("10.0.0.1", Oid_Inbound, 1500*time.Millisecond)
+
+	want := `# HELP yoman_interface_octets_total Interface octet counters collected via SNMP.
+# TYPE yoman_interface_octets_total counter
+yoman_interface_octets_total{host="10.0.0.1",port="1",ifName="a\\b\nc",direction="out",oid="1.3.6.1.2.1.31.1.1.1.10"} 2000
+yoman_interface_octets_total{host="10.0.0.1",port="1",ifName="Gi0/1 \"uplink\"",direction="in",oid="1.3.6.1.2.1.31.1.1.1.6"} 1000
+# HELP yoman_poll_duration_seconds Duration of the latest SNMP poll per switch.
+# TYPE yoman_poll_duration_seconds gauge
+yoman_poll_duration_seconds{host="10.0.0.1",oid="1.3.6.1.2.1.31.1.1.1.6"} 1.5
+`
+	if got := string(e.Render()); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	//设置调度器后输出任务计数
+	e.SetDispatcher(core.NewDispatcher(1, 1))
+	got := string(e.Render())
+	for _, line := range []string{
+		"# TYPE yoman_snmp_errors_total counter\nyoman_snmp_errors_total 0\n",
+		"# TYPE yoman_snmp_jobs_total counter\nyoman_snmp_jobs_total 0\n",
+		"# TYPE yoman_dispatcher_queue_depth gauge\nyoman_dispatcher_queue_depth 0\n",
+		"# TYPE yoman_dispatcher_busy_executors gauge\nyoman_dispatcher_busy_executors 0\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Fatalf("missing %q in\n%s", line, got)
+		}
+	}
+}
+
+//超过保留时长没有更新的样本和采集耗时不再导出
+func TestExporterExpiry(t *testing.T) {
+	e := NewExporter()
+	e.SetExpiry(time.Minute)
+	e.Observe(&SwitchResult{Shost: "old", SPort: "1", SFlow: "1", Oid: Oid_Inbound})
+	e.Observe(&SwitchResult{Shost: "new", SPort: "1", SFlow: "2", Oid: Oid_Inbound})
+	e.ObservePoll("old", Oid_Inbound, time.Second)
+	e.ObservePoll("new", Oid_Inbound, time.Second)
+	stale := time.Now().Add(-2 * time.Minute)
+	e.sampleSeen["old|1|"+Oid_Inbound] = stale
+	e.pollSeen["old|"+Oid_Inbound] = stale
+
+	got := string(e.Render())
+	if strings.Contains(got, `host="old"`) || !strings.Contains(got, `host="new",port="1"`) || !strings.Contains(got, `yoman_poll_duration_seconds{host="new"`) {
+		t.Fatalf("render\n%s", got)
+	}
+	if len(e.samples) != 1 || len(e.sampleSeen) != 1 || len(e.duration) != 1 || len(e.pollSeen) != 1 {
+		t.Fatalf("%d samples, %d durations left", len(e.samples), len(e.duration))
+	}
+}
+
+//调度器可以在导出服务运行时设置
+func TestExporterSetDispatcherConcurrently(t *testing.T) {
+	e := NewExporter()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			e.Render()
+		}
+	}()
+	e.SetDispatcher(core.NewDispatcher(1, 1))
+	<-done
+}
@@ -0,0 +1,168 @@
+package yoman
+
+import (
+	"fmt"
+	"github.com/domac/yoman/snmp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//接口元数据oid
+const (
+	Oid_IfName       = "1.3.6.1.2.1.31.1.1.1.1"  //ifName
+	Oid_IfAlias      = "1.3.6.1.2.1.31.1.1.1.18" //ifAlias
+	Oid_IfHighSpeed  = "1.3.6.1.2.1.31.1.1.1.15" //ifHighSpeed (Mbps)
+	Oid_IfSpeed      = "1.3.6.1.2.1.2.2.1.5"     //ifSpeed (bps), 设备不支持ifHighSpeed时使用
+	Oid_IfOperStatus = "1.3.6.1.2.1.2.2.1.8"     //ifOperStatus
+)
+
+//ifOperStatus取值 (RFC 2863)
+var operStatusNames = map[int64]string{
+	1: "up",
+	2: "down",
+	3: "testing",
+	4: "unknown",
+	5: "dormant",
+	6: "notPresent",
+	7: "lowerLayerDown",
+}
+
+//接口元数据
+type IfMeta struct {
+	Name       string
+	Alias      string
+	Speed      int64  //接口速率(bps), 0表示未知
+	OperStatus string //up, down 等
+}
+
+//单台设备的接口元数据, 以端口(ifIndex)为键
+type deviceMeta struct {
+	mutex   sync.Mutex //同一设备只有一个采集在刷新元数据
+	ports   map[string]*IfMeta
+	fetched time.Time
+}
+
+//接口元数据缓存: 按设备缓存, 超过ttl后由下一次采集刷新
+type IfMetaCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	devices map[string]*deviceMeta
+}
+
+func NewIfMetaCache(ttl time.Duration) *IfMetaCache {
+	return &IfMetaCache{
+		ttl:     ttl,
+		devices: make(map[string]*deviceMeta),
+	}
+}
+
+func (c *IfMetaCache) device(host string) *deviceMeta {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	dm, ok := c.devices[host]
+	if !ok {
+		dm = &deviceMeta{}
+		c.devices[host] = dm
+	}
+	return dm
+}
+
+//获取设备的接口元数据, 缓存过期时使用当前连接重新采集; 全部列采集失败时继续使用旧的数据
+func (c *IfMetaCache) Get(wsnmp *snmp.WapSNMP, host string) map[string]*IfMeta {
+	dm := c.device(host)
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+	if dm.ports != nil && time.Since(dm.fetched) < c.ttl {
+		return dm.ports
+	}
+	ports, err := WalkIfMeta(wsnmp)
+	if err != nil {
+		fmt.Printf("host(%s)采集接口元数据出现异常 : %s \n", host, err)
+	}
+	//部分列失败时使用成功的列; 全部失败时保留旧的数据, 没有旧数据时缓存空的结果, 避免每次采集都重试失败的设备
+	if err == nil || len(ports) > 0 || dm.ports == nil {
+		dm.ports = ports
+	}
+	dm.fetched = time.Now()
+	return dm.ports
+}
+
+//采集设备的ifName, ifAlias, ifHighSpeed(ifSpeed), ifOperStatus;
+//每列单独采集, 某一列失败(例如设备不支持ifAlias)时保留其他列的数据, 返回的错误列出失败的列
+func WalkIfMeta(wsnmp *snmp.WapSNMP) (map[string]*IfMeta, error) {
+	ports := make(map[string]*IfMeta)
+	failed := []string{}
+	walk := func(oid string) map[string]interface{} {
+		table, err := wsnmp.GetTable(snmp.MustParseOid(oid))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", oid, strings.TrimSpace(err.Error())))
+			return nil
+		}
+		return table
+	}
+	port := func(key string) *IfMeta {
+		_, p := SplitData(key)
+		m, ok := ports[p]
+		if !ok {
+			m = &IfMeta{}
+			ports[p] = m
+		}
+		return m
+	}
+
+	for k, v := range walk(Oid_IfName) {
+		port(k).Name = fmt.Sprintf("%v", v)
+	}
+
+	for k, v := range walk(Oid_IfAlias) {
+		port(k).Alias = fmt.Sprintf("%v", v)
+	}
+
+	speeds := walk(Oid_IfHighSpeed)
+	for k, v := range speeds {
+		if speed := metaInt(v); speed > 0 {
+			port(k).Speed = speed * 1000000
+		}
+	}
+	//ifSpeed最大只能表示4294967295bps, 只在ifHighSpeed没有数据时使用
+	if len(speeds) == 0 {
+		for k, v := range walk(Oid_IfSpeed) {
+			port(k).Speed = metaInt(v)
+		}
+	}
+
+	for k, v := range walk(Oid_IfOperStatus) {
+		s := metaInt(v)
+		if name, ok := operStatusNames[s]; ok {
+			port(k).OperStatus = name
+		} else {
+			port(k).OperStatus = strconv.FormatInt(s, 10)
+		}
+	}
+	if len(failed) > 0 {
+		return ports, fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return ports, nil
+}
+
+func metaInt(v interface{}) int64 {
+	switch value := v.(type) {
+	case int64:
+		return value
+	case snmp.Gauge:
+		return int64(value)
+	case snmp.Counter:
+		return int64(value)
+	}
+	return 0
+}
+
+//把元数据填充到采集结果
+func (m *IfMeta) apply(sr *SwitchResult) {
+	sr.IfName = m.Name
+	sr.IfAlias = m.Alias
+	sr.Speed = m.Speed
+	sr.OperStatus = m.OperStatus
+}
@@ -0,0 +1,182 @@
+package yoman
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const INFLUX_MEASUREMENT = "interface"
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+//InfluxDB行协议: interface,host=..,port=..,ifName=.. in=..i,out=..i <纳秒时间戳>
+func PropertyToLine(p *Property) string {
+	fields := []string{}
+	//只输出采集到的方向, 没有采集的方向不能写成0
+	if p.HasIn {
+		fields = append(fields, "in="+strconv.FormatInt(p.Inbound, 10)+"i")
+	}
+	if p.HasOut {
+		fields = append(fields, "out="+strconv.FormatInt(p.OutBound, 10)+"i")
+	}
+	if p.InUtil != nil {
+		fields = append(fields, "in_util="+strconv.FormatFloat(*p.InUtil, 'f', -1, 64))
+	}
+	if p.OutUtil != nil {
+		fields = append(fields, "out_util="+strconv.FormatFloat(*p.OutUtil, 'f', -1, 64))
+	}
+	//行协议至少需要一个字段
+	if len(fields) == 0 {
+		return ""
+	}
+	return influxLine(p.Host, strconv.Itoa(p.Port), p.IfName, fields, p.Clock)
+}
+
+func influxLine(host, port, ifName string, fields []string, clock int64) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(INFLUX_MEASUREMENT)
+	buf.WriteString(",host=" + influxTagEscaper.Replace(host))
+	buf.WriteString(",port=" + influxTagEscaper.Replace(port))
+	//InfluxDB不允许空的tag值
+	if ifName != "" {
+		buf.WriteString(",ifName=" + influxTagEscaper.Replace(ifName))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strings.Join(fields, ","))
+	if clock > 0 {
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(clock, 10))
+		buf.WriteString("000000000")
+	}
+	return buf.String()
+}
+
+//InfluxDB上报: 按批写入HTTP /write 接口或文件
+type InfluxSink struct {
+	mutex     sync.Mutex
+	uri       string //http(s)地址, 例如 http://localhost:8086/write?db=yoman
+	file      *os.File
+	gzip      bool
+	batchSize int
+	buf       bytes.Buffer
+	lines     int
+	pending   []*Payload //当前批次包含的数据
+}
+
+//target 为 http(s) 地址时写入 /write 接口, 否则作为文件路径追加写入
+func NewInfluxSink(target string, batchSize int, useGzip bool) (*InfluxSink, error) {
+	if target == "" {
+		return nil, fmt.Errorf("influx sink needs a target, please input it by `-influx=` ")
+	}
+	if batchSize <= 0 {
+		batchSize = 5000
+	}
+	s := &InfluxSink{gzip: useGzip, batchSize: batchSize}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		s.uri = target
+		return s, nil
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+func (s *InfluxSink) Name() string {
+	return "influx"
+}
+
+//缓存到批次中, 批次满时写出
+func (s *InfluxSink) Send(p *Payload) error {
+	if p.Type != PAYLOAD_FLOW {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = append(s.pending, p)
+	for _, property := range p.Properties {
+		if line := PropertyToLine(property); line != "" {
+			s.buf.WriteString(line)
+			s.buf.WriteByte('\n')
+			s.lines++
+		}
+	}
+	if s.lines >= s.batchSize {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *InfluxSink) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.flush()
+}
+
+func (s *InfluxSink) flush() error {
+	if s.lines == 0 {
+		s.pending = nil
+		return nil
+	}
+	//压缩或写出失败时同样丢弃批次, 数据随FlushError写入缓存
+	body := s.buf.Bytes()
+	var err error
+	if s.gzip {
+		body, err = gzipBody(body)
+	}
+	if err == nil {
+		err = s.write(body)
+	}
+	pending := s.pending
+	s.buf.Reset()
+	s.lines = 0
+	s.pending = nil
+	if err != nil {
+		return &FlushError{Payloads: pending, Err: err}
+	}
+	return nil
+}
+
+func (s *InfluxSink) write(body []byte) error {
+	if s.file != nil {
+		//多个gzip成员拼接仍是合法的gzip文件
+		_, err := s.file.Write(body)
+		return err
+	}
+	headers := make(map[string]string)
+	headers["Content-Type"] = "text/plain; charset=utf-8"
+	if s.gzip {
+		headers["Content-Encoding"] = "gzip"
+	}
+	resp, err := yomanClient.Do("POST", s.uri, headers, bytes.NewReader(body))
+	return checkResponse(resp, err)
+}
+
+//关闭写入的文件, 之前调用Flush写出最后的批次
+func (s *InfluxSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	zbuf := &bytes.Buffer{}
+	zw := gzip.NewWriter(zbuf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return zbuf.Bytes(), nil
+}
@@ -0,0 +1,121 @@
+package yoman
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPropertyToLine(t *testing.T) {
+	util := 12.5
+	cases := []struct {
+		name string
+		p    Property
+		want string
+	}{
+		{"counters", Property{Host: "10.0.0.1", Port: 3, IfName: "Gi0/3", Inbound: 100, OutBound: 200, HasIn: true, HasOut: true, Clock: 1700000000},
+			"interface,host=10.0.0.1,port=3,ifName=Gi0/3 in=100i,out=200i 1700000000000000000"},
+		{"escaped tags", Property{Host: "sw 1,a=b", Port: 1, IfName: "Port-channel 1,x=y", Inbound: 1, HasIn: true, Clock: 1},
+			`interface,host=sw\ 1\,a\=b,port=1,ifName=Port-channel\ 1\,x\=y in=1i 1000000000`},
+		{"empty ifName", Property{Host: "h", Port: 2, OutBound: 5, HasOut: true, Clock: 10},
+			"interface,host=h,port=2 out=5i 10000000000"},
+		{"no clock", Property{Host: "h", Port: 2, Inbound: 0, HasIn: true},
+			"interface,host=h,port=2 in=0i"},
+		{"utilization", Property{Host: "h", Port: 1, Inbound: 8, HasIn: true, InUtil: &util, OutUtil: &util, Clock: 1},
+			"interface,host=h,port=1 in=8i,in_util=12.5,out_util=12.5 1000000000"},
+		{"no fields", Property{Host: "h", Port: 1, Clock: 1}, ""},
+	}
+	for _, c := range cases {
+		if got := PropertyToLine(&c.p); got != c.want {
+			t.Errorf("%s:\n got %s\nwant %s", c.name, got, c.want)
+		}
+	}
+}
+
+func flowPayload(host string, ports ...int) *Payload {
+	p := &Payload{Type: PAYLOAD_FLOW, Host: host}
+	for _, port := range ports {
+		p.Properties = append(p.Properties, &Property{Host: host, Port: port, Inbound: int64(port), HasIn: true, Clock: 1})
+	}
+	return p
+}
+
+//批次满时写出, 剩余的行在Flush时写出; gzip时每个批次是一个gzip成员
+func TestInfluxSinkBatch(t *testing.T) {
+	for _, useGzip := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "influx.txt")
+		s, err := NewInfluxSink(path, 3, useGzip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Send(flowPayload("a", 1, 2)); err != nil {
+			t.Fatal(err)
+		}
+		//非流量数据不写入
+		if err := s.Send(&Payload{Type: PAYLOAD_TRAP, Host: "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Send(flowPayload("b", 1, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if s.lines != 0 || len(s.pending) != 0 {
+			t.Fatalf("gzip %v: %d lines pending after a full batch", useGzip, s.lines)
+		}
+		if err := s.Send(flowPayload("c", 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		if useGzip {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = ioutil.ReadAll(zr)
+		} else {
+			data, err = ioutil.ReadAll(f)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "interface,host=a,port=1 in=1i 1000000000\ninterface,host=a,port=2 in=2i 1000000000\n" +
+			"interface,host=b,port=1 in=1i 1000000000\ninterface,host=b,port=2 in=2i 1000000000\n" +
+			"interface,host=c,port=1 in=1i 1000000000\n"
+		if string(data) != want {
+			t.Fatalf("gzip %v: content\n%s", useGzip, data)
+		}
+	}
+}
+
+//写出失败时返回包含整个批次的*FlushError, 并清空批次
+func TestInfluxSinkFlushError(t *testing.T) {
+	s, err := NewInfluxSink(filepath.Join(t.TempDir(), "influx.txt"), 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	a, b := flowPayload("a", 1), flowPayload("b", 1)
+	s.Send(a)
+	s.Send(b)
+	fe, ok := s.Flush().(*FlushError)
+	if !ok || len(fe.Payloads) != 2 || fe.Payloads[0] != a || fe.Payloads[1] != b {
+		t.Fatalf("Flush error %#v", fe)
+	}
+	if s.lines != 0 || s.buf.Len() != 0 || len(s.pending) != 0 {
+		t.Fatalf("batch not reset: %d lines, %d bytes, %d payloads", s.lines, s.buf.Len(), len(s.pending))
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("empty Flush: %v", err)
+	}
+}
@@ -1,17 +1,18 @@
 package yoman
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/domac/yoman/config"
 	"github.com/domac/yoman/core"
 	"github.com/domac/yoman/snmp"
+	"strings"
 	"time"
 )
 
-const version = snmp.SNMPv2c //SNMP协议版本
-var Erroc int = 0
-var Wgroutinue int = 0
+//共享套接字的SNMP引擎, 为空时每个任务使用单独的套接字
+var snmpEngine *snmp.Engine
 
 //交换机采集结果
 type SwitchResult struct {
@@ -21,6 +22,14 @@ type SwitchResult struct {
 	STime int64
 	ETime int64
 	Oid   string
+
+	IfName     string //接口名称, 由接口元数据填充
+	IfAlias    string //接口描述
+	Speed      int64  //接口速率(bps), 0表示未知
+	OperStatus string //接口运行状态
+	SUptime    int64  //采集时设备的sysUpTime(百分之一秒), 0表示未知
+	SWidth     int    //计数器位数(32/64), 0表示非计数器
+	Rate       bool   //SFlow为bps速率而非原始计数
 }
 
 func NewSwitchResult(host, port, flow, oid string) *SwitchResult {
@@ -42,85 +51,287 @@ type SwitchRequest struct {
 
 //任务作业结构
 type Job struct {
-	Id          string
-	Host        string
-	Community   string
-	Oid         string
-	Result      []*SwitchResult
-	fail        bool
-	failMessage string
-	Timeout     int
-	Retries     int
-}
-
-func NewJob(id string, host string, community string, oid string, timeout int, retries int) *Job {
+	Id         string
+	Host       string
+	Community  string
+	Switch     config.Switch
+	Oids       []string //同一会话中采集的oid
+	Timeout    int
+	Retries    int
+	WithUptime bool         //同时采集sysUpTime, 用于速率计算时识别设备重启
+	Meta       *IfMetaCache `json:"-"` //接口元数据缓存, 为空时不采集元数据
+
+	unresolved bool //从任务日志恢复但清单中已经没有该设备, 无法取得凭据
+}
+
+//任务日志中保存的采集任务: 只保存设备地址(清单中设备的键)和采集参数,
+//community和v3口令等凭据不写入磁盘, 恢复时由ResolveSwitch从清单重新取得
+type jobRecord struct {
+	Id         string   `json:"id"`
+	Host       string   `json:"host"`
+	Oids       []string `json:"oids"`
+	Timeout    int      `json:"timeout"`
+	Retries    int      `json:"retries"`
+	WithUptime bool     `json:"with_uptime,omitempty"`
+}
+
+func (j *Job) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jobRecord{
+		Id:         j.Id,
+		Host:       j.Host,
+		Oids:       j.Oids,
+		Timeout:    j.Timeout,
+		Retries:    j.Retries,
+		WithUptime: j.WithUptime,
+	})
+}
+
+func (j *Job) UnmarshalJSON(data []byte) error {
+	var r jobRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	*j = Job{
+		Id:         r.Id,
+		Host:       r.Host,
+		Switch:     config.Switch{Host: r.Host},
+		Oids:       r.Oids,
+		Timeout:    r.Timeout,
+		Retries:    r.Retries,
+		WithUptime: r.WithUptime,
+		unresolved: true,
+	}
+	return nil
+}
+
+//从清单中取得恢复的任务的设备配置(凭据); 清单中没有该设备时返回false, 任务执行时以不可重试的错误失败
+func (j *Job) ResolveSwitch(items []config.Switch) bool {
+	for _, item := range items {
+		if item.Host == j.Host {
+			j.Switch = item
+			j.Community = item.Community
+			j.unresolved = false
+			return true
+		}
+	}
+	return false
+}
+
+//采集任务可以写入任务日志, 重新运行时恢复
+const JOB_KIND = "snmp-job"
+
+func init() {
+	core.RegisterRunnable(JOB_KIND, func() core.Runnable {
+		return &Job{}
+	})
+}
+
+//采集任务的结果
+type JobResult struct {
+	Host     string
+	Oids     []string
+	Results  []*SwitchResult
+	Duration time.Duration //采集耗时
+}
+
+func NewJob(id string, sw config.Switch, oids []string, timeout int, retries int) *Job {
 	return &Job{
 		Id:        id,
-		Oid:       oid,
-		Host:      host,
-		Community: community,
+		Oids:      oids,
+		Host:      sw.Host,
+		Community: sw.Community,
+		Switch:    sw,
 		Timeout:   timeout,
 		Retries:   retries,
 	}
 }
 
-func (j *Job) SetFailure(message string) {
-	j.fail = true
-	j.failMessage = message
+//根据交换机配置创建SNMP客户端: 配置了v3用户时使用USM, 否则使用community
+func NewSNMPClient(sw config.Switch, timeout int, retries int) (*snmp.WapSNMP, error) {
+	wsnmp, err := newSNMPClient(sw, timeout, retries)
+	if err != nil {
+		return nil, err
+	}
+	wsnmp.SetMaxRepetitions(sw.MaxRepetitions)
+	wsnmp.SetBufferSize(sw.BufferSize)
+	return wsnmp, nil
 }
 
-func (j *Job) Do() {
-	oid := snmp.MustParseOid(j.Oid)
-	result := []*SwitchResult{}
-	wsnmp, err := snmp.NewWapSNMP(j.Host, j.Community, version, time.Duration(j.Timeout)*time.Millisecond, j.Retries)
-	defer wsnmp.Close()
+func newSNMPClient(sw config.Switch, timeout int, retries int) (*snmp.WapSNMP, error) {
+	t := time.Duration(timeout) * time.Millisecond
+	if sw.User == "" {
+		version, err := snmp.ParseVersion(sw.Version)
+		if err != nil {
+			return nil, core.Permanent(err)
+		}
+		if version == snmp.SNMPv3 {
+			return nil, core.Permanent(fmt.Errorf("host(%s): snmp v3 requires user", sw.Host))
+		}
+		if snmpEngine != nil {
+			return snmp.NewWapSNMPOnEngine(sw.Host, sw.Community, version, t, retries, snmpEngine)
+		}
+		return snmp.NewWapSNMP(sw.Host, sw.Community, version, t, retries)
+	}
+	//配置错误, 重试也不会成功
+	authProtocol, err := snmp.ParseAuthProtocol(sw.AuthProtocol)
 	if err != nil {
-		Erroc++
-		j.SetFailure(err.Error())
-	} else {
+		return nil, core.Permanent(err)
+	}
+	privProtocol, err := snmp.ParsePrivProtocol(sw.PrivProtocol)
+	if err != nil {
+		return nil, core.Permanent(err)
+	}
+	return snmp.NewWapSNMPv3(sw.Host, &snmp.UsmParams{
+		UserName:       sw.User,
+		AuthProtocol:   authProtocol,
+		AuthPassphrase: sw.AuthPassphrase,
+		PrivProtocol:   privProtocol,
+		PrivPassphrase: sw.PrivPassphrase,
+		ContextName:    sw.ContextName,
+	}, t, retries)
+}
 
-		if !*Debug {
-			table, err := wsnmp.GetTable(oid)
-			if err != nil {
-				Erroc++
-				j.SetFailure(err.Error())
-			} else {
-				for k, v := range table {
-					_, port := SplitData(k)
-					flow := fmt.Sprintf("%v", v)
-					result = append(result, NewSwitchResult(j.Host, port, flow, j.Oid))
-				}
+func (j *Job) Kind() string {
+	return JOB_KIND
+}
+
+func (j *Job) String() string {
+	return fmt.Sprintf("oid(%s)连接host(%s)", strings.Join(j.Oids, ","), j.Host)
+}
+
+//在一个会话中采集交换机的全部oid, ctx取消时关闭连接中断正在进行的请求
+func (j *Job) Run(ctx context.Context) (core.Result, error) {
+	begin := time.Now()
+	jr := &JobResult{Host: j.Host, Oids: j.Oids}
+	results, err := j.collect(ctx)
+	jr.Results = results
+	jr.Duration = time.Since(begin)
+	return jr, err
+}
+
+func (j *Job) collect(ctx context.Context) ([]*SwitchResult, error) {
+	if j.unresolved {
+		return nil, core.Permanent(fmt.Errorf("host(%s) is not in the inventory", j.Host))
+	}
+	oids := make([]snmp.Oid, len(j.Oids))
+	for i, o := range j.Oids {
+		oids[i] = snmp.MustParseOid(o)
+	}
+	wsnmp, err := NewSNMPClient(j.Switch, j.Timeout, j.Retries)
+	if err != nil {
+		return nil, err
+	}
+	defer wsnmp.Close()
+	defer closeOnCancel(ctx, wsnmp)()
+
+	result := []*SwitchResult{}
+	if *Debug {
+		values, err := wsnmp.GetMultiple(oids)
+		if err != nil {
+			return nil, err
+		}
+		meta := j.ifMeta(wsnmp)
+		for i, oid := range oids {
+			v, ok := values[oid.String()]
+			if !ok {
+				continue
 			}
-		} else {
-			woid, err := wsnmp.Get(oid)
-			if err != nil {
-				Erroc++
-				j.SetFailure(err.Error())
-			} else {
-				flow := fmt.Sprintf("%v", woid)
-				_, port := SplitData(oid.String())
-				result = append(result, NewSwitchResult(j.Host, port, flow, j.Oid))
+			flow := fmt.Sprintf("%v", v)
+			_, port := SplitData(oid.String())
+			sr := NewSwitchResult(j.Host, port, flow, j.Oids[i])
+			if m, ok := meta[port]; ok {
+				m.apply(sr)
+			}
+			result = append(result, sr)
+		}
+		return result, nil
+	}
+
+	//多个列合并到同一个GetBulk请求, 同一端口的出入站数据来自同一时刻
+	tables, err := wsnmp.GetTables(oids)
+	if err != nil {
+		return nil, err
+	}
+	uptime := int64(0)
+	if j.WithUptime {
+		if v, err := wsnmp.Get(snmp.MustParseOid(Oid_SysUpTime)); err == nil {
+			if d, ok := v.(time.Duration); ok {
+				uptime = int64(d / (10 * time.Millisecond))
+			}
+		}
+	}
+	meta := j.ifMeta(wsnmp)
+	for i, oid := range oids {
+		for k, v := range tables[oid.String()] {
+			_, port := SplitData(k)
+			flow := fmt.Sprintf("%v", v)
+			sr := NewSwitchResult(j.Host, port, flow, j.Oids[i])
+			sr.SUptime = uptime
+			sr.SWidth = counterWidth(v)
+			if m, ok := meta[port]; ok {
+				m.apply(sr)
 			}
+			result = append(result, sr)
 		}
+	}
+	return result, nil
+}
 
+//ctx取消时关闭SNMP连接, 阻塞中的读写立即返回; 返回的函数用于停止监听
+func closeOnCancel(ctx context.Context, wsnmp *snmp.WapSNMP) func() {
+	stop := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			wsnmp.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
 	}
-	Wgroutinue++
-	j.Result = result
+}
+
+//设备的接口元数据
+func (j *Job) ifMeta(wsnmp *snmp.WapSNMP) map[string]*IfMeta {
+	if j.Meta == nil {
+		return nil
+	}
+	return j.Meta.Get(wsnmp, j.Host)
+}
+
+//计数器位数
+func counterWidth(v interface{}) int {
+	switch v.(type) {
+	case snmp.Counter:
+		return 32
+	case snmp.Counter64:
+		return 64
+	}
+	return 0
 }
 
 //上报方法回调
 func GenerateMessageReportMethod(r *Report) core.MF {
 	return func(task core.Task) {
-		tj := (*task.TargetObj).(*Job)
-		if !tj.fail {
-			//遍历结果,进行上报
-			for _, res := range tj.Result {
-				res.STime = task.StartTime
-				res.ETime = task.EndTime
-				r.AddResult(res)
-			}
-		} else {
-			fmt.Printf("oid(%s)连接host(%s)出现异常 : %s \n", tj.Oid, tj.Host, tj.failMessage)
+		jr, ok := task.Result.(*JobResult)
+		if !ok {
+			//任务被取消或者超时
+			fmt.Printf("%v任务未完成 : %s \n", task.Runnable, task.Err)
+			return
+		}
+		if r.exporter != nil {
+			r.exporter.ObservePoll(jr.Host, strings.Join(jr.Oids, ","), jr.Duration)
+		}
+		if task.Err != nil {
+			fmt.Printf("oid(%s)连接host(%s)出现异常(执行%d次) : %s \n", strings.Join(jr.Oids, ","), jr.Host, task.Attempts, task.Err)
+			return
+		}
+		//遍历结果,进行上报
+		for _, res := range jr.Results {
+			res.STime = task.StartTime
+			res.ETime = task.EndTime
+			r.AddResult(res)
 		}
 	}
 }
@@ -0,0 +1,135 @@
+package yoman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/domac/yoman/config"
+	"github.com/domac/yoman/core"
+	"github.com/domac/yoman/snmp"
+	"strings"
+	"testing"
+	"time"
+)
+
+//模拟交换机: ports个端口的ifHCInOctets/ifHCOutOctets, ifName, ifOperStatus 以及 sysUpTime
+func startSwitch(t *testing.T, ports int) *snmp.Agent {
+	a := snmp.NewAgent("public")
+	values := []snmp.SNMPValue{{Oid: snmp.MustParseOid(Oid_SysUpTime), Value: 12345 * 10 * time.Millisecond}}
+	for i := 1; i <= ports; i++ {
+		index := fmt.Sprintf(".%d", i)
+		values = append(values,
+			snmp.SNMPValue{Oid: snmp.MustParseOid(Oid_Inbound + index), Value: snmp.Counter64(1000 + i)},
+			snmp.SNMPValue{Oid: snmp.MustParseOid(Oid_Outbound + index), Value: snmp.Counter64(2000 + i)},
+			snmp.SNMPValue{Oid: snmp.MustParseOid(Oid_IfName + index), Value: fmt.Sprintf("Gi0/%d", i)},
+			snmp.SNMPValue{Oid: snmp.MustParseOid(Oid_IfOperStatus + index), Value: int64(1)})
+	}
+	a.Load(values)
+	if err := a.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestJobRun(t *testing.T) {
+	a := startSwitch(t, 40)
+	//不支持ifAlias的设备, 其他元数据照常采集
+	a.AddFault(snmp.Fault{Prefix: snmp.MustParseOid(Oid_IfAlias), ErrorStatus: snmp.GenErr})
+	host := a.Addr().String()
+
+	for _, version := range []string{"v1", "v2c"} {
+		job := NewJob("1", config.Switch{Host: host, Community: "public", Version: version}, []string{Oid_Inbound, Oid_Outbound}, 1000, 0)
+		job.WithUptime = true
+		job.Meta = NewIfMetaCache(time.Hour)
+		res, err := job.Run(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %s", version, err)
+		}
+		jr := res.(*JobResult)
+		if jr.Host != host || len(jr.Results) != 80 {
+			t.Fatalf("%s: host %s, %d results", version, jr.Host, len(jr.Results))
+		}
+		for _, sr := range jr.Results {
+			base := 1000
+			if sr.Oid == Oid_Outbound {
+				base = 2000
+			}
+			var port int
+			fmt.Sscanf(sr.SPort, "%d", &port)
+			if sr.SFlow != fmt.Sprintf("%d", base+port) {
+				t.Fatalf("%s: port %s flow %s, want %d", version, sr.SPort, sr.SFlow, base+port)
+			}
+			if sr.IfName != "Gi0/"+sr.SPort || sr.OperStatus != "up" {
+				t.Fatalf("%s: port %s meta %q %q", version, sr.SPort, sr.IfName, sr.OperStatus)
+			}
+			if sr.SUptime != 12345 || sr.SWidth != 64 || sr.Shost != host {
+				t.Fatalf("%s: port %s uptime %d width %d", version, sr.SPort, sr.SUptime, sr.SWidth)
+			}
+		}
+	}
+}
+
+//ctx取消时中断正在等待响应的请求
+func TestJobRunCancel(t *testing.T) {
+	a := startSwitch(t, 1)
+	a.AddFault(snmp.Fault{Prefix: snmp.MustParseOid(Oid_Inbound), Delay: 5 * time.Second})
+	job := NewJob("1", config.Switch{Host: a.Addr().String(), Community: "public"}, []string{Oid_Inbound}, 10000, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if _, err := job.Run(ctx); err == nil {
+		t.Fatal("expected an error")
+	}
+	if d := time.Since(begin); d > 2*time.Second {
+		t.Fatalf("Run returned after %s", d)
+	}
+}
+
+//任务日志中不保存凭据, 恢复时从清单重新取得
+func TestJobPersistence(t *testing.T) {
+	sw := config.Switch{
+		Host:           "10.0.0.1",
+		Community:      "secret-community",
+		User:           "admin",
+		AuthProtocol:   "sha",
+		AuthPassphrase: "secret-auth",
+		PrivProtocol:   "aes",
+		PrivPassphrase: "secret-priv",
+	}
+	job := NewJob("7", sw, []string{Oid_Inbound, Oid_Outbound}, 1000, 2)
+	job.WithUptime = true
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret-community", "secret-auth", "secret-priv", "admin"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("%s persisted: %s", secret, data)
+		}
+	}
+
+	restored := &Job{}
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Id != "7" || restored.Host != sw.Host || len(restored.Oids) != 2 || restored.Timeout != 1000 || restored.Retries != 2 || !restored.WithUptime {
+		t.Fatalf("restored %+v", restored)
+	}
+	//清单中没有该设备
+	if restored.ResolveSwitch([]config.Switch{{Host: "10.0.0.2"}}) {
+		t.Fatal("resolved a host that is not in the inventory")
+	}
+	if _, err := restored.Run(context.Background()); !isPermanent(err) {
+		t.Fatalf("Run error = %v, want a permanent error", err)
+	}
+	if !restored.ResolveSwitch([]config.Switch{{Host: "10.0.0.2"}, sw}) || restored.Switch != sw || restored.Community != sw.Community {
+		t.Fatalf("resolved switch %+v", restored.Switch)
+	}
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(core.PermanentError)
+	return ok
+}
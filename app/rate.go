@@ -0,0 +1,87 @@
+package yoman
+
+import (
+	"math"
+	"strconv"
+	"sync"
+)
+
+//速率计算器: 保存每个 host/port/oid 上一次的采集结果, 用两次采集的计数差值计算bps
+type RateCalculator struct {
+	mutex sync.Mutex
+	last  map[string]*SwitchResult
+}
+
+func NewRateCalculator() *RateCalculator {
+	return &RateCalculator{
+		last: make(map[string]*SwitchResult),
+	}
+}
+
+func rateKey(s *SwitchResult) string {
+	return s.Shost + "|" + s.SPort + "|" + s.Oid
+}
+
+//计算速率, 第一次采集、设备重启或者数据异常时返回false(该样本只作为下一次计算的基准)
+func (rc *RateCalculator) Compute(cur *SwitchResult) (*SwitchResult, bool) {
+	curValue, err := strconv.ParseUint(cur.SFlow, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	rc.mutex.Lock()
+	prev, ok := rc.last[rateKey(cur)]
+	rc.last[rateKey(cur)] = cur
+	rc.mutex.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	prevValue, err := strconv.ParseUint(prev.SFlow, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	//sysUpTime变小说明设备重启过, 跨重启的样本丢弃
+	if cur.SUptime > 0 && prev.SUptime > 0 && cur.SUptime < prev.SUptime {
+		return nil, false
+	}
+
+	//优先使用设备的sysUpTime计算间隔, 取不到时使用采集完成时间
+	var seconds float64
+	if cur.SUptime > 0 && prev.SUptime > 0 {
+		seconds = float64(cur.SUptime-prev.SUptime) / 100
+	} else {
+		seconds = float64(cur.ETime - prev.ETime)
+	}
+	if seconds <= 0 {
+		return nil, false
+	}
+
+	delta, ok := counterDelta(prevValue, curValue, cur.SWidth)
+	if !ok {
+		return nil, false
+	}
+
+	bps := float64(delta) * 8 / seconds
+	//超过接口速率的结果不可信(例如计数器被清零后又回绕), 丢弃
+	if cur.Speed > 0 && bps > float64(cur.Speed) {
+		return nil, false
+	}
+	rate := *cur
+	rate.SFlow = strconv.FormatUint(uint64(math.Floor(bps+0.5)), 10)
+	rate.Rate = true
+	return &rate, true
+}
+
+//计数器差值, 处理32位计数器回绕;
+//64位计数器实际上不会回绕(100Gb/s下需要数十年), 变小说明计数器被清零或者不连续, 丢弃
+func counterDelta(prev, cur uint64, width int) (uint64, bool) {
+	if cur >= prev {
+		return cur - prev, true
+	}
+	if width != 32 || prev > math.MaxUint32 {
+		return 0, false
+	}
+	return uint64(uint32(cur) - uint32(prev)), true
+}
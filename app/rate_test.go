@@ -0,0 +1,73 @@
+package yoman
+
+import (
+	"testing"
+)
+
+func sample(flow string, uptime, etime int64, width int) *SwitchResult {
+	sr := NewSwitchResult("10.0.0.1", "1", flow, Oid_Inbound)
+	sr.SUptime = uptime
+	sr.ETime = etime
+	sr.SWidth = width
+	return sr
+}
+
+func TestRateCompute(t *testing.T) {
+	cases := []struct {
+		name   string
+		prev   *SwitchResult
+		cur    *SwitchResult
+		speed  int64
+		want   string
+		wantOk bool
+	}{
+		//(2^32-1000 -> 1000) 差值2000字节, 10秒
+		{"32-bit wrap", sample("4294966296", 1000, 0, 32), sample("1000", 2000, 0, 32), 0, "1600", true},
+		{"64-bit increase", sample("1000", 1000, 0, 64), sample("126000", 2000, 0, 64), 0, "100000", true},
+		{"64-bit decrease", sample("5000", 1000, 0, 64), sample("1000", 2000, 0, 64), 0, "", false},
+		{"uptime decrease", sample("1000", 5000, 0, 64), sample("2000", 1000, 0, 64), 0, "", false},
+		{"zero interval", sample("1000", 1000, 0, 64), sample("2000", 1000, 0, 64), 0, "", false},
+		{"negative interval", sample("1000", 0, 100, 64), sample("2000", 0, 90, 64), 0, "", false},
+		//没有sysUpTime时使用采集完成时间
+		{"etime interval", sample("1000", 0, 100, 64), sample("3000", 0, 104, 64), 0, "4000", true},
+		{"above speed", sample("1000", 1000, 0, 64), sample("126000", 2000, 0, 64), 10000, "", false},
+		{"within speed", sample("1000", 1000, 0, 64), sample("126000", 2000, 0, 64), 100000, "100000", true},
+		{"not a number", sample("1000", 1000, 0, 64), sample("n/a", 2000, 0, 64), 0, "", false},
+	}
+	for _, c := range cases {
+		rc := NewRateCalculator()
+		c.cur.Speed = c.speed
+		if _, ok := rc.Compute(c.prev); ok {
+			t.Fatalf("%s: first sample returned a rate", c.name)
+		}
+		rate, ok := rc.Compute(c.cur)
+		if ok != c.wantOk {
+			t.Fatalf("%s: ok = %v, want %v", c.name, ok, c.wantOk)
+		}
+		if !ok {
+			continue
+		}
+		if rate.SFlow != c.want || !rate.Rate {
+			t.Fatalf("%s: rate = %s (Rate %v), want %s", c.name, rate.SFlow, rate.Rate, c.want)
+		}
+		if c.cur.Rate {
+			t.Fatalf("%s: the sample was marked as a rate", c.name)
+		}
+	}
+}
+
+//不同端口与方向分别计算
+func TestRateComputeKeys(t *testing.T) {
+	rc := NewRateCalculator()
+	in := sample("1000", 1000, 0, 64)
+	out := sample("1000", 1000, 0, 64)
+	out.Oid = Oid_Outbound
+	rc.Compute(in)
+	if _, ok := rc.Compute(out); ok {
+		t.Fatal("the outbound sample used the inbound baseline")
+	}
+	rate, ok := rc.Compute(sample("2250", 2000, 0, 64))
+	if !ok || rate.SFlow != "1000" {
+		t.Fatalf("rate = %v, %v", rate, ok)
+	}
+}
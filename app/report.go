@@ -2,6 +2,7 @@ package yoman
 
 import (
 	"encoding/json"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -9,28 +10,59 @@ import (
 
 //上报数据属性
 type Property struct {
-	Oid         string `json:"oid"`
-	Inbound     int64  `json:"in_bound"`
-	OutBound    int64  `json:"out_bound"`
-	Port        int    `json:"port"`
-	Host        string `json:"host"`
-	Start_clock int64  `json:"start_clock"`
-	Clock       int64  `json:"clock"`
+	Oid         string   `json:"oid"`
+	Inbound     int64    `json:"in_bound"`
+	OutBound    int64    `json:"out_bound"`
+	Port        int      `json:"port"`
+	Host        string   `json:"host"`
+	IfName      string   `json:"if_name,omitempty"`
+	IfAlias     string   `json:"if_alias,omitempty"`
+	Speed       int64    `json:"speed,omitempty"`       //接口速率(bps)
+	OperStatus  string   `json:"oper_status,omitempty"` //接口运行状态: up, down 等
+	Start_clock int64    `json:"start_clock"`
+	Clock       int64    `json:"clock"`
+	Unit        string   `json:"unit,omitempty"`     //bps: in_bound/out_bound为速率
+	InUtil      *float64 `json:"in_util,omitempty"`  //入站利用率(%), 仅速率数据且接口速率已知时有值
+	OutUtil     *float64 `json:"out_util,omitempty"` //出站利用率(%)
+	HasIn       bool     `json:"has_in,omitempty"`   //采集到入站数据, 区分没有采集和值为0
+	HasOut      bool     `json:"has_out,omitempty"`  //采集到出站数据
 }
 
 type Report struct {
-	mutex     sync.Mutex //互斥锁
-	Data      map[string][]*SwitchResult
-	Reporturi string
+	mutex    sync.Mutex //互斥锁
+	Data     map[string][]*SwitchResult
+	Sinks    *SinkGroup      //上报目的地
+	rates    *RateCalculator //设置后上报速率而非原始计数
+	exporter *Exporter       //Prometheus指标导出
 }
 
-func NewReport(reporturi string) *Report {
+func NewReport(sinks *SinkGroup) *Report {
 	return &Report{
-		Data:      make(map[string][]*SwitchResult),
-		Reporturi: reporturi}
+		Data:  make(map[string][]*SwitchResult),
+		Sinks: sinks}
+}
+
+//设置速率计算器(守护模式)
+func (r *Report) SetRateCalculator(rc *RateCalculator) {
+	r.rates = rc
+}
+
+//设置指标导出
+func (r *Report) SetExporter(e *Exporter) {
+	r.exporter = e
 }
 
 func (r *Report) AddResult(s *SwitchResult) {
+	if r.exporter != nil {
+		r.exporter.Observe(s)
+	}
+	if r.rates != nil {
+		rate, ok := r.rates.Compute(s)
+		if !ok {
+			return
+		}
+		s = rate
+	}
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	if _, ok := r.Data[s.Shost]; ok {
@@ -55,20 +87,35 @@ func (r *Report) GetReportCount() int64 {
 //发送报告数据
 func (r *Report) SendData() int64 {
 	count := int64(0)
-	for _, v := range r.Data {
-		c := int64(0)
-		params := make(map[string]string)
-		params["data"], c = SwitchCollectData(v) //每个交换机的采集结果
-		count = count + c
-		if r.Reporturi != "" && len(r.Reporturi) > 5 {
-			yomanClient.Post(r.Reporturi, params)
-		}
+	for host, v := range r.Data {
+		properties := CollectProperties(v) //每个交换机的采集结果
+		count = count + int64(len(properties))
+		r.Sinks.Send(&Payload{
+			Type:       PAYLOAD_FLOW,
+			Host:       host,
+			Properties: properties,
+		})
 	}
+	r.Sinks.Flush()
 	return count
 }
 
 //生成端口为参考指标的上报数据
 func SwitchCollectData(switchResults []*SwitchResult) (string, int64) {
+	return ConvertToJson(collectPortMap(switchResults))
+}
+
+//生成端口为参考指标的属性列表
+func CollectProperties(switchResults []*SwitchResult) []*Property {
+	plist := []*Property{}
+	for port, property := range collectPortMap(switchResults) {
+		property.Port, _ = strconv.Atoi(port)
+		plist = append(plist, property)
+	}
+	return plist
+}
+
+func collectPortMap(switchResults []*SwitchResult) map[string]*Property {
 	portMap := make(map[string]*Property) //port-oid-data
 	for _, sr := range switchResults {
 		property := new(Property)
@@ -78,7 +125,7 @@ func SwitchCollectData(switchResults []*SwitchResult) (string, int64) {
 		property.setProperty(sr)
 		portMap[sr.SPort] = property
 	}
-	return ConvertToJson(portMap)
+	return portMap
 }
 
 //设置属性
@@ -88,24 +135,58 @@ func (p *Property) setProperty(sr *SwitchResult) {
 	p.Clock = sr.ETime
 	p.Host = sr.Shost
 	p.Oid = sr.Oid
+	if sr.IfName != "" {
+		p.IfName = sr.IfName
+	}
+	if sr.IfAlias != "" {
+		p.IfAlias = sr.IfAlias
+	}
+	if sr.Speed > 0 {
+		p.Speed = sr.Speed
+	}
+	if sr.OperStatus != "" {
+		p.OperStatus = sr.OperStatus
+	}
 	flow, _ := strconv.Atoi(sr.SFlow)
+	var util *float64
+	if sr.Rate {
+		p.Unit = "bps"
+		util = utilisation(int64(flow), sr.Speed)
+	}
 
 	if !*Debug {
 		if sr.Oid == Oid_Inbound {
 			p.Inbound = int64(flow)
+			p.InUtil = util
+			p.HasIn = true
 		} else if sr.Oid == Oid_Outbound {
 			p.OutBound = int64(flow)
+			p.OutUtil = util
+			p.HasOut = true
 		}
 	} else {
 		if strings.Contains(sr.Oid, Oid_Inbound) {
 			p.Inbound = int64(flow)
+			p.InUtil = util
+			p.HasIn = true
 		} else if strings.Contains(sr.Oid, Oid_Outbound) {
 			p.OutBound = int64(flow)
+			p.OutUtil = util
+			p.HasOut = true
 		}
 	}
 
 }
 
+//接口利用率(%), 保留两位小数
+func utilisation(bps int64, speed int64) *float64 {
+	if speed <= 0 {
+		return nil
+	}
+	util := math.Floor(float64(bps)*10000/float64(speed)+0.5) / 100
+	return &util
+}
+
 //转化为json格式
 func ConvertToJson(p map[string]*Property) (data string, count int64) {
 	if p == nil {
@@ -0,0 +1,59 @@
+package yoman
+
+import (
+	"context"
+	"fmt"
+	"github.com/domac/yoman/snmp"
+	"net"
+	"strconv"
+	"time"
+)
+
+//模拟器的故障注入和计数器增长参数
+type SimulateOptions struct {
+	Rate  float64       //全部计数器每秒增加的值
+	Drop  float64       //请求不回复的概率(0-1)
+	Delay time.Duration //回复前等待的时间
+}
+
+//SNMP代理模拟器: 每个snmpwalk文件模拟一台设备, 第i个文件监听addr的端口加i, ctx取消后返回
+func Simulate(ctx context.Context, files []string, addr string, opts SimulateOptions) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no snmpwalk files to simulate")
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	agents := []*snmp.Agent{}
+	defer func() {
+		for _, agent := range agents {
+			agent.Close()
+		}
+	}()
+	for i, file := range files {
+		agent := snmp.NewAgent("")
+		if err := agent.LoadWalkFile(file); err != nil {
+			return err
+		}
+		if opts.Rate > 0 {
+			agent.SetCounterRate(snmp.Oid{}, opts.Rate)
+		}
+		if opts.Drop > 0 || opts.Delay > 0 {
+			agent.AddFault(snmp.Fault{Drop: opts.Drop, Delay: opts.Delay})
+		}
+		listen := net.JoinHostPort(host, strconv.Itoa(port+i))
+		if err := agent.Start(listen); err != nil {
+			return err
+		}
+		agents = append(agents, agent)
+		fmt.Printf("模拟设备 %s 监听 %s \n", file, listen)
+	}
+	<-ctx.Done()
+	return nil
+}
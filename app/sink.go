@@ -0,0 +1,374 @@
+package yoman
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	client "github.com/domac/yoman/httpclient"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	PAYLOAD_FLOW = "flow" //接口流量数据
+	PAYLOAD_TRAP = "trap" //trap事件
+)
+
+//一次上报的数据
+type Payload struct {
+	Type       string       `json:"type"`
+	Host       string       `json:"host"`
+	Properties []*Property  `json:"properties,omitempty"`
+	Events     []*TrapEvent `json:"events,omitempty"`
+}
+
+//上报数据的JSON数组, 与原有 data 参数格式一致
+func (p *Payload) Data() string {
+	var v interface{} = p.Properties
+	if p.Type == PAYLOAD_TRAP {
+		v = p.Events
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+//数据上报目的地
+type Sink interface {
+	Name() string
+	Send(p *Payload) error
+}
+
+//批量上报的目的地实现Flusher, 每轮上报结束时写出缓存的数据
+type Flusher interface {
+	Flush() error
+}
+
+//缓存记录的目的地已经不在配置中, 重发不会成功
+var errSinkNotConfigured = errors.New("sink is not configured")
+
+//批次写出失败, 携带该批次包含的数据以便写入磁盘缓存
+type FlushError struct {
+	Payloads []*Payload
+	Err      error
+}
+
+func (e *FlushError) Error() string {
+	return e.Err.Error()
+}
+
+//HTTP表单上报 (data=JSON数组)
+type FormSink struct {
+	uri string
+}
+
+func NewFormSink(uri string) *FormSink {
+	return &FormSink{uri: uri}
+}
+
+func (s *FormSink) Name() string {
+	return "form"
+}
+
+func (s *FormSink) Send(p *Payload) error {
+	params := make(map[string]string)
+	params["data"] = p.Data()
+	if p.Type != PAYLOAD_FLOW {
+		params["type"] = p.Type
+	}
+	resp, err := yomanClient.Post(s.uri, params)
+	return checkResponse(resp, err)
+}
+
+//HTTP JSON请求体上报
+type JsonSink struct {
+	uri string
+}
+
+func NewJsonSink(uri string) *JsonSink {
+	return &JsonSink{uri: uri}
+}
+
+func (s *JsonSink) Name() string {
+	return "json"
+}
+
+func (s *JsonSink) Send(p *Payload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	headers := make(map[string]string)
+	headers["Content-Type"] = "application/json"
+	resp, err := yomanClient.Do("POST", s.uri, headers, bytes.NewReader(b))
+	return checkResponse(resp, err)
+}
+
+func checkResponse(resp *client.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+//标准输出, 每行一个JSON
+type StdoutSink struct {
+	mutex sync.Mutex
+}
+
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{}
+}
+
+func (s *StdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s *StdoutSink) Send(p *Payload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = fmt.Fprintln(os.Stdout, string(b))
+	return err
+}
+
+//文件追加写入, 每行一个JSON
+type FileSink struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file sink needs a file path, please input it by `-reportfile=` ")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{path: path, file: f}, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Send(p *Payload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.file.Write(append(b, '\n'))
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+//上报统计
+type SinkStats struct {
+	Sent      int64
+	Failed    int64
+	LastError string
+}
+
+//多个上报目的地同时上报, 分别统计成功与失败次数
+type SinkGroup struct {
+	sinks []Sink
+	stats []*SinkStats
+	mutex sync.Mutex //保护LastError
+	spool *Spool     //上报失败的数据写入磁盘缓存
+}
+
+func NewSinkGroup(sinks ...Sink) *SinkGroup {
+	g := &SinkGroup{}
+	for _, s := range sinks {
+		g.Add(s)
+	}
+	return g
+}
+
+//上报目的地参数
+type SinkOptions struct {
+	Reporturi   string //form, json
+	Reportfile  string //file
+	Influx      string //influx: http(s)地址或文件路径
+	InfluxBatch int
+	InfluxGzip  bool
+}
+
+//根据 -sinks 参数创建上报目的地, 例如 "form,stdout"
+func NewSinkGroupFromSpec(spec string, opts SinkOptions) (*SinkGroup, error) {
+	reporturi := opts.Reporturi
+	g := NewSinkGroup()
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "form", "json":
+			//未设置上报接口时不上报
+			if reporturi == "" || len(reporturi) <= 5 {
+				continue
+			}
+			if strings.TrimSpace(name) == "form" {
+				g.Add(NewFormSink(reporturi))
+			} else {
+				g.Add(NewJsonSink(reporturi))
+			}
+		case "stdout":
+			g.Add(NewStdoutSink())
+		case "file":
+			s, err := NewFileSink(opts.Reportfile)
+			if err != nil {
+				return nil, err
+			}
+			g.Add(s)
+		case "influx":
+			s, err := NewInfluxSink(opts.Influx, opts.InfluxBatch, opts.InfluxGzip)
+			if err != nil {
+				return nil, err
+			}
+			g.Add(s)
+		default:
+			return nil, fmt.Errorf("unknown sink %q", name)
+		}
+	}
+	return g, nil
+}
+
+func (g *SinkGroup) Add(s Sink) {
+	g.sinks = append(g.sinks, s)
+	g.stats = append(g.stats, &SinkStats{})
+}
+
+func (g *SinkGroup) Sinks() []Sink {
+	return g.sinks
+}
+
+//设置磁盘缓存
+func (g *SinkGroup) SetSpool(s *Spool) {
+	g.spool = s
+}
+
+//发送到全部目的地, 全部成功时返回true
+func (g *SinkGroup) Send(p *Payload) bool {
+	ok := true
+	for i, s := range g.sinks {
+		if err := s.Send(p); err != nil {
+			ok = false
+			g.fail(i, err)
+			fmt.Printf("上报(%s)host(%s)数据出现异常 : %s \n", s.Name(), p.Host, err)
+			g.spoolPayloads(s.Name(), err, p)
+			continue
+		}
+		atomic.AddInt64(&g.stats[i].Sent, 1)
+	}
+	return ok
+}
+
+//写出各目的地缓存的批次
+func (g *SinkGroup) Flush() bool {
+	ok := true
+	for i, s := range g.sinks {
+		f, isFlusher := s.(Flusher)
+		if !isFlusher {
+			continue
+		}
+		if err := f.Flush(); err != nil {
+			ok = false
+			g.fail(i, err)
+			fmt.Printf("上报(%s)批量写出出现异常 : %s \n", s.Name(), err)
+			g.spoolPayloads(s.Name(), err)
+		}
+	}
+	return ok
+}
+
+//把失败的数据写入磁盘缓存
+func (g *SinkGroup) spoolPayloads(sink string, err error, payloads ...*Payload) {
+	if g.spool == nil {
+		return
+	}
+	//批次写出失败时, 该批次已包含当前数据
+	if fe, ok := err.(*FlushError); ok {
+		payloads = fe.Payloads
+	}
+	for _, p := range payloads {
+		if e := g.spool.Write(sink, p); e != nil {
+			fmt.Printf("上报(%s)数据写入缓存出现异常 : %s \n", sink, e)
+		}
+	}
+}
+
+//重发缓存的数据到指定的目的地, 不再写入缓存; 批次写出失败时*FlushError中还可能包含正常上报的数据, 由调用者写入缓存
+func (g *SinkGroup) deliver(sink string, p *Payload) error {
+	for i, s := range g.sinks {
+		if s.Name() != sink {
+			continue
+		}
+		err := s.Send(p)
+		if f, ok := s.(Flusher); ok && err == nil {
+			err = f.Flush()
+		}
+		if err != nil {
+			g.fail(i, err)
+			return err
+		}
+		atomic.AddInt64(&g.stats[i].Sent, 1)
+		return nil
+	}
+	return errSinkNotConfigured
+}
+
+func (g *SinkGroup) fail(i int, err error) {
+	atomic.AddInt64(&g.stats[i].Failed, 1)
+	g.mutex.Lock()
+	g.stats[i].LastError = err.Error()
+	g.mutex.Unlock()
+}
+
+//关闭持有文件等资源的目的地, 退出前调用
+func (g *SinkGroup) Close() error {
+	var first error
+	for _, s := range g.sinks {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+//各目的地的上报统计
+func (g *SinkGroup) Stats() map[string]SinkStats {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	result := make(map[string]SinkStats)
+	for i, s := range g.sinks {
+		result[s.Name()] = SinkStats{
+			Sent:      atomic.LoadInt64(&g.stats[i].Sent),
+			Failed:    atomic.LoadInt64(&g.stats[i].Failed),
+			LastError: g.stats[i].LastError,
+		}
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package yoman
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//批量上报的目的地, Flush按fail返回包含整个批次的*FlushError
+type batchSink struct {
+	mutex   sync.Mutex
+	fail    bool
+	pending []*Payload
+	flushed int
+}
+
+func (s *batchSink) Name() string {
+	return "batch"
+}
+
+func (s *batchSink) Send(p *Payload) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pending = append(s.pending, p)
+	return nil
+}
+
+func (s *batchSink) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending := s.pending
+	s.pending = nil
+	if s.fail {
+		return &FlushError{Payloads: pending, Err: errors.New("batch rejected")}
+	}
+	s.flushed += len(pending)
+	return nil
+}
+
+//各目的地分别统计, 一个目的地失败不影响其他目的地
+func TestSinkGroupStats(t *testing.T) {
+	ok := &memorySink{name: "ok", limit: -1}
+	failing := &memorySink{name: "failing", limit: 1}
+	g := NewSinkGroup(ok, failing)
+	results := []bool{}
+	for _, host := range []string{"h0", "h1", "h2"} {
+		results = append(results, g.Send(&Payload{Host: host}))
+	}
+	if !results[0] || results[1] || results[2] {
+		t.Fatalf("Send results %v", results)
+	}
+	if got := ok.received(); got != "h0,h1,h2" {
+		t.Fatalf("ok sink received %s", got)
+	}
+
+	stats := g.Stats()
+	if s := stats["ok"]; s.Sent != 3 || s.Failed != 0 || s.LastError != "" {
+		t.Fatalf("ok sink stats %+v", s)
+	}
+	if s := stats["failing"]; s.Sent != 1 || s.Failed != 2 || s.LastError != "sink unavailable" {
+		t.Fatalf("failing sink stats %+v", s)
+	}
+}
+
+//发送失败的数据和写出失败的整个批次写入缓存, 并记录所属的目的地
+func TestSinkGroupSpool(t *testing.T) {
+	s := newTestSpool(t, 0, 0)
+	batch := &batchSink{fail: true}
+	failing := &memorySink{name: "failing", limit: 0}
+	g := NewSinkGroup(batch, failing)
+	g.SetSpool(s)
+
+	g.Send(&Payload{Host: "h0"})
+	g.Send(&Payload{Host: "h1"})
+	if g.Flush() {
+		t.Fatal("Flush succeeded")
+	}
+	stat := spoolStat(t, s)
+	if stat.Records != 4 || stat.Sinks["batch"] != 2 || stat.Sinks["failing"] != 2 {
+		t.Fatalf("stat %+v", stat)
+	}
+	if n := g.Stats()["batch"].Failed; n != 1 {
+		t.Fatalf("batch sink failed %d times, want 1", n)
+	}
+
+	//目的地恢复后重发到各自的目的地
+	batch.fail = false
+	failing.limit = -1
+	if sent, _, err := s.Replay(g); err != nil || sent != 4 {
+		t.Fatalf("replay: sent %d err %v", sent, err)
+	}
+	if batch.flushed != 2 || failing.received() != "h0,h1" {
+		t.Fatalf("batch flushed %d, failing sink received %s", batch.flushed, failing.received())
+	}
+}
+
+func TestNewSinkGroupFromSpec(t *testing.T) {
+	names := func(g *SinkGroup) string {
+		list := []string{}
+		for _, s := range g.Sinks() {
+			list = append(list, s.Name())
+		}
+		return strings.Join(list, ",")
+	}
+
+	//没有设置上报接口时跳过form和json
+	g, err := NewSinkGroupFromSpec("form, json,stdout", SinkOptions{})
+	if err != nil || names(g) != "stdout" {
+		t.Fatalf("sinks %v, err %v", g, err)
+	}
+	g, err = NewSinkGroupFromSpec("form,json", SinkOptions{Reporturi: "http://127.0.0.1/report"})
+	if err != nil || names(g) != "form,json" {
+		t.Fatalf("sinks %v, err %v", g, err)
+	}
+
+	if _, err := NewSinkGroupFromSpec("stdout,kafka", SinkOptions{}); err == nil || !strings.Contains(err.Error(), "kafka") {
+		t.Fatalf("unknown sink error = %v", err)
+	}
+	if _, err := NewSinkGroupFromSpec("file", SinkOptions{}); err == nil {
+		t.Fatal("file sink without a path")
+	}
+	if _, err := NewSinkGroupFromSpec("influx", SinkOptions{}); err == nil {
+		t.Fatal("influx sink without a target")
+	}
+}
+
+//每条数据一行JSON, 关闭后不再写入
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	g, err := NewSinkGroupFromSpec("file", SinkOptions{Reportfile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Send(&Payload{Type: PAYLOAD_FLOW, Host: "h0"})
+	g.Send(&Payload{Type: PAYLOAD_FLOW, Host: "h1"})
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if g.Send(&Payload{Type: PAYLOAD_FLOW, Host: "h2"}) {
+		t.Fatal("Send succeeded after Close")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"flow","host":"h0"}` + "\n" + `{"type":"flow","host":"h1"}` + "\n"
+	if string(data) != want {
+		t.Fatalf("file content %q", data)
+	}
+}
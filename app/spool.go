@@ -0,0 +1,404 @@
+package yoman
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SPOOL_SUFFIX = ".spool"
+
+//上报失败的数据
+type SpoolRecord struct {
+	Sink    string   `json:"sink"`
+	Time    int64    `json:"time"`
+	Payload *Payload `json:"payload"`
+}
+
+//磁盘缓存: 上报失败的数据以长度前缀记录写入目录中的分段文件, 下次运行或后台按顺序重发
+type Spool struct {
+	mutex       sync.Mutex
+	replayMutex sync.Mutex //同一时间只有一个重发, 重发期间不持有mutex
+	dir         string
+	maxSize     int64         //目录总大小上限, 超出时删除最旧的分段
+	maxAge      time.Duration //记录保存时长, 超出的记录在重发时丢弃
+	segmentSize int64         //分段文件超过该大小时切换新分段
+	current     *os.File      //当前写入的分段
+	written     int64
+	total       int64 //目录总大小, sized为false时需要重新读取目录
+	sized       bool
+}
+
+//分段文件的默认大小
+const spoolSegmentSize = 4 << 20
+
+func NewSpool(dir string, maxSize int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir, maxSize: maxSize, maxAge: maxAge, segmentSize: spoolSegmentSize}, nil
+}
+
+//写入一条上报失败的数据
+func (s *Spool) Write(sink string, p *Payload) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(sink, p)
+}
+
+func (s *Spool) write(sink string, p *Payload) error {
+	data, err := json.Marshal(&SpoolRecord{Sink: sink, Time: time.Now().Unix(), Payload: p})
+	if err != nil {
+		return err
+	}
+
+	if s.current == nil || s.written >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := writeRecord(s.current, data); err != nil {
+		return err
+	}
+	s.written += int64(4 + len(data))
+	return s.enforceSize(int64(4 + len(data)))
+}
+
+func (s *Spool) rotate() error {
+	if s.current != nil {
+		s.current.Close()
+	}
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), SPOOL_SUFFIX))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.current = nil
+		return err
+	}
+	s.current = f
+	s.written = 0
+	return nil
+}
+
+//写入n字节后检查目录大小, 超出上限时删除最旧的分段(不删除当前写入的分段); 只在首次检查和超出上限时读取目录
+func (s *Spool) enforceSize(n int64) error {
+	if s.maxSize <= 0 {
+		return nil
+	}
+	if s.sized {
+		s.total += n
+		if s.total <= s.maxSize {
+			return nil
+		}
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	total := int64(0)
+	for _, seg := range segments {
+		total += seg.size
+	}
+	for _, seg := range segments {
+		if total <= s.maxSize {
+			break
+		}
+		if s.current != nil && seg.path == s.current.Name() {
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		fmt.Printf("缓存目录超出大小上限, 丢弃分段 %s \n", filepath.Base(seg.path))
+		total -= seg.size
+	}
+	s.total, s.sized = total, true
+	return nil
+}
+
+type spoolSegment struct {
+	path string
+	size int64
+}
+
+//按写入顺序排列的分段文件
+func (s *Spool) segments() ([]spoolSegment, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []spoolSegment
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), SPOOL_SUFFIX) {
+			continue
+		}
+		result = append(result, spoolSegment{filepath.Join(s.dir, info.Name()), info.Size()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].path < result[j].path })
+	return result, nil
+}
+
+//缓存状态
+type SpoolStat struct {
+	Segments int
+	Records  int
+	Bytes    int64
+	Oldest   time.Time
+	Sinks    map[string]int
+}
+
+func (s *Spool) Stat() (*SpoolStat, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	stat := &SpoolStat{Segments: len(segments), Sinks: make(map[string]int)}
+	for _, seg := range segments {
+		stat.Bytes += seg.size
+		records, err := readSegment(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			stat.Records++
+			stat.Sinks[r.Sink]++
+			if t := time.Unix(r.Time, 0); stat.Oldest.IsZero() || t.Before(stat.Oldest) {
+				stat.Oldest = t
+			}
+		}
+	}
+	return stat, nil
+}
+
+//按顺序重发缓存的数据, 遇到失败时停止并保留剩余记录, 返回重发成功和丢弃(过期或者目的地已经移除)的记录数;
+//发送期间不持有锁, 同时上报失败的数据写入新的分段
+func (s *Spool) Replay(g *SinkGroup) (int, int, error) {
+	s.replayMutex.Lock()
+	defer s.replayMutex.Unlock()
+
+	//当前分段不再追加, 之后的失败写入新分段
+	s.mutex.Lock()
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	segments, err := s.segments()
+	s.mutex.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sent, expired := 0, 0
+	for _, seg := range segments {
+		records, err := readSegment(seg.path)
+		if os.IsNotExist(err) {
+			//重发期间因超出大小上限被删除
+			continue
+		}
+		if err != nil {
+			return sent, expired, err
+		}
+		for i, r := range records {
+			if s.maxAge > 0 && time.Since(time.Unix(r.Time, 0)) > s.maxAge {
+				expired++
+				continue
+			}
+			err := g.deliver(r.Sink, r.Payload)
+			if err == errSinkNotConfigured {
+				//目的地已经从配置中移除, 与过期的记录一样丢弃, 不阻塞后面的记录
+				expired++
+				continue
+			}
+			if err != nil {
+				//与重发的数据同一批次的正常上报数据已经从批次中移除, 同样写入缓存
+				if fe, ok := err.(*FlushError); ok {
+					for _, p := range fe.Payloads {
+						if p == r.Payload {
+							continue
+						}
+						if e := s.Write(r.Sink, p); e != nil {
+							fmt.Printf("上报(%s)数据写入缓存出现异常 : %s \n", r.Sink, e)
+						}
+					}
+				}
+				//保留未发送的记录, 下次继续
+				return sent, expired, s.finishSegment(seg.path, records[i:])
+			}
+			sent++
+		}
+		if err := s.finishSegment(seg.path, nil); err != nil {
+			return sent, expired, err
+		}
+	}
+	return sent, expired, nil
+}
+
+//重发结束后删除分段, 或者用剩余的记录替换; 分段已经因超出大小上限被删除时不再重建
+func (s *Spool) finishSegment(path string, rest []*SpoolRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sized = false
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if len(rest) == 0 {
+		return os.Remove(path)
+	}
+	return rewriteSegment(path, rest)
+}
+
+//删除全部缓存
+func (s *Spool) Purge() error {
+	s.replayMutex.Lock()
+	defer s.replayMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sized = false
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+//记录格式: 4字节大端长度 + JSON
+func writeRecord(w io.Writer, data []byte) error {
+	head := make([]byte, 4)
+	binary.BigEndian.PutUint32(head, uint32(len(data)))
+	if _, err := w.Write(append(head, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readSegment(path string) ([]*SpoolRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*SpoolRecord
+	reader := bufio.NewReader(f)
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, head); err != nil {
+			//末尾不完整的记录(写入时进程退出)直接忽略
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			break
+		}
+		r := &SpoolRecord{}
+		if err := json.Unmarshal(data, r); err != nil {
+			return nil, fmt.Errorf("spool segment %s is corrupted: %v", filepath.Base(path), err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+//用剩余的记录替换分段文件
+func rewriteSegment(path string, records []*SpoolRecord) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err := writeRecord(f, data); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//重发缓存的数据并输出结果
+func ReplaySpool(s *Spool, g *SinkGroup) {
+	sent, expired, err := s.Replay(g)
+	if sent > 0 || expired > 0 {
+		fmt.Printf("缓存数据重发 %d 条, 过期丢弃 %d 条 \n", sent, expired)
+	}
+	if err != nil {
+		fmt.Printf("缓存数据重发出现异常 : %s \n", err)
+	}
+}
+
+//缓存管理命令: stat 查看缓存, drain 重发全部缓存, purge 删除全部缓存
+func SpoolCommand(s *Spool, g *SinkGroup, cmd string) {
+	if s == nil {
+		println("no spool directory, please input it by `-spooldir=` ")
+		return
+	}
+	switch cmd {
+	case "", "stat":
+		stat, err := s.Stat()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("# 缓存分段数量 : %d\n", stat.Segments)
+		fmt.Printf("# 缓存记录数量 : %d\n", stat.Records)
+		fmt.Printf("# 缓存大小 (字节) : %d\n", stat.Bytes)
+		if !stat.Oldest.IsZero() {
+			fmt.Printf("# 最早记录时间 : %s\n", stat.Oldest.Format("2006-01-02 15:04:05"))
+		}
+		for sink, count := range stat.Sinks {
+			fmt.Printf("# 上报(%s)缓存记录数量 : %d\n", sink, count)
+		}
+	case "drain":
+		ReplaySpool(s, g)
+		stat, err := s.Stat()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("# 剩余缓存记录数量 : %d\n", stat.Records)
+	case "purge":
+		if err := s.Purge(); err != nil {
+			panic(err)
+		}
+		println("spool purged")
+	default:
+		println("unknown spool command, usage: yoman -spooldir=<dir> spool [stat|drain|purge]")
+	}
+}
@@ -0,0 +1,236 @@
+package yoman
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录收到的数据的上报目的地, 成功limit次后返回错误; limit为-1时不失败
+type memorySink struct {
+	name  string
+	limit int
+	hook  func(p *Payload) //Send开始时调用
+	mutex sync.Mutex
+	hosts []string
+}
+
+func (s *memorySink) Name() string {
+	return s.name
+}
+
+func (s *memorySink) Send(p *Payload) error {
+	if s.hook != nil {
+		s.hook(p)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.limit >= 0 && len(s.hosts) >= s.limit {
+		return errors.New("sink unavailable")
+	}
+	s.hosts = append(s.hosts, p.Host)
+	return nil
+}
+
+func (s *memorySink) received() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return strings.Join(s.hosts, ",")
+}
+
+func newTestSpool(t *testing.T, maxSize int64, maxAge time.Duration) *Spool {
+	s, err := NewSpool(t.TempDir(), maxSize, maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func writePayloads(t *testing.T, s *Spool, sink string, from, to int) {
+	for i := from; i < to; i++ {
+		if err := s.Write(sink, &Payload{Type: PAYLOAD_FLOW, Host: fmt.Sprintf("h%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func hostRange(from, to int) string {
+	hosts := []string{}
+	for i := from; i < to; i++ {
+		hosts = append(hosts, fmt.Sprintf("h%d", i))
+	}
+	return strings.Join(hosts, ",")
+}
+
+func spoolStat(t *testing.T, s *Spool) *SpoolStat {
+	stat, err := s.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat
+}
+
+//分段写满后切换, 重发按写入顺序跨越全部分段
+func TestSpoolRotation(t *testing.T) {
+	s := newTestSpool(t, 0, 0)
+	s.segmentSize = 150
+	writePayloads(t, s, "mem", 0, 10)
+	if stat := spoolStat(t, s); stat.Segments < 3 || stat.Records != 10 || stat.Sinks["mem"] != 10 {
+		t.Fatalf("stat %+v", stat)
+	}
+
+	sink := &memorySink{name: "mem", limit: -1}
+	sent, expired, err := s.Replay(NewSinkGroup(sink))
+	if err != nil || sent != 10 || expired != 0 {
+		t.Fatalf("replay: sent %d expired %d err %v", sent, expired, err)
+	}
+	if got := sink.received(); got != hostRange(0, 10) {
+		t.Fatalf("replayed %s", got)
+	}
+	if stat := spoolStat(t, s); stat.Segments != 0 || stat.Records != 0 {
+		t.Fatalf("stat after replay %+v", stat)
+	}
+}
+
+//重发中途失败时分段只保留未发送的记录, 下次从失败的记录继续
+func TestSpoolPartialReplay(t *testing.T) {
+	s := newTestSpool(t, 0, 0)
+	writePayloads(t, s, "mem", 0, 10)
+
+	sink := &memorySink{name: "mem", limit: 3}
+	g := NewSinkGroup(sink)
+	sent, _, err := s.Replay(g)
+	if err != nil || sent != 3 {
+		t.Fatalf("replay: sent %d err %v", sent, err)
+	}
+	if stat := spoolStat(t, s); stat.Segments != 1 || stat.Records != 7 {
+		t.Fatalf("stat after partial replay %+v", stat)
+	}
+
+	sink.limit = -1
+	sent, _, err = s.Replay(g)
+	if err != nil || sent != 7 {
+		t.Fatalf("second replay: sent %d err %v", sent, err)
+	}
+	if got := sink.received(); got != hostRange(0, 10) {
+		t.Fatalf("replayed %s", got)
+	}
+}
+
+//过期的记录和目的地已经移除的记录在重发时丢弃
+func TestSpoolExpiry(t *testing.T) {
+	s := newTestSpool(t, 0, time.Hour)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	records := []*SpoolRecord{
+		{Sink: "mem", Time: old, Payload: &Payload{Host: "old"}},
+		{Sink: "mem", Time: time.Now().Unix(), Payload: &Payload{Host: "new"}},
+		{Sink: "removed", Time: time.Now().Unix(), Payload: &Payload{Host: "orphan"}},
+		{Sink: "mem", Time: old, Payload: &Payload{Host: "old"}},
+	}
+	if err := rewriteSegment(filepath.Join(s.dir, "00000000000000000001"+SPOOL_SUFFIX), records); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &memorySink{name: "mem", limit: -1}
+	sent, expired, err := s.Replay(NewSinkGroup(sink))
+	if err != nil || sent != 1 || expired != 3 {
+		t.Fatalf("replay: sent %d expired %d err %v", sent, expired, err)
+	}
+	if got := sink.received(); got != "new" {
+		t.Fatalf("replayed %s", got)
+	}
+}
+
+//写入时进程退出留下的不完整记录被忽略
+func TestSpoolTruncatedRecord(t *testing.T) {
+	s := newTestSpool(t, 0, 0)
+	writePayloads(t, s, "mem", 0, 3)
+	path := s.current.Name()
+	s.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := readSegment(path)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("%d records, err %v", len(records), err)
+	}
+	sink := &memorySink{name: "mem", limit: -1}
+	if sent, _, err := s.Replay(NewSinkGroup(sink)); err != nil || sent != 2 {
+		t.Fatalf("replay: sent %d err %v", sent, err)
+	}
+	if got := sink.received(); got != hostRange(0, 2) {
+		t.Fatalf("replayed %s", got)
+	}
+}
+
+//超出大小上限时丢弃最旧的分段
+func TestSpoolMaxSize(t *testing.T) {
+	s := newTestSpool(t, 600, 0)
+	s.segmentSize = 150
+	writePayloads(t, s, "mem", 0, 30)
+	stat := spoolStat(t, s)
+	if stat.Bytes > 600 || stat.Records == 0 || stat.Records >= 30 {
+		t.Fatalf("stat %+v", stat)
+	}
+	if s.total != stat.Bytes {
+		t.Fatalf("tracked size %d, directory size %d", s.total, stat.Bytes)
+	}
+
+	//保留的是最新的记录
+	sink := &memorySink{name: "mem", limit: -1}
+	if _, _, err := s.Replay(NewSinkGroup(sink)); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.received(); got != hostRange(30-stat.Records, 30) {
+		t.Fatalf("replayed %s", got)
+	}
+}
+
+//重发等待网络时不阻塞新的失败数据写入缓存
+func TestSpoolWriteDuringReplay(t *testing.T) {
+	s := newTestSpool(t, 0, 0)
+	writePayloads(t, s, "mem", 0, 2)
+
+	written := make(chan error, 1)
+	sink := &memorySink{name: "mem", limit: -1}
+	sink.hook = func(p *Payload) {
+		if p.Host != "h0" {
+			return
+		}
+		go func() {
+			written <- s.Write("mem", &Payload{Host: "h2"})
+		}()
+		select {
+		case err := <-written:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("Write blocked by Replay")
+		}
+	}
+	if sent, _, err := s.Replay(NewSinkGroup(sink)); err != nil || sent != 2 {
+		t.Fatalf("replay: sent %d err %v", sent, err)
+	}
+	//重发期间写入的记录位于新的分段, 下次重发
+	if stat := spoolStat(t, s); stat.Records != 1 {
+		t.Fatalf("stat %+v", stat)
+	}
+	if sent, _, err := s.Replay(NewSinkGroup(sink)); err != nil || sent != 1 {
+		t.Fatalf("second replay: sent %d err %v", sent, err)
+	}
+	if got := sink.received(); got != hostRange(0, 3) {
+		t.Fatalf("replayed %s", got)
+	}
+}
@@ -0,0 +1,88 @@
+package yoman
+
+import (
+	"context"
+	"fmt"
+	"github.com/domac/yoman/snmp"
+	"time"
+)
+
+//上报的trap事件
+type TrapEvent struct {
+	Host       string            `json:"host"`
+	Version    string            `json:"version"`
+	Type       string            `json:"type"` //trap 或 inform
+	Name       string            `json:"name,omitempty"`
+	TrapOid    string            `json:"trap_oid"`
+	Enterprise string            `json:"enterprise,omitempty"`
+	Uptime     int64             `json:"uptime"` //设备启动时长(百分之一秒)
+	Varbinds   map[string]string `json:"varbinds"`
+	Clock      int64             `json:"clock"`
+}
+
+func NewTrapEvent(trap *snmp.Trap) *TrapEvent {
+	ev := &TrapEvent{
+		Host:     trap.Source,
+		Version:  "v2c",
+		Type:     "trap",
+		Name:     trap.Name,
+		TrapOid:  trap.TrapOid.String(),
+		Uptime:   int64(trap.Uptime / (10 * time.Millisecond)),
+		Varbinds: make(map[string]string),
+		Clock:    time.Now().Unix(),
+	}
+	if trap.Version == snmp.SNMPv1 {
+		ev.Version = "v1"
+		ev.Enterprise = trap.Enterprise.String()
+		//v1 trap的agent-addr为实际发出事件的设备
+		if trap.AgentAddr != nil && !trap.AgentAddr.IsUnspecified() {
+			ev.Host = trap.AgentAddr.String()
+		}
+	}
+	if trap.Type == snmp.AsnInform {
+		ev.Type = "inform"
+	}
+	for _, v := range trap.Varbinds {
+		ev.Varbinds[v.Oid.String()] = fmt.Sprintf("%v", v.Value)
+	}
+	return ev
+}
+
+//trap事件上报回调
+func GenerateTrapReportMethod(sinks *SinkGroup) snmp.TrapHandler {
+	return func(trap *snmp.Trap) {
+		ev := NewTrapEvent(trap)
+		sinks.Send(&Payload{
+			Type:   PAYLOAD_TRAP,
+			Host:   ev.Host,
+			Events: []*TrapEvent{ev},
+		})
+	}
+}
+
+//创建trap接收器
+func NewTrapListener(handler snmp.TrapHandler) *snmp.TrapListener {
+	listener := snmp.NewTrapListener(handler)
+	listener.ErrorHandler = func(source string, err error) {
+		fmt.Printf("解析来自%s的trap报文出现异常 : %s \n", source, err)
+	}
+	return listener
+}
+
+//定期输出trap队列满时丢弃的数量, 直到ctx取消
+func reportTrapDrops(ctx context.Context, listener *snmp.TrapListener) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	last := uint64(0)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if n := listener.Dropped(); n > last {
+			fmt.Printf("trap处理不及时, 队列已满丢弃 %d 个 (累计 %d 个) \n", n-last, n)
+			last = n
+		}
+	}
+}
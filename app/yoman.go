@@ -1,35 +1,76 @@
 package yoman
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/domac/yoman/config"
 	"github.com/domac/yoman/core"
+	"github.com/domac/yoman/snmp"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var APP_VERSION = "1.0"
 
 const (
-	Oid_Inbound  = "1.3.6.1.2.1.31.1.1.1.6"  //入站OID
-	Oid_Outbound = "1.3.6.1.2.1.31.1.1.1.10" //出站OID
+	Oid_Inbound   = "1.3.6.1.2.1.31.1.1.1.6"  //入站OID
+	Oid_Outbound  = "1.3.6.1.2.1.31.1.1.1.10" //出站OID
+	Oid_SysUpTime = "1.3.6.1.2.1.1.3.0"       //设备启动时长
 
 )
 
 var (
-	work_num    = flag.Int("w", 100, "num of worker num")                       //执行的协程数量
-	interval    = flag.Int("i", 10, "interval of worker execute")               //任务执行间隔
-	timeout     = flag.Int("timeout", 500, "timeout of smmp get data")          //SNMP调用超时
-	oids        = flag.String("oids", "", "oids for snmp")                      //oids 数据
-	datafile    = flag.String("datafile", "", "datafile for loading snmp data") //数据文件
-	datauri     = flag.String("datauri", "", "data uri for getting snmp data")  //数据接口
-	Debug       = flag.Bool("debug", false, "debug mode")                       //debug模式
-	priority    = flag.Int("pp", 0, "num of priority worker num")               //优先执行个数
-	retries     = flag.Int("rt", 0, "num of retries num")
-	reporturi   = flag.String("reporturi", "http://localhost:8080/switch/flow", "report uri for sending snmp data to the server")
-	app_version = flag.Bool("v", false, "the version of yoman")
+	work_num     = flag.Int("w", 100, "num of worker num")                       //执行的协程数量
+	work_min     = flag.Int("wmin", 0, "min worker num in daemon mode")          //守护模式最小协程数量
+	interval     = flag.Int("i", 10, "interval of worker execute")               //任务执行间隔, 设置了按设备的限制且没有明确指定时不使用
+	timeout      = flag.Int("timeout", 500, "timeout of smmp get data")          //SNMP调用超时
+	oids         = flag.String("oids", "", "oids for snmp")                      //oids 数据
+	datafile     = flag.String("datafile", "", "datafile for loading snmp data") //数据文件
+	datauri      = flag.String("datauri", "", "data uri for getting snmp data")  //数据接口
+	Debug        = flag.Bool("debug", false, "debug mode")                       //debug模式
+	priority     = flag.Int("pp", 0, "num of priority worker num")               //优先执行个数
+	retries      = flag.Int("rt", 0, "num of retries num")
+	reporturi    = flag.String("reporturi", "http://localhost:8080/switch/flow", "report uri for sending snmp data to the server")
+	app_version  = flag.Bool("v", false, "the version of yoman")
+	daemon       = flag.Bool("daemon", false, "daemon mode, poll switches periodically and report bps rates")                        //守护模式
+	poll         = flag.Int("poll", 60, "poll interval (seconds) in daemon mode")                                                    //守护模式采集周期
+	schedulefile = flag.String("schedule", "", "json file of oid groups polled by cron expressions or intervals, implies -daemon")   //计划采集配置
+	sinks        = flag.String("sinks", "form", "report sinks separated by comma: form, json, stdout, file, influx")                 //上报目的地
+	reportfile   = flag.String("reportfile", "", "file path of the file sink")                                                       //文件上报路径
+	influx       = flag.String("influx", "", "influxdb write uri (http://host:8086/write?db=yoman) or file path of the influx sink") //InfluxDB上报
+	influxbatch  = flag.Int("influxbatch", 5000, "lines per batch of the influx sink")
+	influxgzip   = flag.Bool("influxgzip", false, "gzip batches of the influx sink")
+	spooldir     = flag.String("spooldir", "", "directory of the on-disk spool for failed report deliveries") //上报失败缓存目录
+	spoolmaxsize = flag.Int("spoolmaxsize", 100, "max size (MB) of the spool directory")
+	spoolmaxage  = flag.Int("spoolmaxage", 24, "max age (hours) of spooled records")
+	ifmeta       = flag.Bool("ifmeta", false, "walk ifName, ifAlias, ifHighSpeed and ifOperStatus and join them to each port") //接口元数据
+	ifmetattl    = flag.Int("ifmetattl", 3600, "cache time (seconds) of the interface metadata per device")
+	discover     = flag.String("discover", "", "discover switches in cidr ranges separated by comma, e.g. 10.0.0.0/24") //网络发现
+	communities  = flag.String("communities", "public", "candidate communities of the discovery separated by comma")
+	discoverfile = flag.String("discoverfile", "switches.json", "output datafile of the discovery")
+	tasktimeout  = flag.Int("tasktimeout", 0, "deadline (ms) of each snmp job, 0 means no deadline")       //任务执行超时
+	taskretries  = flag.Int("taskretries", 0, "times to retry a failed snmp job with exponential backoff") //任务重试次数
+	retrybackoff = flag.Int("retrybackoff", 1000, "delay (ms) before the first retry of a failed job")     //重试等待时间
+	retrymax     = flag.Int("retrymaxbackoff", 30000, "max delay (ms) between retries of a failed job")    //重试等待时间上限
+	tasklog      = flag.String("tasklog", "", "write-ahead log of jobs, a rerun after a crash only polls unfinished switches")
+	draintimeout = flag.Int("draintimeout", 30, "seconds to wait for running jobs on SIGINT/SIGTERM")      //优雅退出等待时间
+	hostinflight = flag.Int("hostinflight", 0, "max running jobs per switch, 0 means no limit")            //单台设备并发数
+	hostrate     = flag.Float64("hostrate", 0, "max jobs started per second per switch, 0 means no limit") //单台设备速率
+	hostburst    = flag.Int("hostburst", 1, "burst of jobs per switch allowed by -hostrate")
+	traps        = flag.Bool("traps", false, "receive snmp traps and informs")                                  //trap接收
+	trapport     = flag.Int("trapport", 162, "udp port of the trap receiver")                                   //trap接收端口
+	metrics      = flag.String("metrics", "", "listen address of the prometheus /metrics exporter, e.g. :9116") //指标导出地址
+	debugaddr    = flag.String("debugaddr", "", "listen address of the dispatcher stats in json, e.g. :6060")   //调试接口地址
+	simaddr      = flag.String("simaddr", "127.0.0.1:1161", "listen address of the first simulated agent")
+	simrate      = flag.Float64("simrate", 0, "increase of every simulated counter per second")
+	simdrop      = flag.Float64("simdrop", 0, "probability (0-1) of dropping a simulated response")
+	simdelay     = flag.Int("simdelay", 0, "delay (ms) of simulated responses")
+	sockets      = flag.Int("sockets", 0, "udp sockets shared by all v1/v2c snmp requests, 0 means a socket per job")
 )
 
 //执行函数
@@ -41,16 +82,128 @@ func Startup() {
 		return
 	}
 
+	//全部v1/v2c请求复用少量套接字, 按请求ID分发响应
+	if *sockets > 0 {
+		engine, err := snmp.NewEngine(*sockets)
+		if err != nil {
+			panic(err)
+		}
+		defer engine.Close()
+		snmpEngine = engine
+	}
+
+	//网络发现: 扫描地址段并生成交换机数据文件
+	if *discover != "" {
+		switches, err := Discover(strings.Split(*discover, ","), strings.Split(*communities, ","), *work_num, *timeout, *retries)
+		if err != nil {
+			panic(err)
+		}
+		if err := WriteSwitchFile(*discoverfile, switches); err != nil {
+			panic(err)
+		}
+		fmt.Printf("交换机数据已写入 %s \n", *discoverfile)
+		return
+	}
+
+	//SNMP代理模拟器: yoman -simaddr=127.0.0.1:1161 simulate <snmpwalk文件>...
+	if flag.Arg(0) == "simulate" {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go handleSignals(cancel)
+		err := Simulate(ctx, flag.Args()[1:], *simaddr, SimulateOptions{
+			Rate:  *simrate,
+			Drop:  *simdrop,
+			Delay: time.Duration(*simdelay) * time.Millisecond,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	itvl := time.Duration(*interval)
 
-	if *oids == "" {
+	//上报目的地
+	sg, err := NewSinkGroupFromSpec(*sinks, SinkOptions{
+		Reporturi:   *reporturi,
+		Reportfile:  *reportfile,
+		Influx:      *influx,
+		InfluxBatch: *influxbatch,
+		InfluxGzip:  *influxgzip,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer sg.Close()
+
+	//上报失败的数据写入磁盘缓存
+	var spool *Spool
+	if *spooldir != "" {
+		spool, err = NewSpool(*spooldir, int64(*spoolmaxsize)<<20, time.Duration(*spoolmaxage)*time.Hour)
+		if err != nil {
+			panic(err)
+		}
+		defer spool.Close()
+		sg.SetSpool(spool)
+	}
+
+	//缓存管理命令: yoman -spooldir=<dir> spool [stat|drain|purge]
+	if flag.Arg(0) == "spool" {
+		SpoolCommand(spool, sg, flag.Arg(1))
+		return
+	}
+
+	//重发上次运行缓存的数据
+	if spool != nil {
+		ReplaySpool(spool, sg)
+	}
+
+	//收到SIGINT/SIGTERM时取消ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSignals(cancel)
+
+	//计划采集: 每组oid按各自的cron表达式或者间隔采集, 使用守护模式
+	var schedules []config.Schedule
+	if *schedulefile != "" {
+		schedules, err = config.LoadScheduleFromFile(*schedulefile)
+		if err != nil {
+			panic(err)
+		}
+		*daemon = true
+	}
+
+	//trap接收, 事件与采集数据使用同一个上报接口
+	if *traps {
+		listener := NewTrapListener(GenerateTrapReportMethod(sg))
+		go reportTrapDrops(ctx, listener)
+		addr := fmt.Sprintf(":%d", *trapport)
+		if *oids == "" && len(schedules) == 0 {
+			//只接收trap
+			go func() {
+				<-ctx.Done()
+				listener.Close()
+			}()
+			if err := listener.Listen(addr); err != nil {
+				panic(err)
+			}
+			return
+		}
+		go func() {
+			if err := listener.Listen(addr); err != nil {
+				fmt.Printf("trap接收器启动失败 : %s \n", err)
+			}
+		}()
+		defer listener.Close()
+	}
+
+	if *oids == "" && len(schedules) == 0 {
 		println("no oids found, please input oid value by `-oids=` ")
 		return
 	}
 	oidlist := strings.Split(*oids, ",")
 
 	var (
-		err   error
 		wg    sync.WaitGroup
 		mpwg  sync.WaitGroup
 		items []config.Switch
@@ -80,33 +233,270 @@ func Startup() {
 	//创建任务调度器
 	d := core.NewDispatcherWithMQ(*work_num, *work_num, &wg, &mpwg)
 	d.SetPriority(*priority)
+	d.SetTaskTimeout(time.Duration(*tasktimeout) * time.Millisecond)
+	if *taskretries > 0 {
+		d.SetRetryPolicy(&core.RetryPolicy{
+			MaxAttempts: *taskretries + 1,
+			BaseDelay:   time.Duration(*retrybackoff) * time.Millisecond,
+			MaxDelay:    time.Duration(*retrymax) * time.Millisecond,
+			Jitter:      0.5,
+		})
+		//用完重试次数仍然失败的任务
+		deadLetter := make(chan core.Task, *work_num)
+		d.SetDeadLetter(deadLetter)
+		go func() {
+			for task := range deadLetter {
+				fmt.Printf("%v重试%d次后仍然失败 : %s \n", task.Runnable, task.Attempts-1, task.Err)
+			}
+		}()
+	}
+
+	//一次性采集的任务日志: 进程异常退出后重新运行时只采集未完成的交换机
+	var recovered []core.Task
+	if *tasklog != "" && *daemon {
+		fmt.Println("守护模式每个周期采集全部交换机, 忽略 -tasklog")
+	} else if *tasklog != "" {
+		tl, err := core.OpenTaskLog(*tasklog)
+		if err != nil {
+			panic(err)
+		}
+		defer tl.Close()
+		if recovered, err = tl.Recovered(); err != nil {
+			panic(err)
+		}
+		d.SetTaskLog(tl)
+	}
 
-	//设置消息处理方法
-	r := NewReport(*reporturi)
-	d.SetMF(GenerateMessageReportMethod(r))
+	//按设备限制并发数和速率, 数据文件中的设置优先; 检查设备的优先级
+	defaults := core.KeyLimit{MaxInFlight: *hostinflight, Rate: *hostrate, Burst: *hostburst}
+	d.SetDefaultKeyLimit(defaults)
+	perHost := defaults.MaxInFlight > 0 || defaults.Rate > 0
+	for _, item := range items {
+		if _, err := core.ParsePriority(item.Priority); err != nil {
+			panic(fmt.Errorf("switch %s: %s", item.Host, err))
+		}
+		if item.MaxInFlight > 0 || item.Rate > 0 || item.Burst > 0 {
+			d.SetKeyLimit(item.Host, switchLimit(item, defaults))
+			perHost = true
+		}
+	}
+	//按设备的限制代替全局的分发间隔, 只有明确指定 -i 时两者同时生效
+	if perHost && !flagSet("i") {
+		itvl = 0
+	}
+
+	//守护模式下执行器数量在 wmin 和 w 之间自动伸缩
+	if *daemon && *work_min > 0 && *work_min < *work_num {
+		d.SetAutoScale(&core.AutoScale{Min: *work_min, Max: *work_num})
+	}
 
 	//启动调度器
-	d.RunWithLimiter(itvl * time.Millisecond)
+	if itvl > 0 {
+		d.RunWithLimiter(itvl * time.Millisecond)
+	} else {
+		d.Run()
+	}
 	defer d.Stop()
 
-	wg.Add(1)
-	mpwg.Add(1)
-	start := time.Now()
+	//优雅退出: 不再派发新任务, 等待正在执行的任务完成, 超时后取消
 	go func() {
-		for i, oid := range oidlist {
-			for j, item := range items {
-				id := fmt.Sprintf("%d-%d", i, j)
-				job := NewJob(id, item.Host, item.Community, oid, *timeout, *retries)
-				t := core.CreateTask(job, "Do")
-				d.SubmitTask(t)
-			}
+		<-ctx.Done()
+		if err := d.Drain(time.Duration(*draintimeout) * time.Second); err != nil {
+			fmt.Printf("等待任务完成超时 : %s \n", err)
 		}
-		fmt.Println("任务派分完成,正在执行中...")
-		wg.Done()
-		mpwg.Done()
 	}()
-	wg.Wait()
-	mpwg.Wait()
+
+	//Prometheus指标导出
+	var exporter *Exporter
+	if *metrics != "" {
+		exporter = NewExporter()
+		exporter.SetDispatcher(d)
+		//守护模式下不再采集的设备的样本在3个采集周期后删除
+		if *daemon {
+			exporter.SetExpiry(3 * collectPeriod(schedules))
+		}
+		StartExporter(*metrics, exporter)
+	}
+
+	//接口元数据按设备缓存, 刷新频率低于流量计数
+	var meta *IfMetaCache
+	if *ifmeta {
+		meta = NewIfMetaCache(time.Duration(*ifmetattl) * time.Second)
+	}
+
+	var scheduler *core.Scheduler
+	if len(schedules) > 0 {
+		scheduler = newCollectScheduler(d, schedules, items, meta, sg, exporter)
+	}
+
+	//调度器统计的调试接口
+	if *debugaddr != "" {
+		StartDebugServer(*debugaddr, d, scheduler)
+	}
+
+	if !*daemon {
+		r := NewReport(sg)
+		r.SetExporter(exporter)
+		tasks := jobTasks(items, oidlist, meta)
+		if len(recovered) > 0 {
+			fmt.Printf("恢复上次未完成的任务 %d 个 \n", len(recovered))
+			tasks = resumeTasks(recovered, items, meta)
+		}
+		collect(context.Background(), d, tasks, r)
+		return
+	}
+
+	//守护模式: 按周期采集, 使用前后两次的计数差值上报速率
+	if *poll <= 0 {
+		println("poll interval must be positive, please input it by `-poll=` ")
+		return
+	}
+	//后台重发缓存的数据
+	if spool != nil {
+		go func() {
+			for range time.Tick(time.Duration(*poll) * time.Second) {
+				ReplaySpool(spool, sg)
+			}
+		}()
+	}
+
+	if scheduler != nil {
+		scheduler.Start()
+		<-ctx.Done()
+		scheduler.Stop()
+		return
+	}
+
+	rc := NewRateCalculator()
+	ticker := time.NewTicker(time.Duration(*poll) * time.Second)
+	defer ticker.Stop()
+	for {
+		r := NewReport(sg)
+		r.SetRateCalculator(rc)
+		r.SetExporter(exporter)
+		collect(context.Background(), d, jobTasks(items, oidlist, meta), r)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//交换机的采集限制, 没有设置的字段使用默认值
+func switchLimit(sw config.Switch, defaults core.KeyLimit) core.KeyLimit {
+	limit := defaults
+	if sw.MaxInFlight > 0 {
+		limit.MaxInFlight = sw.MaxInFlight
+	}
+	if sw.Rate > 0 {
+		limit.Rate = sw.Rate
+	}
+	if sw.Burst > 0 {
+		limit.Burst = sw.Burst
+	}
+	return limit
+}
+
+//第一次收到SIGINT/SIGTERM时取消ctx进行优雅退出, 再次收到时立即退出
+func handleSignals(cancel context.CancelFunc) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-ch
+	fmt.Printf("收到信号 %s, 正在停止 (再次发送信号立即退出)... \n", sig)
+	cancel()
+	<-ch
+	os.Exit(1)
+}
+
+//执行一轮采集并上报
+//每台交换机一个任务, 在同一会话中采集全部oid
+func jobTasks(items []config.Switch, oidlist []string, meta *IfMetaCache) []core.Task {
+	tasks := make([]core.Task, 0, len(items))
+	for j, item := range items {
+		job := NewJob(fmt.Sprintf("%d", j), item, oidlist, *timeout, *retries)
+		job.WithUptime = *daemon
+		job.Meta = meta
+		t := core.NewTask(job)
+		t.Key = item.Host
+		t.Priority, _ = core.ParsePriority(item.Priority)
+		tasks = append(tasks, t)
+	}
+	return tasks
+}
+
+//命令行中是否指定了该参数
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+//从任务日志恢复的任务: 从清单重新取得设备凭据, 关联接口元数据缓存
+func resumeTasks(tasks []core.Task, items []config.Switch, meta *IfMetaCache) []core.Task {
+	for _, t := range tasks {
+		if job, ok := t.Runnable.(*Job); ok {
+			job.Meta = meta
+			if !job.ResolveSwitch(items) {
+				fmt.Printf("恢复的任务%s的设备已经不在清单中 \n", job.Host)
+			}
+		}
+	}
+	return tasks
+}
+
+//两次采集的最长间隔: 采集周期和各个计划采集的间隔中的最大值
+func collectPeriod(schedules []config.Schedule) time.Duration {
+	period := time.Duration(*poll) * time.Second
+	now := time.Now()
+	for _, sc := range schedules {
+		s, err := core.ParseSchedule(sc.Schedule)
+		if err != nil {
+			continue
+		}
+		next := s.Next(now)
+		if d := s.Next(next).Sub(next); d > period {
+			period = d
+		}
+	}
+	return period
+}
+
+//按计划采集的调度: 每组oid使用各自的速率计算
+func newCollectScheduler(d *core.Dispatcher, schedules []config.Schedule, items []config.Switch, meta *IfMetaCache, sg *SinkGroup, exporter *Exporter) *core.Scheduler {
+	s := core.NewScheduler()
+	for _, sc := range schedules {
+		policy, err := core.ParseOverlapPolicy(sc.Policy)
+		if err != nil {
+			panic(fmt.Errorf("schedule %s: %s", sc.Name, err))
+		}
+		oidlist := strings.Split(sc.Oids, ",")
+		rc := NewRateCalculator()
+		err = s.Add(sc.Name, sc.Schedule, policy, func(ctx context.Context) error {
+			r := NewReport(sg)
+			r.SetRateCalculator(rc)
+			r.SetExporter(exporter)
+			return collect(ctx, d, jobTasks(items, oidlist, meta), r)
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	return s
+}
+
+//提交一轮采集任务, 全部完成后上报; ctx取消(例如计划采集停止)时中断本轮的任务,
+//调度器停止或者ctx取消时返回提交失败的错误
+func collect(ctx context.Context, d *core.Dispatcher, tasks []core.Task, r *Report) error {
+	start := time.Now()
+	//组内任务的结果由本轮的Report处理
+	b, err := d.SubmitBatchWithContext(ctx, tasks, GenerateMessageReportMethod(r))
+	fmt.Println("任务派分完成,正在执行中...")
+	b.Wait()
 
 	cost := fmt.Sprintf("%v", time.Now().Sub(start).Seconds())
 
@@ -118,13 +508,19 @@ func Startup() {
 
 	fmt.Println("数据上报完成!")
 
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 	fmt.Printf("----------- 全部处理完成 : %s ----------- \n", time.Now().Format("2006-01-02 15:04:05"))
-	fmt.Printf("# 执行snmp请求协程数量 : %d\n", Wgroutinue)
-	fmt.Printf("# 执行snmp错误数量 : %d\n", Erroc)
+	//本轮的任务数, 调度器的统计是整个运行期间的累计值
+	done, failed := b.Counts()
+	fmt.Printf("# 执行snmp请求协程数量 : %d\n", done)
+	fmt.Printf("# 执行snmp错误数量 : %d\n", failed)
 	fmt.Printf("# 上报调用次数 : %d\n", len(r.Data))
 	fmt.Printf("# 上报数据批次数量 : %d\n", sdc)
 	fmt.Printf("# Snmp采集耗时 (秒) : %v\n", cost)
 	fmt.Printf("# 数据上报耗时 (秒): %v\n", r_cost)
-	fmt.Println("\n")
+	for name, st := range r.Sinks.Stats() {
+		fmt.Printf("# 上报(%s)成功/失败次数 : %d/%d\n", name, st.Sent, st.Failed)
+	}
+	fmt.Print("\n\n")
+	return err
 }
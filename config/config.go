@@ -9,6 +9,31 @@ import (
 type Switch struct {
 	Host      string `json:"host"`
 	Community string `json:"community"`
+	Version   string `json:"version,omitempty"` //SNMP版本: v1, v2c(默认); 设置了user时使用v3
+
+	//SNMPv3 用户安全模型参数, 设置了user时使用v3协议
+	User           string `json:"user,omitempty"`
+	AuthProtocol   string `json:"auth_protocol,omitempty"` //md5, sha, sha224, sha256, sha384, sha512
+	AuthPassphrase string `json:"auth_passphrase,omitempty"`
+	PrivProtocol   string `json:"priv_protocol,omitempty"` //des, aes, aes192, aes256
+	PrivPassphrase string `json:"priv_passphrase,omitempty"`
+	ContextName    string `json:"context_name,omitempty"`
+
+	//网络发现得到的设备信息
+	Name        string `json:"name,omitempty"`          //sysName
+	Vendor      string `json:"vendor,omitempty"`        //根据sysObjectID的企业号识别的厂商
+	SysObjectID string `json:"sys_object_id,omitempty"` //sysObjectID
+	SysDescr    string `json:"sys_descr,omitempty"`     //sysDescr
+
+	//设备的采集限制, 0表示使用 -hostinflight/-hostrate 的默认值
+	MaxInFlight int     `json:"max_inflight,omitempty"` //同时执行的采集任务数上限
+	Rate        float64 `json:"rate,omitempty"`         //每秒开始的采集任务数
+	Burst       int     `json:"burst,omitempty"`        //速率限制允许的突发任务数
+	Priority    string  `json:"priority,omitempty"`     //采集优先级: high, normal(默认), low
+
+	//GetBulk参数, 0表示自动调整/默认值
+	MaxRepetitions int `json:"max_repetitions,omitempty"` //每个GetBulk请求的重复次数上限
+	BufferSize     int `json:"buffer_size,omitempty"`     //接收缓冲区大小(字节), 使用共享引擎时不起作用
 }
 
 //从配置文件读取信息
@@ -27,6 +52,27 @@ func LoadSwitchFromFile(fileName string) ([]Switch, error) {
 	return d, nil
 }
 
+//计划采集的一组oid
+type Schedule struct {
+	Name     string `json:"name"`
+	Oids     string `json:"oids"`             //多个oid以逗号分隔
+	Schedule string `json:"schedule"`         //cron表达式(例如 "*/5 * * * *", "@daily")或者间隔(例如 "60s")
+	Policy   string `json:"policy,omitempty"` //上一次采集未结束时: skip(默认)跳过, catchup结束后补采一次
+}
+
+//读取计划采集配置文件
+func LoadScheduleFromFile(fileName string) ([]Schedule, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var s []Schedule
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 //从数据接口中获取交换机数据
 func LoadSwitchFromUrl(url string) ([]Switch, error) {
 	return nil, nil
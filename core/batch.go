@@ -0,0 +1,66 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+//一组任务: 全部任务结束并且结果处理完成后Wait返回
+type Batch struct {
+	wg     sync.WaitGroup
+	mf     MF     //组内任务的消息处理方法, 为空时使用调度器的方法
+	done   uint64 //已经结束的任务数
+	failed uint64 //出错的任务数(包括超时和被取消)
+}
+
+//等待组内的任务全部结束
+func (b *Batch) Wait() {
+	b.wg.Wait()
+}
+
+func (b *Batch) finish(task Task) {
+	if b == nil {
+		return
+	}
+	atomic.AddUint64(&b.done, 1)
+	if task.Err != nil {
+		atomic.AddUint64(&b.failed, 1)
+	}
+	b.wg.Done()
+}
+
+//组内已经结束的任务数和其中出错(包括超时和被取消)的任务数; 调度器的Stats是整个运行期间的累计值
+func (b *Batch) Counts() (done, failed uint64) {
+	return atomic.LoadUint64(&b.done), atomic.LoadUint64(&b.failed)
+}
+
+//提交一组任务, mf不为空时组内任务的结果由mf处理; 提交失败时返回已经提交的部分, Wait等待这部分任务
+func (dispatcher *Dispatcher) SubmitBatch(tasks []Task, mf MF) (*Batch, error) {
+	return dispatcher.SubmitBatchWithContext(dispatcher.ctx, tasks, mf)
+}
+
+//提交一组带上下文的任务, ctx取消后尚未提交的任务不再提交, 已经提交的任务停止执行
+func (dispatcher *Dispatcher) SubmitBatchWithContext(ctx context.Context, tasks []Task, mf MF) (*Batch, error) {
+	b := &Batch{mf: mf}
+	//先记录整批任务: 进程在派发过程中退出时, 还没有排队的任务也能从任务日志恢复
+	logged := make([]Task, 0, len(tasks))
+	for _, task := range tasks {
+		if task.Timeout == 0 {
+			task.Timeout = dispatcher.taskTimeout
+		}
+		logged = append(logged, task)
+	}
+	if err := dispatcher.taskLog.submit(logged...); err != nil {
+		return b, err
+	}
+	for _, task := range tasks {
+		task.batch = b
+		b.wg.Add(1)
+		if err := dispatcher.SubmitTaskWithContext(ctx, task); err != nil {
+			b.wg.Done()
+			return b, err
+		}
+	}
+	return b, nil
+}
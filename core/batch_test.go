@@ -0,0 +1,65 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+//每组的计数只包含组内的任务
+func TestBatchCounts(t *testing.T) {
+	d, _ := newTestDispatcher(2)
+	d.Run()
+	defer d.Stop()
+
+	ok := funcRunnable(func(ctx context.Context) (Result, error) { return nil, nil })
+	fail := funcRunnable(func(ctx context.Context) (Result, error) { return nil, errors.New("down") })
+	for round := 0; round < 2; round++ {
+		var reported int32
+		tasks := []Task{NewTask(ok), NewTask(ok), NewTask(fail)}
+		b, err := d.SubmitBatch(tasks, func(Task) { atomic.AddInt32(&reported, 1) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Wait()
+		if done, failed := b.Counts(); done != 3 || failed != 1 {
+			t.Fatalf("round %d: done %d, failed %d", round, done, failed)
+		}
+		if n := atomic.LoadInt32(&reported); n != 3 {
+			t.Fatalf("round %d: %d tasks reported", round, n)
+		}
+	}
+	if st := d.Stats(); st.Completed != 4 || st.Failed != 2 {
+		t.Fatalf("dispatcher totals: completed %d, failed %d", st.Completed, st.Failed)
+	}
+}
+
+//ctx取消时中断正在执行的任务, 不再提交剩余的任务
+func TestSubmitBatchWithContext(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	d.Run()
+	defer d.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan bool, 10)
+	block := funcRunnable(func(ctx context.Context) (Result, error) {
+		started <- true
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	tasks := []Task{NewTask(block), NewTask(block), NewTask(block), NewTask(block)}
+	go func() {
+		<-started
+		cancel()
+	}()
+	b, err := d.SubmitBatchWithContext(ctx, tasks, nil)
+	b.Wait()
+	done, failed := b.Counts()
+	if done != failed || done == 0 {
+		t.Fatalf("done %d, failed %d", done, failed)
+	}
+	if err == nil && done != 4 {
+		t.Fatalf("%d of 4 submitted tasks finished", done)
+	}
+}
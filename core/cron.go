@@ -0,0 +1,212 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//调度计划: 返回t之后的下一次运行时间, 没有下一次时返回零值
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+//固定间隔
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+//cron表达式: 分 时 日 月 周, 每个字段是可以取值的位图
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool //字段为*
+}
+
+//cron字段的取值范围
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+//预定义的表达式
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//解析调度计划, 支持:
+//  5个字段的cron表达式, 例如 "*/5 * * * *", "0 3 * * mon-fri"
+//  @yearly, @monthly, @weekly, @daily, @hourly
+//  固定间隔: "@every 5m" 或者 "60s"
+func ParseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		return parseInterval(strings.TrimSpace(spec[len("@every "):]))
+	}
+	if _, err := time.ParseDuration(spec); err == nil {
+		return parseInterval(spec)
+	}
+	if expr, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = expr
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected 5 cron fields, got %d", spec, len(fields))
+	}
+	s := &cronSchedule{
+		domAny: fields[2] == "*" || fields[2] == "?",
+		dowAny: fields[4] == "*" || fields[4] == "?",
+	}
+	var err error
+	if s.minute, err = parseCronField(fields[0], cronMinute); err != nil {
+		return nil, fmt.Errorf("schedule %q: minute: %s", spec, err)
+	}
+	if s.hour, err = parseCronField(fields[1], cronHour); err != nil {
+		return nil, fmt.Errorf("schedule %q: hour: %s", spec, err)
+	}
+	if s.dom, err = parseCronField(fields[2], cronDom); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of month: %s", spec, err)
+	}
+	if s.month, err = parseCronField(fields[3], cronMonth); err != nil {
+		return nil, fmt.Errorf("schedule %q: month: %s", spec, err)
+	}
+	if s.dow, err = parseCronField(fields[4], cronDow); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of week: %s", spec, err)
+	}
+	//周日可以写作0或者7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseInterval(spec string) (Schedule, error) {
+	d, err := time.ParseDuration(spec)
+	if err != nil {
+		return nil, fmt.Errorf("schedule interval %q: %s", spec, err)
+	}
+	if d < time.Second {
+		return nil, fmt.Errorf("schedule interval %q: must be at least 1s", spec)
+	}
+	return intervalSchedule{d}, nil
+}
+
+//解析一个字段: 逗号分隔的 *, n, a-b, 以及带步长的 */s, a-b/s, a/s
+func parseCronField(field string, f cronField) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		low, high := f.min, f.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err error
+			if low, err = f.value(part[:i]); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(part[i+1:]); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if low, err = f.value(part); err != nil {
+				return 0, err
+			}
+			//a/s 表示从a开始到最大值
+			if step == 1 {
+				high = low
+			}
+		}
+		if low > high {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range [%d, %d]", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+//日和周都有限制时满足其一即可, 与标准cron一致
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	//最多查找5年, 例如 2月30日 永远不会匹配
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -1,21 +1,28 @@
 package core
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MF func(task Task)
 
+//调度器停止接收任务后提交或者被取消的任务返回该错误
+var ErrDispatcherClosed = errors.New("dispatcher is closed")
+
 //任务分发器
 type Dispatcher struct {
-	maxExecutors    int
+	maxExecutors    int //执行器数量, 可以通过Resize调整
 	queueBufferSize int
 	wg              *sync.WaitGroup
 	wait            bool
-	taskQueue       chan Task
+	taskQueue       *priorityQueue //按优先级分开的任务队列
 	taskPool        chan chan Task
-	executors       []Executor
+	executors       []*Executor
 	quit            chan bool
 	limiter         <-chan time.Time
 	openmq          bool
@@ -23,25 +30,51 @@ type Dispatcher struct {
 	mpwg            *sync.WaitGroup
 	messageFunc     MF
 	priority        uint64 //优先执行数
+
+	ctx         context.Context //取消后全部任务停止执行
+	cancel      context.CancelFunc
+	taskTimeout time.Duration  //任务默认执行超时
+	inflight    sync.WaitGroup //已提交且未完成的任务
+	mutex       sync.RWMutex
+	closed      chan bool //停止接收新任务后关闭
+	closeOnce   sync.Once
+	retryPolicy *RetryPolicy
+	requeueing  sync.WaitGroup //等待重新排队的任务(重试或者获得限流名额)
+	keyLimits   *keyLimiter    //按键的并发数和速率限制
+	stats       *dispatcherStats
+	poolMutex   sync.Mutex //保护executors, maxExecutors和retire
+	retire      int        //等待退出的执行器数量
+	resized     chan bool  //执行器数量减少时唤醒分发协程
+	autoScale   *AutoScale
+	taskLog     *TaskLog //任务日志, 为空时不记录
+	deadLetter  chan<- Task
+	running     bool
+	stopOnce    sync.Once
+	reportQuit  chan bool
+	stopped     chan bool //调度器停止后关闭
 }
 
 //创建分发器
 func NewDispatcher(maxExecutors, queueBufferSize int) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
 	dispatcher := &Dispatcher{
+		ctx:             ctx,
+		cancel:          cancel,
+		closed:          make(chan bool),
+		reportQuit:      make(chan bool),
+		stopped:         make(chan bool),
 		maxExecutors:    maxExecutors,
 		queueBufferSize: queueBufferSize,
 		taskPool:        make(chan chan Task, maxExecutors),
 		wait:            false,
 		quit:            make(chan bool),
-		executors:       make([]Executor, maxExecutors),
+		resized:         make(chan bool, 1),
 		openmq:          false,
 	}
+	dispatcher.keyLimits = newKeyLimiter(dispatcher.resume)
+	dispatcher.stats = newDispatcherStats()
 
-	if queueBufferSize != 0 {
-		dispatcher.taskQueue = make(chan Task, queueBufferSize)
-	} else {
-		dispatcher.taskQueue = make(chan Task)
-	}
+	dispatcher.taskQueue = newPriorityQueue(queueBufferSize)
 	return dispatcher
 }
 
@@ -67,7 +100,74 @@ func NewDispatcherWithMQ(maxExecutors, queueBufferSize int, wg *sync.WaitGroup,
 	return dispatcher
 }
 
-func (dispatcher *Dispatcher) SubmitTask(task Task) {
+//提交任务, 使用调度器的上下文
+func (dispatcher *Dispatcher) SubmitTask(task Task) error {
+	return dispatcher.SubmitTaskWithContext(dispatcher.ctx, task)
+}
+
+//提交带上下文的任务, ctx取消或者超时后任务停止执行; 调度器停止接收任务后返回ErrDispatcherClosed
+func (dispatcher *Dispatcher) SubmitTaskWithContext(ctx context.Context, task Task) error {
+	dispatcher.mutex.RLock()
+	defer dispatcher.mutex.RUnlock()
+	if dispatcher.isClosed() {
+		return ErrDispatcherClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	task.ctx = ctx
+	task.submitted = time.Now()
+	if task.Timeout == 0 {
+		task.Timeout = dispatcher.taskTimeout
+	}
+
+	//先写入任务日志再排队
+	if err := dispatcher.taskLog.submit(task); err != nil {
+		return err
+	}
+
+	dispatcher.accept()
+	select {
+	case dispatcher.taskQueue.queue(task.Priority) <- task:
+		atomic.AddUint64(&dispatcher.stats.submitted, 1)
+		return nil
+	case <-ctx.Done():
+		dispatcher.release()
+		if dispatcher.ctx.Err() == nil {
+			dispatcher.taskLog.done(task)
+		}
+		return ctx.Err()
+	case <-dispatcher.closed:
+		//调度器停止时没有排队的任务下次运行时恢复
+		dispatcher.release()
+		return ErrDispatcherClosed
+	}
+}
+
+//停止接收新任务, 阻塞在提交中的任务返回ErrDispatcherClosed
+func (dispatcher *Dispatcher) close() {
+	dispatcher.closeOnce.Do(func() {
+		close(dispatcher.closed)
+	})
+	//等待提交中的任务返回, 之后不会再有任务加入
+	dispatcher.mutex.Lock()
+	dispatcher.mutex.Unlock()
+	//取消等待限流名额的任务
+	for _, task := range dispatcher.keyLimits.flush() {
+		dispatcher.cancelTask(task, ErrDispatcherClosed)
+	}
+}
+
+func (dispatcher *Dispatcher) isClosed() bool {
+	select {
+	case <-dispatcher.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (dispatcher *Dispatcher) accept() {
 	if dispatcher.wait {
 		dispatcher.wg.Add(1)
 
@@ -76,10 +176,51 @@ func (dispatcher *Dispatcher) SubmitTask(task Task) {
 		}
 
 	}
-	dispatcher.taskQueue <- task
+	dispatcher.inflight.Add(1)
+}
+
+func (dispatcher *Dispatcher) release() {
+	if dispatcher.wait {
+		dispatcher.wg.Done()
+
+		if dispatcher.openmq {
+			dispatcher.mpwg.Done()
+		}
+
+	}
+	dispatcher.inflight.Done()
+}
+
+//取消未执行的任务, 与执行完成的任务一样上报
+func (dispatcher *Dispatcher) cancelTask(task Task, err error) {
+	dispatcher.keyLimits.release(task)
+	task.admitted = false
+	task.Err = err
+	atomic.AddUint64(&dispatcher.stats.cancelled, 1)
+	//调度器停止时取消的任务没有完成, 下次运行时从任务日志恢复
+	if !dispatcher.isClosed() && dispatcher.ctx.Err() == nil {
+		dispatcher.taskLog.done(task)
+	}
+	if dispatcher.openmq && task.Type == TASK_NORMAL {
+		dispatcher.messagePipeline <- task
+	} else {
+		if dispatcher.openmq && dispatcher.wait {
+			dispatcher.mpwg.Done()
+		}
+		task.batch.finish(task)
+	}
+	if dispatcher.wait {
+		dispatcher.wg.Done()
+	}
+	dispatcher.inflight.Done()
 }
 
-//设置优先执行数
+//设置任务的默认执行超时, 0表示不限制
+func (dispatcher *Dispatcher) SetTaskTimeout(timeout time.Duration) {
+	dispatcher.taskTimeout = timeout
+}
+
+//设置优先执行数: 前num个任务不受RunWithLimiter的间隔限制, 与任务的优先级(Task.Priority)无关
 func (dispatcher *Dispatcher) SetPriority(num int) {
 	if num < 0 {
 		num = 0
@@ -89,19 +230,14 @@ func (dispatcher *Dispatcher) SetPriority(num int) {
 
 func (dispatcher *Dispatcher) Run() {
 
-	for i := 0; i < dispatcher.maxExecutors; i++ {
-		if dispatcher.wait {
-			if !dispatcher.openmq {
-				dispatcher.executors[i] = NewExecutorWithWait(dispatcher.taskPool, dispatcher.wg)
-			} else {
-				dispatcher.executors[i] = NewExecutorWithMQ(dispatcher.taskPool, dispatcher.messagePipeline, dispatcher.wg)
-			}
-		} else {
-			dispatcher.executors[i] = NewExecutor(dispatcher.taskPool)
-		}
-		//开启执行
-		dispatcher.executors[i].Start()
+	//开启执行, 自动伸缩时从最小数量开始
+	dispatcher.poolMutex.Lock()
+	if a := dispatcher.autoScale; a != nil && a.Min > 0 {
+		dispatcher.maxExecutors = a.Min
 	}
+	dispatcher.startExecutors(dispatcher.maxExecutors)
+	dispatcher.running = true
+	dispatcher.poolMutex.Unlock()
 
 	//开启任务分发
 	go dispatcher.dispatch()
@@ -111,8 +247,12 @@ func (dispatcher *Dispatcher) Run() {
 		go dispatcher.report()
 	}
 
+	if dispatcher.autoScale != nil {
+		go dispatcher.autoscale()
+	}
 }
 
+//全局限制任务的执行间隔, 已由按键的限制(SetKeyLimit/SetDefaultKeyLimit)代替
 func (dispatcher *Dispatcher) RunWithLimiter(limiterGap time.Duration) {
 	dispatcher.limiter = time.Tick(limiterGap)
 	dispatcher.Run()
@@ -122,23 +262,60 @@ func (dispatcher *Dispatcher) RunWithLimiter(limiterGap time.Duration) {
 func (dispatcher *Dispatcher) dispatch() {
 	defer dispatcher.shutdown()
 	index := uint64(0)
+	var executorTaskChan chan Task
 	for {
+		//先取得空闲的执行器再按优先级取出任务, 等待执行器期间到达的高优先级任务不会落后
+		if executorTaskChan == nil {
+			select {
+			case executorTaskChan = <-dispatcher.taskPool:
+			case <-dispatcher.quit:
+				return
+			}
+		}
+		//执行器数量减少时, 空闲的执行器退出
+		if dispatcher.retireExecutor(executorTaskChan) {
+			executorTaskChan = nil
+			continue
+		}
 		if dispatcher.priority >= 0 {
 			index++
 		}
-		select {
-		case task := <-dispatcher.taskQueue:
+		task, ok := dispatcher.taskQueue.next(dispatcher.quit, dispatcher.resized)
+		if !ok {
+			select {
+			case <-dispatcher.quit:
+				return
+			default:
+				continue
+			}
+		}
 
-			executorTaskChan := <-dispatcher.taskPool
+		//停止接收任务后, 队列中尚未执行的任务直接取消
+		if dispatcher.isClosed() {
+			dispatcher.cancelTask(task, ErrDispatcherClosed)
+			continue
+		}
 
-			if dispatcher.limiter != nil && index > dispatcher.priority {
-				index = dispatcher.priority //防止index越界
-				<-dispatcher.limiter
-			}
+		//超出所在键的限制时等待, 不占用执行器
+		if !dispatcher.keyLimits.admit(&task) {
+			continue
+		}
 
-			executorTaskChan <- task
+		if dispatcher.limiter != nil && index > dispatcher.priority {
+			index = dispatcher.priority //防止index越界
+			select {
+			case <-dispatcher.limiter:
+			case <-dispatcher.quit:
+				dispatcher.cancelTask(task, ErrDispatcherClosed)
+				return
+			}
+		}
 
+		select {
+		case executorTaskChan <- task:
+			executorTaskChan = nil
 		case <-dispatcher.quit:
+			dispatcher.cancelTask(task, ErrDispatcherClosed)
 			return
 		}
 	}
@@ -149,33 +326,95 @@ func (dispatcher *Dispatcher) report() {
 	for {
 		select {
 		case messageTask := <-dispatcher.messagePipeline:
-			f := dispatcher.messageFunc
+			dispatcher.handleMessage(messageTask)
 
-			//并行处理数据上报
-			go func() {
-				f(messageTask)
-				dispatcher.mpwg.Done()
-			}()
-
-		case <-dispatcher.quit:
-			return
+		case <-dispatcher.reportQuit:
+			//处理停止前剩余的消息
+			for {
+				select {
+				case messageTask := <-dispatcher.messagePipeline:
+					dispatcher.handleMessage(messageTask)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
+func (dispatcher *Dispatcher) handleMessage(messageTask Task) {
+	f := dispatcher.messageFunc
+	if messageTask.batch != nil && messageTask.batch.mf != nil {
+		f = messageTask.batch.mf
+	}
+
+	//并行处理数据上报
+	go func() {
+		f(messageTask)
+		dispatcher.mpwg.Done()
+		messageTask.batch.finish(messageTask)
+	}()
+}
+
 func (dispatcher *Dispatcher) shutdown() {
-	for _, e := range dispatcher.executors {
-		for !e.Stop() { //一直处理停止
+	//取消正在执行的任务, 执行器不再等待挂起的任务
+	dispatcher.cancel()
+	dispatcher.poolMutex.Lock()
+	executors := dispatcher.executors
+	dispatcher.poolMutex.Unlock()
+	for _, e := range executors {
+		e.Stop()
+	}
+	for _, e := range executors {
+		<-e.stopped
+	}
+
+	//不再接收任务, 取消队列中剩余的任务
+	dispatcher.close()
+	dispatcher.requeueing.Wait()
+	for _, queue := range dispatcher.taskQueue.queues {
+		for len(queue) > 0 {
+			dispatcher.cancelTask(<-queue, ErrDispatcherClosed)
 		}
 	}
-	close(dispatcher.taskPool)
-	close(dispatcher.taskQueue)
-	close(dispatcher.messagePipeline)
+	close(dispatcher.reportQuit)
+	close(dispatcher.stopped)
 }
 
-//停止开关
+//立即停止: 取消正在执行和队列中的任务, 等待执行器退出
 func (dispatcher *Dispatcher) Stop() {
-	dispatcher.quit <- true
+	dispatcher.stopOnce.Do(func() {
+		close(dispatcher.quit)
+	})
+	dispatcher.poolMutex.Lock()
+	running := dispatcher.running
+	dispatcher.poolMutex.Unlock()
+	if !running {
+		dispatcher.cancel()
+		return
+	}
+	<-dispatcher.stopped
+}
+
+//优雅停止: 不再接收新任务, 取消队列中尚未执行的任务, 等待正在执行的任务完成;
+//超过timeout后取消仍在执行的任务. 返回时调度器已停止
+func (dispatcher *Dispatcher) Drain(timeout time.Duration) error {
+	dispatcher.close()
+
+	done := make(chan bool)
+	go func() {
+		dispatcher.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("drain timed out after %v, running tasks are cancelled", timeout)
+	}
+	dispatcher.Stop()
+	return err
 }
 
 //设置消息处理方法
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+//测试用的执行体
+type funcRunnable func(ctx context.Context) (Result, error)
+
+func (f funcRunnable) Run(ctx context.Context) (Result, error) {
+	return f(ctx)
+}
+
+//带消息管道的调度器, 结束的任务(包括被取消的)发送到返回的通道
+func newTestDispatcher(executors int) (*Dispatcher, chan Task) {
+	var wg, mpwg sync.WaitGroup
+	d := NewDispatcherWithMQ(executors, 100, &wg, &mpwg)
+	finished := make(chan Task, 100)
+	d.SetMF(func(task Task) {
+		finished <- task
+	})
+	return d, finished
+}
+
+//等待一个结束的任务
+func nextTask(t *testing.T, finished chan Task, timeout time.Duration) Task {
+	t.Helper()
+	select {
+	case task := <-finished:
+		return task
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for a task to finish")
+	}
+	return Task{}
+}
+
+//等待条件成立
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+//优雅停止: 正在执行的任务完成后返回, 之后提交的任务返回ErrDispatcherClosed
+func TestDrain(t *testing.T) {
+	d, finished := newTestDispatcher(2)
+	d.Run()
+	for i := 0; i < 4; i++ {
+		d.SubmitTask(NewTask(funcRunnable(func(ctx context.Context) (Result, error) {
+			time.Sleep(20 * time.Millisecond)
+			return nil, nil
+		})))
+	}
+	waitFor(t, func() bool { return d.Stats().BusyExecutors == 2 })
+	if err := d.Drain(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SubmitTask(NewTask(funcRunnable(nil))); err != ErrDispatcherClosed {
+		t.Fatalf("submit after drain = %v, want ErrDispatcherClosed", err)
+	}
+	//排队中尚未执行的任务被取消, 其余的执行完成
+	stats := d.Stats()
+	if stats.Completed != 2 || stats.Cancelled != 2 {
+		t.Fatalf("completed %d, cancelled %d", stats.Completed, stats.Cancelled)
+	}
+	for i := 0; i < 4; i++ {
+		nextTask(t, finished, time.Second)
+	}
+}
+
+//超时后取消仍在执行的任务
+func TestDrainTimeout(t *testing.T) {
+	d, finished := newTestDispatcher(1)
+	d.Run()
+	started := make(chan bool)
+	d.SubmitTask(NewTask(funcRunnable(func(ctx context.Context) (Result, error) {
+		close(started)
+		time.Sleep(5 * time.Second) //不响应取消的任务
+		return nil, nil
+	})))
+	<-started
+	begin := time.Now()
+	if err := d.Drain(50 * time.Millisecond); err == nil {
+		t.Fatal("expected a drain timeout")
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("Drain returned after %s", elapsed)
+	}
+	if task := nextTask(t, finished, time.Second); task.Err != context.Canceled {
+		t.Fatalf("task error = %v, want context.Canceled", task.Err)
+	}
+}
+
+func TestSubmitTaskWithContext(t *testing.T) {
+	//提交前已经取消
+	d, finished := newTestDispatcher(1)
+	d.Run()
+	defer d.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.SubmitTaskWithContext(ctx, NewTask(funcRunnable(nil))); err != context.Canceled {
+		t.Fatalf("submit with a cancelled context = %v", err)
+	}
+
+	//执行中取消
+	ctx, cancel = context.WithCancel(context.Background())
+	started := make(chan bool)
+	d.SubmitTaskWithContext(ctx, NewTask(funcRunnable(func(ctx context.Context) (Result, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})))
+	<-started
+	cancel()
+	if task := nextTask(t, finished, time.Second); task.Err != context.Canceled {
+		t.Fatalf("task error = %v, want context.Canceled", task.Err)
+	}
+
+	//超时
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	d.SubmitTaskWithContext(ctx, NewTask(funcRunnable(func(ctx context.Context) (Result, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})))
+	if task := nextTask(t, finished, time.Second); task.Err != context.DeadlineExceeded {
+		t.Fatalf("task error = %v, want context.DeadlineExceeded", task.Err)
+	}
+}
+
+//队列已满时阻塞的提交在ctx取消后返回
+func TestSubmitTaskWithContextBlocked(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	defer d.Stop()
+	if err := d.SubmitTask(NewTask(funcRunnable(nil))); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.SubmitTaskWithContext(ctx, NewTask(funcRunnable(nil))); err != context.DeadlineExceeded {
+		t.Fatalf("blocked submit = %v, want context.DeadlineExceeded", err)
+	}
+	if n := d.Stats().Submitted; n != 1 {
+		t.Fatalf("%d tasks submitted, want 1", n)
+	}
+}
+
+//Run与Stop并发调用
+func TestRunStopConcurrently(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		d, _ := newTestDispatcher(2)
+		done := make(chan bool)
+		go func() {
+			d.Run()
+			close(done)
+		}()
+		d.Stop()
+		<-done
+		d.Stop()
+	}
+}
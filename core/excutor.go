@@ -1,21 +1,32 @@
 package core
 
 import (
+	"context"
+	"fmt"
 	"reflect"
 	"sync"
 	"time"
 )
 
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 //执行器结构
 type Executor struct {
 	TaskPool   chan chan Task //任务池
 	TaskChan   chan Task      //任务通道
 	wg         *sync.WaitGroup
 	quit       chan bool
+	stopOnce   *sync.Once
+	stopped    chan bool //执行器退出后关闭
 	wait       bool
-	idle       bool //是否空闲
 	mq         chan Task
 	use_report bool
+	ctx        context.Context //调度器的上下文, 取消后正在执行的任务停止
+	inflight   *sync.WaitGroup //调度器中未完成的任务
+	retry      func(Task) bool //失败的任务重新排队时返回true
+	release    func(Task)      //释放任务占用的限流名额
+	stats      *dispatcherStats
+	taskLog    *TaskLog
 }
 
 //构建执行器
@@ -25,8 +36,10 @@ func NewExecutor(taskPool chan chan Task) Executor {
 		TaskChan:   make(chan Task),
 		wait:       false,
 		quit:       make(chan bool),
-		idle:       false,
+		stopOnce:   &sync.Once{},
+		stopped:    make(chan bool),
 		use_report: false,
+		ctx:        context.Background(),
 	}
 }
 
@@ -50,64 +63,134 @@ func NewExecutorWithMQ(taskPool chan chan Task, mq chan Task, wg *sync.WaitGroup
 //开启执行模式
 func (e *Executor) Start() {
 	go func() {
+		defer close(e.stopped)
 		for {
-			e.TaskPool <- e.TaskChan
+			select {
+			case e.TaskPool <- e.TaskChan:
+			case <-e.quit:
+				println("executor quit")
+				return
+			}
 			select {
 			case task := <-e.TaskChan:
-				e.idle = false
+				//调度器减少执行器数量
+				if task.retire {
+					return
+				}
 				if task.Type == TASK_NORMAL {
-					//通过反射调用任务函数
-					task.StartTime = time.Now().Unix()
-					e.Call(task)
+					task.Attempts++
+					start := time.Now()
+					if e.stats != nil {
+						e.stats.begin(task, start)
+					}
+					task.StartTime = start.Unix()
+					e.taskLog.start(task)
+					task.Result, task.Err = e.execute(task)
 					task.EndTime = time.Now().Unix()
-					//任务上报
+					if e.stats != nil {
+						e.stats.end(start)
+					}
+					if e.release != nil {
+						e.release(task)
+					}
+					task.admitted = false
+					//失败的任务重新排队, 暂不上报
+					if task.Err != nil && e.retry != nil && e.retry(task) {
+						continue
+					}
+					if e.stats != nil {
+						e.stats.finish(task)
+					}
+					//调度器停止时中断的任务没有完成
+					if e.ctx.Err() == nil {
+						e.taskLog.done(task)
+					}
+					//任务上报, 组内的任务在结果处理后结束
 					if e.use_report {
 						e.Report(task)
+					} else {
+						task.batch.finish(task)
 					}
+				} else {
+					task.batch.finish(task)
 				}
-				e.idle = true
 				if e.wait {
 					e.wg.Done()
 				}
+				if e.inflight != nil {
+					e.inflight.Done()
+				}
 			case <-e.quit:
-				println("executor quit")
 				return
 			}
 		}
 	}()
 }
 
-//停止执行模式(不是立刻停止,而是发送停止信号呼叫当前任务停止)
-func (e *Executor) Stop() bool {
-	if e.idle {
-		e.quit <- true
-		return true
+//停止执行器, 正在执行的任务由上下文取消
+func (e *Executor) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.quit)
+	})
+}
+
+//执行任务: 任务超时或者被取消时不再等待任务返回, 避免挂起的任务阻塞执行器
+func (e *Executor) execute(task Task) (Result, error) {
+	ctx, cancel := mergeContext(task.Context(), e.ctx)
+	defer cancel()
+	if task.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, task.Timeout)
+		defer cancelTimeout()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	runnable := task.runnable()
+	if runnable == nil {
+		return nil, fmt.Errorf("task %s has nothing to run", task.TaskId)
+	}
+
+	type outcome struct {
+		result Result
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := runnable.Run(ctx)
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return false
 }
 
-//任务方法调用
-func (e *Executor) Call(task Task) []interface{} {
-	out := reflect.ValueOf(*task.TargetObj).MethodByName(task.TargetFunc).Call([]reflect.Value{})
-	if len(out) == 0 {
-		return nil
+//任务方法调用, 方法的参数为context.Context时传入任务的上下文
+func (e *Executor) Call(ctx context.Context, task Task) []interface{} {
+	out, err := callMethod(ctx, *task.TargetObj, task.TargetFunc)
+	if err != nil {
+		return []interface{}{ExeError{err.Error()}}
 	}
+	return out
+}
 
-	outArgs := make([]interface{}, len(out))
-	for i := 0; i < len(outArgs); i++ {
-		outArgs[i] = out[i].Interface()
+//parent取消或者other取消时都会取消的上下文
+func mergeContext(parent, other context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if other == nil || other == parent {
+		return ctx, cancel
 	}
-	lastParamter := out[len(out)-1].Interface()
-	//判断最后的返回参数是否为error类型
-	if lastParamter != nil {
-		if e, ok := lastParamter.(error); ok {
-			//最后的返回结果为错误类型,且不为空的情况(可能需要最错误重试)
-			outArgs[len(out)-1] = ExeError{e.Error()}
-		} else {
-			println("final param must be error")
+	go func() {
+		select {
+		case <-other.Done():
+			cancel()
+		case <-ctx.Done():
 		}
-	}
-	return outArgs
+	}()
+	return ctx, cancel
 }
 
 //消息上报
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"encoding/binary"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
@@ -85,3 +87,41 @@ func IsIntranet(ipStr string) bool {
 
 	return false
 }
+
+//展开IPv4地址段(例如 10.0.0.0/24)为主机地址列表, 不包含网络地址和广播地址; 单个地址原样返回
+func ExpandCIDR(cidr string) ([]string, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid ipv4 address %q", cidr)
+		}
+		return []string{ip.To4().String()}, nil
+	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("only ipv4 ranges are supported: %s", cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("range %s is too large, the prefix must be /16 or longer", cidr)
+	}
+
+	start := binary.BigEndian.Uint32(ipnet.IP.To4())
+	size := uint32(1) << uint(bits-ones)
+	first, last := start, start+size-1
+	//前缀为31位和32位时没有网络地址和广播地址
+	if size > 2 {
+		first++
+		last--
+	}
+	ips := make([]string, 0, last-first+1)
+	addr := make(net.IP, 4)
+	for i := uint32(0); i <= last-first; i++ {
+		binary.BigEndian.PutUint32(addr, first+i)
+		ips = append(ips, addr.String())
+	}
+	return ips, nil
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandCIDR(t *testing.T) {
+	cases := []struct {
+		cidr  string
+		count int
+		first string
+		last  string
+	}{
+		{"10.0.0.5", 1, "10.0.0.5", "10.0.0.5"},
+		{"10.0.0.5/32", 1, "10.0.0.5", "10.0.0.5"},
+		//31位前缀的两个地址都是主机地址(RFC 3021)
+		{"10.0.0.4/31", 2, "10.0.0.4", "10.0.0.5"},
+		{"10.0.0.0/30", 2, "10.0.0.1", "10.0.0.2"},
+		//主机位不为0时按网络地址展开
+		{"192.168.1.77/24", 254, "192.168.1.1", "192.168.1.254"},
+		{"172.16.0.0/16", 65534, "172.16.0.1", "172.16.255.254"},
+	}
+	for _, c := range cases {
+		ips, err := ExpandCIDR(c.cidr)
+		if err != nil {
+			t.Fatalf("%s: %s", c.cidr, err)
+		}
+		if len(ips) != c.count || ips[0] != c.first || ips[len(ips)-1] != c.last {
+			t.Fatalf("%s: %d addresses %s - %s, want %d %s - %s", c.cidr, len(ips), ips[0], ips[len(ips)-1], c.count, c.first, c.last)
+		}
+	}
+}
+
+//地址按数值递增, 跨越字节边界时不按字符串排序
+func TestExpandCIDROrder(t *testing.T) {
+	ips, err := ExpandCIDR("10.0.0.0/23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(ips[8:11], ","); got != "10.0.0.9,10.0.0.10,10.0.0.11" {
+		t.Fatalf("ips[8:11] = %s", got)
+	}
+	if got := strings.Join(ips[253:257], ","); got != "10.0.0.254,10.0.0.255,10.0.1.0,10.0.1.1" {
+		t.Fatalf("ips[253:257] = %s", got)
+	}
+	if len(ips) != 510 {
+		t.Fatalf("%d addresses, want 510", len(ips))
+	}
+}
+
+func TestExpandCIDRErrors(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/15", "0.0.0.0/0", "10.0.0.256", "10.0.0.0/33", "fe80::1", "fe80::/120", "switch-1"} {
+		if ips, err := ExpandCIDR(cidr); err == nil {
+			t.Fatalf("%s: %d addresses, want an error", cidr, len(ips))
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+//单个键(例如设备地址)的限制
+type KeyLimit struct {
+	MaxInFlight int     //同时执行的任务数上限, 0表示不限制
+	Rate        float64 //每秒开始执行的任务数(令牌桶), 0表示不限制
+	Burst       int     //令牌桶容量, 不大于0时为1
+}
+
+func (l KeyLimit) capacity() float64 {
+	if l.Burst <= 0 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+//单个键的状态: 正在执行的任务数, 令牌数和等待中的任务
+type keyState struct {
+	limit    KeyLimit
+	inflight int
+	tokens   float64
+	last     time.Time
+	parked   []Task
+	timer    *time.Timer
+}
+
+//补充令牌
+func (s *keyState) refill(now time.Time) {
+	if s.limit.Rate <= 0 {
+		return
+	}
+	s.tokens += now.Sub(s.last).Seconds() * s.limit.Rate
+	if capacity := s.limit.capacity(); s.tokens > capacity {
+		s.tokens = capacity
+	}
+	s.last = now
+}
+
+func (s *keyState) full() bool {
+	return s.limit.MaxInFlight > 0 && s.inflight >= s.limit.MaxInFlight
+}
+
+func (s *keyState) empty() bool {
+	return s.limit.Rate > 0 && s.tokens < 1
+}
+
+//占用一个执行名额和一个令牌
+func (s *keyState) take() {
+	s.inflight++
+	if s.limit.Rate > 0 {
+		s.tokens--
+	}
+}
+
+//按键限制并发数和速率: 超出限制的任务在这里等待, 不占用执行器
+type keyLimiter struct {
+	mutex    sync.Mutex
+	defaults KeyLimit
+	limits   map[string]KeyLimit
+	states   map[string]*keyState
+	closed   bool
+	wake     func(Task)       //等待的任务获得名额后重新排队
+	now      func() time.Time //时钟, 测试时替换
+}
+
+func newKeyLimiter(wake func(Task)) *keyLimiter {
+	return &keyLimiter{
+		limits: make(map[string]KeyLimit),
+		states: make(map[string]*keyState),
+		wake:   wake,
+		now:    time.Now,
+	}
+}
+
+func (l *keyLimiter) limit(key string) KeyLimit {
+	if limit, ok := l.limits[key]; ok {
+		return limit
+	}
+	return l.defaults
+}
+
+func (l *keyLimiter) state(key string, now time.Time) *keyState {
+	s, ok := l.states[key]
+	if !ok {
+		limit := l.limit(key)
+		s = &keyState{limit: limit, tokens: limit.capacity(), last: now}
+		l.states[key] = s
+	}
+	return s
+}
+
+//设置键的限制, 已经在等待的任务按新的限制放行
+func (l *keyLimiter) set(key string, limit KeyLimit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limits[key] = limit
+	if s, ok := l.states[key]; ok {
+		s.limit = limit
+		l.pump(key, s, l.now())
+	}
+}
+
+func (l *keyLimiter) setDefaults(limit KeyLimit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.defaults = limit
+	for key, s := range l.states {
+		if _, ok := l.limits[key]; !ok {
+			s.limit = limit
+			l.pump(key, s, l.now())
+		}
+	}
+}
+
+//任务可以执行时占用名额并返回true; 否则任务进入等待, 获得名额后通过wake重新排队
+func (l *keyLimiter) admit(task *Task) bool {
+	if task.Key == "" || task.admitted {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return true
+	}
+	now := l.now()
+	s := l.state(task.Key, now)
+	s.refill(now)
+	//已经有任务在等待时排在它们后面
+	if len(s.parked) == 0 && !s.full() && !s.empty() {
+		s.take()
+		task.admitted = true
+		return true
+	}
+	s.parked = append(s.parked, *task)
+	l.schedule(task.Key, s, now)
+	return false
+}
+
+//任务结束, 释放名额并放行等待的任务
+func (l *keyLimiter) release(task Task) {
+	if !task.admitted {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s, ok := l.states[task.Key]
+	if !ok {
+		return
+	}
+	s.inflight--
+	now := l.now()
+	l.pump(task.Key, s, now)
+	//空闲且令牌已满的键不再保留状态
+	if s.inflight == 0 && len(s.parked) == 0 && (s.limit.Rate <= 0 || s.tokens >= s.limit.capacity()) {
+		delete(l.states, task.Key)
+	}
+}
+
+//按到达顺序放行等待的任务, 令牌不足时等待补充
+func (l *keyLimiter) pump(key string, s *keyState, now time.Time) {
+	s.refill(now)
+	for len(s.parked) > 0 && !s.full() && !s.empty() {
+		task := s.parked[0]
+		s.parked = s.parked[1:]
+		s.take()
+		task.admitted = true
+		l.wake(task)
+	}
+	l.schedule(key, s, now)
+}
+
+//有任务在等待令牌时, 在下一个令牌补充后唤醒
+func (l *keyLimiter) schedule(key string, s *keyState, now time.Time) {
+	if s.timer != nil || len(s.parked) == 0 || s.full() || !s.empty() {
+		return
+	}
+	wait := time.Duration((1 - s.tokens) / s.limit.Rate * float64(time.Second))
+	s.timer = time.AfterFunc(wait, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		s.timer = nil
+		if l.states[key] == s {
+			l.pump(key, s, l.now())
+		}
+	})
+}
+
+//等待名额的任务数
+func (l *keyLimiter) waiting() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	n := 0
+	for _, s := range l.states {
+		n += len(s.parked)
+	}
+	return n
+}
+
+//停止限流, 返回全部等待中的任务
+func (l *keyLimiter) flush() []Task {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	tasks := []Task{}
+	for _, s := range l.states {
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+		tasks = append(tasks, s.parked...)
+		s.parked = nil
+	}
+	return tasks
+}
+
+//设置单个键的并发数和速率限制, 覆盖默认限制
+func (dispatcher *Dispatcher) SetKeyLimit(key string, limit KeyLimit) {
+	dispatcher.keyLimits.set(key, limit)
+}
+
+//设置所有键的默认限制, Key为空的任务不受限制
+func (dispatcher *Dispatcher) SetDefaultKeyLimit(limit KeyLimit) {
+	dispatcher.keyLimits.setDefaults(limit)
+}
+
+//等待名额的任务获得名额, 重新排队
+func (dispatcher *Dispatcher) resume(task Task) {
+	dispatcher.requeueing.Add(1)
+	go dispatcher.requeue(task, 0)
+}
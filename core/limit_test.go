@@ -0,0 +1,143 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//同一个键同时执行的任务数不超过MaxInFlight, 不同的键互不影响
+func TestKeyLimitMaxInFlight(t *testing.T) {
+	d, finished := newTestDispatcher(10)
+	d.SetKeyLimit("a", KeyLimit{MaxInFlight: 3})
+	d.Run()
+	defer d.Stop()
+
+	var mutex sync.Mutex
+	running := map[string]int{}
+	peak := map[string]int{}
+	job := func(key string) funcRunnable {
+		return func(ctx context.Context) (Result, error) {
+			mutex.Lock()
+			running[key]++
+			if running[key] > peak[key] {
+				peak[key] = running[key]
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			running[key]--
+			mutex.Unlock()
+			return nil, nil
+		}
+	}
+	const n = 30
+	for i := 0; i < n; i++ {
+		for _, key := range []string{"a", "b"} {
+			task := NewTask(job(key))
+			task.Key = key
+			if err := d.SubmitTask(task); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 2*n; i++ {
+		if task := nextTask(t, finished, 5*time.Second); task.Err != nil {
+			t.Fatal(task.Err)
+		}
+	}
+	if peak["a"] != 3 {
+		t.Fatalf("key a peaked at %d running tasks, want 3", peak["a"])
+	}
+	if peak["b"] <= 3 {
+		t.Fatalf("key b peaked at %d running tasks, want it unlimited", peak["b"])
+	}
+	if w := d.Stats().Waiting; w != 0 {
+		t.Fatalf("%d tasks still waiting", w)
+	}
+}
+
+//模拟时钟下的令牌桶: 突发Burst个, 之后每秒Rate个
+func TestKeyLimitRate(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	var woken int32
+	l := newKeyLimiter(func(Task) { atomic.AddInt32(&woken, 1) })
+	l.now = func() time.Time { return clock }
+	l.set("a", KeyLimit{Rate: 5, Burst: 2})
+	defer l.flush()
+
+	admitted := 0
+	admit := func() bool {
+		task := Task{Key: "a"}
+		if l.admit(&task) {
+			admitted++
+			return true
+		}
+		return false
+	}
+	if !admit() || !admit() {
+		t.Fatal("burst was not admitted")
+	}
+	if admit() {
+		t.Fatal("admitted a task beyond the burst")
+	}
+	//0.2秒补充一个令牌, 放行等待中的任务
+	clock = clock.Add(100 * time.Millisecond)
+	l.mutex.Lock()
+	l.pump("a", l.states["a"], l.now())
+	l.mutex.Unlock()
+	if atomic.LoadInt32(&woken) != 0 {
+		t.Fatal("woke a task before a token was refilled")
+	}
+	clock = clock.Add(100 * time.Millisecond)
+	l.mutex.Lock()
+	l.pump("a", l.states["a"], l.now())
+	l.mutex.Unlock()
+	if n := atomic.LoadInt32(&woken); n != 1 || l.waiting() != 0 {
+		t.Fatalf("woken %d, waiting %d", n, l.waiting())
+	}
+
+	//持续有任务时10秒内开始50个
+	admitted = 0
+	atomic.StoreInt32(&woken, 0)
+	for i := 0; i < 1000; i++ {
+		clock = clock.Add(10 * time.Millisecond)
+		l.mutex.Lock()
+		l.pump("a", l.states["a"], l.now())
+		l.mutex.Unlock()
+		if l.waiting() == 0 {
+			admit()
+		}
+	}
+	if started := admitted + int(atomic.LoadInt32(&woken)); started < 49 || started > 51 {
+		t.Fatalf("%d tasks started in 10s at 5/s", started)
+	}
+}
+
+//等待令牌的任务按到达顺序放行
+func TestKeyLimitOrder(t *testing.T) {
+	clock := time.Unix(1000, 0)
+	order := []string{}
+	l := newKeyLimiter(func(task Task) { order = append(order, task.TaskId) })
+	l.now = func() time.Time { return clock }
+	l.set("a", KeyLimit{Rate: 1})
+	defer l.flush()
+
+	for _, id := range []string{"1", "2", "3"} {
+		task := Task{TaskId: id, Key: "a"}
+		if l.admit(&task) {
+			order = append(order, id)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		clock = clock.Add(time.Second)
+		l.mutex.Lock()
+		l.pump("a", l.states["a"], l.now())
+		l.mutex.Unlock()
+	}
+	if len(order) != 3 || order[0] != "1" || order[1] != "2" || order[2] != "3" {
+		t.Fatalf("order %v", order)
+	}
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+//执行器数量的自动伸缩: 队列积压时增加执行器, 执行器空闲时减少, 数量在Min和Max之间
+type AutoScale struct {
+	Min      int
+	Max      int
+	Interval time.Duration //检查间隔, 不大于0时为1秒
+	Step     int           //每次检查最多增加的执行器数量, 不大于0时为当前数量(每次最多翻倍)
+}
+
+//按调度器的配置创建执行器
+func (dispatcher *Dispatcher) newExecutor() *Executor {
+	var e Executor
+	if dispatcher.wait {
+		if !dispatcher.openmq {
+			e = NewExecutorWithWait(dispatcher.taskPool, dispatcher.wg)
+		} else {
+			e = NewExecutorWithMQ(dispatcher.taskPool, dispatcher.messagePipeline, dispatcher.wg)
+		}
+	} else {
+		e = NewExecutor(dispatcher.taskPool)
+	}
+	e.ctx = dispatcher.ctx
+	e.inflight = &dispatcher.inflight
+	e.retry = dispatcher.retry
+	e.release = dispatcher.keyLimits.release
+	e.stats = dispatcher.stats
+	e.taskLog = dispatcher.taskLog
+	return &e
+}
+
+//启动n个执行器, 调用时持有poolMutex
+func (dispatcher *Dispatcher) startExecutors(n int) {
+	for i := 0; i < n; i++ {
+		e := dispatcher.newExecutor()
+		e.Start()
+		dispatcher.executors = append(dispatcher.executors, e)
+	}
+}
+
+//调整执行器数量, 运行中也可以调用: 增加时立即启动新的执行器,
+//减少时空闲的执行器依次退出, 正在执行任务的执行器完成任务后退出, 队列中的任务不受影响
+func (dispatcher *Dispatcher) Resize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("number of executors must be positive, got %d", n)
+	}
+	dispatcher.poolMutex.Lock()
+	defer dispatcher.poolMutex.Unlock()
+	select {
+	case <-dispatcher.quit:
+		return ErrDispatcherClosed
+	default:
+	}
+	if !dispatcher.running {
+		dispatcher.maxExecutors = n
+		return nil
+	}
+
+	//移除已经退出的执行器
+	live := dispatcher.executors[:0]
+	for _, e := range dispatcher.executors {
+		select {
+		case <-e.stopped:
+		default:
+			live = append(live, e)
+		}
+	}
+	dispatcher.executors = live
+
+	if n > dispatcher.maxExecutors {
+		grow := n - dispatcher.maxExecutors
+		//先撤销尚未执行的减少
+		if dispatcher.retire >= grow {
+			dispatcher.retire -= grow
+			grow = 0
+		} else {
+			grow -= dispatcher.retire
+			dispatcher.retire = 0
+		}
+		dispatcher.startExecutors(grow)
+	} else {
+		dispatcher.retire += dispatcher.maxExecutors - n
+	}
+	dispatcher.maxExecutors = n
+
+	//唤醒等待任务的分发协程处理减少
+	select {
+	case dispatcher.resized <- true:
+	default:
+	}
+	return nil
+}
+
+//分发协程取得的空闲执行器需要退出时, 通知执行器退出并返回true
+func (dispatcher *Dispatcher) retireExecutor(executorTaskChan chan Task) bool {
+	dispatcher.poolMutex.Lock()
+	if dispatcher.retire == 0 {
+		dispatcher.poolMutex.Unlock()
+		return false
+	}
+	dispatcher.retire--
+	dispatcher.poolMutex.Unlock()
+	select {
+	case executorTaskChan <- Task{retire: true}:
+	case <-dispatcher.quit:
+	}
+	return true
+}
+
+//开启执行器数量的自动伸缩, 在Run之前调用; Run时启动Min个执行器
+func (dispatcher *Dispatcher) SetAutoScale(a *AutoScale) {
+	dispatcher.autoScale = a
+}
+
+//按队列长度和空闲执行器数量调整执行器数量
+func (dispatcher *Dispatcher) autoscale() {
+	a := dispatcher.autoScale
+	interval := a.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-dispatcher.quit:
+			return
+		}
+		stats := dispatcher.Stats()
+		target := stats.Executors
+		if stats.QueueDepth > 0 {
+			//队列积压: 按积压的任务数增加, 每次不超过Step个, 短暂的突发不会一次增加到上限
+			step := a.Step
+			if step <= 0 {
+				step = stats.Executors
+			}
+			if grow := stats.QueueDepth; grow < step {
+				target += grow
+			} else {
+				target += step
+			}
+		} else if stats.IdleExecutors > 0 {
+			//每次减少一半的空闲执行器, 避免短暂空闲时频繁伸缩
+			target -= (stats.IdleExecutors + 1) / 2
+		}
+		if target > a.Max {
+			target = a.Max
+		}
+		if target < a.Min {
+			target = a.Min
+		}
+		if target != stats.Executors {
+			dispatcher.Resize(target)
+		}
+	}
+}
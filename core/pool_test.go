@@ -0,0 +1,151 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录同时执行的任务数的峰值
+type concurrency struct {
+	mutex   sync.Mutex
+	running int
+	peak    int
+}
+
+func (c *concurrency) job(release <-chan bool) funcRunnable {
+	return func(ctx context.Context) (Result, error) {
+		c.mutex.Lock()
+		c.running++
+		if c.running > c.peak {
+			c.peak = c.running
+		}
+		c.mutex.Unlock()
+		if release != nil {
+			<-release
+		} else {
+			time.Sleep(2 * time.Millisecond)
+		}
+		c.mutex.Lock()
+		c.running--
+		c.mutex.Unlock()
+		return nil, nil
+	}
+}
+
+func (c *concurrency) get() (int, int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.running, c.peak
+}
+
+//执行器都在执行任务时减少数量: 任务不丢失, 完成后多余的执行器退出
+func TestResizeShrinkWhileBusy(t *testing.T) {
+	d, finished := newTestDispatcher(4)
+	d.Run()
+	defer d.Stop()
+
+	c := &concurrency{}
+	release := make(chan bool)
+	for i := 0; i < 4; i++ {
+		d.SubmitTask(NewTask(c.job(release)))
+	}
+	waitFor(t, func() bool { running, _ := c.get(); return running == 4 })
+	if err := d.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.Stats().Executors; n != 1 {
+		t.Fatalf("%d executors after resize, want 1", n)
+	}
+	//排队中的任务同样不丢失
+	for i := 0; i < 6; i++ {
+		d.SubmitTask(NewTask(c.job(nil)))
+	}
+	close(release)
+	for i := 0; i < 10; i++ {
+		if task := nextTask(t, finished, 5*time.Second); task.Err != nil {
+			t.Fatal(task.Err)
+		}
+	}
+
+	//减少后只有一个执行器
+	c = &concurrency{}
+	for i := 0; i < 10; i++ {
+		d.SubmitTask(NewTask(c.job(nil)))
+	}
+	for i := 0; i < 10; i++ {
+		nextTask(t, finished, 5*time.Second)
+	}
+	if _, peak := c.get(); peak != 1 {
+		t.Fatalf("%d tasks ran at once after shrinking to 1 executor", peak)
+	}
+	if stats := d.Stats(); stats.Completed != 20 || stats.Cancelled != 0 {
+		t.Fatalf("completed %d, cancelled %d", stats.Completed, stats.Cancelled)
+	}
+}
+
+//运行中增加执行器立即生效
+func TestResizeGrow(t *testing.T) {
+	d, finished := newTestDispatcher(1)
+	d.Run()
+	defer d.Stop()
+	if err := d.Resize(0); err == nil {
+		t.Fatal("resized to 0 executors")
+	}
+	d.Resize(4)
+
+	c := &concurrency{}
+	release := make(chan bool)
+	for i := 0; i < 4; i++ {
+		d.SubmitTask(NewTask(c.job(release)))
+	}
+	waitFor(t, func() bool { running, _ := c.get(); return running == 4 })
+	close(release)
+	for i := 0; i < 4; i++ {
+		nextTask(t, finished, 5*time.Second)
+	}
+}
+
+//自动伸缩: 每次最多翻倍, 不超过Max
+func TestAutoScaleGrowth(t *testing.T) {
+	d, finished := newTestDispatcher(1)
+	d.SetAutoScale(&AutoScale{Min: 1, Max: 5, Interval: 20 * time.Millisecond})
+	d.Run()
+	defer d.Stop()
+
+	c := &concurrency{}
+	release := make(chan bool)
+	for i := 0; i < 20; i++ {
+		d.SubmitTask(NewTask(c.job(release)))
+	}
+	sizes := []int{1}
+	deadline := time.Now().Add(5 * time.Second)
+	for sizes[len(sizes)-1] < 5 && time.Now().Before(deadline) {
+		if n := d.Stats().Executors; n != sizes[len(sizes)-1] {
+			sizes = append(sizes, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	want := []int{1, 2, 4, 5}
+	if len(sizes) != len(want) {
+		t.Fatalf("executors grew %v, want %v", sizes, want)
+	}
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Fatalf("executors grew %v, want %v", sizes, want)
+		}
+	}
+	//积压仍然存在时保持在Max
+	time.Sleep(100 * time.Millisecond)
+	if n := d.Stats().Executors; n != 5 {
+		t.Fatalf("%d executors, want 5", n)
+	}
+	if running, _ := c.get(); running != 5 {
+		t.Fatalf("%d tasks running, want 5", running)
+	}
+	close(release)
+	for i := 0; i < 20; i++ {
+		nextTask(t, finished, 5*time.Second)
+	}
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+//任务优先级, 每个优先级一个队列
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0 //默认优先级
+	PriorityHigh   Priority = 1
+)
+
+const priorityLevels = 3
+
+//默认权重: 队列都有任务时, 每取出13个任务中高优先级8个, 普通4个, 低优先级1个
+var defaultPriorityWeights = [priorityLevels]int{1, 4, 8}
+
+func (p Priority) String() string {
+	switch p.level() {
+	case 0:
+		return "low"
+	case 2:
+		return "high"
+	}
+	return "normal"
+}
+
+//队列下标, 超出范围的优先级按最高或者最低处理
+func (p Priority) level() int {
+	if p < PriorityLow {
+		p = PriorityLow
+	}
+	if p > PriorityHigh {
+		p = PriorityHigh
+	}
+	return int(p - PriorityLow)
+}
+
+//解析优先级名称: high, normal, low; 空字符串为normal
+func ParsePriority(name string) (Priority, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "high":
+		return PriorityHigh, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q", name)
+}
+
+//优先级队列: 按权重轮流从有任务的队列中取出任务(平滑加权轮询),
+//低优先级的队列也能按权重比例被调度, 不会因为高优先级的任务持续到达而饿死
+type priorityQueue struct {
+	queues  [priorityLevels]chan Task
+	weights [priorityLevels]int
+	current [priorityLevels]int
+}
+
+func newPriorityQueue(bufferSize int) *priorityQueue {
+	q := &priorityQueue{weights: defaultPriorityWeights}
+	for i := range q.queues {
+		q.queues[i] = make(chan Task, bufferSize)
+	}
+	return q
+}
+
+//任务所在优先级的队列
+func (q *priorityQueue) queue(p Priority) chan Task {
+	return q.queues[p.level()]
+}
+
+//队列中的任务数
+func (q *priorityQueue) len() int {
+	n := 0
+	for i := range q.queues {
+		n += len(q.queues[i])
+	}
+	return n
+}
+
+//按权重选择有任务的队列, 都没有任务时返回-1
+func (q *priorityQueue) pick() int {
+	best, total := -1, 0
+	for i := range q.queues {
+		if len(q.queues[i]) == 0 {
+			continue
+		}
+		q.current[i] += q.weights[i]
+		total += q.weights[i]
+		if best < 0 || q.current[i] > q.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		q.current[best] -= total
+	}
+	return best
+}
+
+//取出下一个任务, 队列都为空时等待; quit关闭或者收到wake时返回false
+func (q *priorityQueue) next(quit chan bool, wake chan bool) (Task, bool) {
+	//队列只由分发协程读取, 有任务的队列不会阻塞
+	if i := q.pick(); i >= 0 {
+		return <-q.queues[i], true
+	}
+	select {
+	case task := <-q.queues[2]:
+		return task, true
+	case task := <-q.queues[1]:
+		return task, true
+	case task := <-q.queues[0]:
+		return task, true
+	case <-quit:
+		return Task{}, false
+	case <-wake:
+		return Task{}, false
+	}
+}
+
+//设置优先级的权重, 不小于1; 需要在Run之前设置
+func (dispatcher *Dispatcher) SetPriorityWeight(p Priority, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	dispatcher.taskQueue.weights[p.level()] = weight
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+//按优先级依次取出的任务, 每个任务记为优先级名称的首字母
+func dequeueOrder(q *priorityQueue, n int) string {
+	var order strings.Builder
+	for i := 0; i < n; i++ {
+		task, ok := q.next(nil, nil)
+		if !ok {
+			break
+		}
+		order.WriteByte(task.Priority.String()[0])
+	}
+	return order.String()
+}
+
+func fillQueue(q *priorityQueue, p Priority, n int) {
+	for i := 0; i < n; i++ {
+		q.queue(p) <- Task{Priority: p}
+	}
+}
+
+//平滑加权轮询: 5:1 时每6个任务中低优先级1个, 并且不集中在一起
+func TestPriorityQueueOrder(t *testing.T) {
+	q := newPriorityQueue(100)
+	q.weights[PriorityHigh.level()] = 5
+	q.weights[PriorityLow.level()] = 1
+	fillQueue(q, PriorityHigh, 50)
+	fillQueue(q, PriorityLow, 20)
+
+	want := strings.Repeat("hhlhhh", 10) + strings.Repeat("l", 10)
+	if got := dequeueOrder(q, 70); got != want {
+		t.Fatalf("order %s, want %s", got, want)
+	}
+}
+
+//默认权重 1:4:8, 低优先级的任务也能被调度
+func TestPriorityQueueDefaultWeights(t *testing.T) {
+	q := newPriorityQueue(100)
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		fillQueue(q, p, 26)
+	}
+	counts := map[rune]int{}
+	for _, c := range dequeueOrder(q, 26) {
+		counts[c]++
+	}
+	if counts['h'] != 16 || counts['n'] != 8 || counts['l'] != 2 {
+		t.Fatalf("counts %v, want h:16 n:8 l:2", counts)
+	}
+}
+
+//队列为空时等待, 收到wake时返回false
+func TestPriorityQueueWake(t *testing.T) {
+	q := newPriorityQueue(1)
+	wake := make(chan bool, 1)
+	wake <- true
+	if _, ok := q.next(nil, wake); ok {
+		t.Fatal("next returned a task from empty queues")
+	}
+	fillQueue(q, PriorityLow, 1)
+	if task, ok := q.next(nil, nil); !ok || task.Priority != PriorityLow {
+		t.Fatalf("next = %v, %v", task, ok)
+	}
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+//重试策略: 失败的任务等待退避时间后重新排队, 等待期间不占用执行器
+type RetryPolicy struct {
+	MaxAttempts int                  //最大执行次数(包含第一次), 不大于1时不重试
+	BaseDelay   time.Duration        //第一次重试前的等待时间
+	MaxDelay    time.Duration        //等待时间上限, 0表示不限制
+	Multiplier  float64              //每次重试等待时间的倍数, 不大于1时使用2
+	Jitter      float64              //随机抖动比例(0-1), 等待时间在 [d*(1-Jitter), d] 之间
+	Retryable   func(err error) bool //判断错误是否可以重试, 为空时除永久错误外全部重试
+}
+
+//永久错误, 不会重试
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+//标记为永久错误
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return PermanentError{err}
+}
+
+//第attempt次执行失败后的等待时间
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+	delay := float64(p.BaseDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		delay -= delay * jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+//任务被取消或者调度器停止, 既不重试也不作为死信
+func interrupted(task Task) bool {
+	return task.Err == ErrDispatcherClosed || task.Err == context.Canceled || task.Context().Err() != nil
+}
+
+//任务的错误是否可以重试
+func (p *RetryPolicy) retryable(task Task) bool {
+	if p.MaxAttempts <= 1 {
+		return false
+	}
+	if _, ok := task.Err.(PermanentError); ok {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(task.Err)
+	}
+	return true
+}
+
+//设置默认的重试策略, 任务的Retry不为空时使用任务的策略
+func (dispatcher *Dispatcher) SetRetryPolicy(p *RetryPolicy) {
+	dispatcher.retryPolicy = p
+}
+
+//设置死信通道, 设置了重试策略时, 错误不能重试或者用完重试次数仍然失败的任务发送到该通道(通道满时丢弃);
+//这些任务同样会上报到消息管道
+func (dispatcher *Dispatcher) SetDeadLetter(ch chan<- Task) {
+	dispatcher.deadLetter = ch
+}
+
+//失败的任务按重试策略重新排队, 返回false时任务结束
+func (dispatcher *Dispatcher) retry(task Task) bool {
+	policy := task.Retry
+	if policy == nil {
+		policy = dispatcher.retryPolicy
+	}
+	if policy == nil || task.Err == nil || interrupted(task) {
+		return false
+	}
+	if !policy.retryable(task) || task.Attempts >= policy.MaxAttempts {
+		dispatcher.sendDeadLetter(task)
+		return false
+	}
+	atomic.AddUint64(&dispatcher.stats.retried, 1)
+	dispatcher.requeueing.Add(1)
+	go dispatcher.requeue(task, policy.Backoff(task.Attempts))
+	return true
+}
+
+//等待退避时间后重新排队; 调度器停止接收任务或者任务被取消时结束任务
+func (dispatcher *Dispatcher) requeue(task Task, delay time.Duration) {
+	defer dispatcher.requeueing.Done()
+	//重试的任务保留最后一次执行的错误
+	cancel := func(err error) {
+		if task.Err != nil {
+			err = task.Err
+		}
+		dispatcher.cancelTask(task, err)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-dispatcher.closed:
+		cancel(ErrDispatcherClosed)
+		return
+	case <-task.Context().Done():
+		cancel(task.Context().Err())
+		return
+	}
+	select {
+	case dispatcher.taskQueue.queue(task.Priority) <- task:
+	case <-dispatcher.closed:
+		cancel(ErrDispatcherClosed)
+	case <-task.Context().Done():
+		cancel(task.Context().Err())
+	}
+}
+
+func (dispatcher *Dispatcher) sendDeadLetter(task Task) {
+	if dispatcher.deadLetter == nil {
+		return
+	}
+	select {
+	case dispatcher.deadLetter <- task:
+	default:
+	}
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("device is down")
+
+//前failures次执行失败的执行体, failures小于0时总是失败
+func failing(failures int32, err error) funcRunnable {
+	var runs int32
+	return func(ctx context.Context) (Result, error) {
+		if n := atomic.AddInt32(&runs, 1); failures < 0 || n <= failures {
+			return nil, err
+		}
+		return "ok", nil
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	never := func(error) bool { return false }
+	cases := []struct {
+		name     string
+		policy   *RetryPolicy
+		failures int32
+		err      error
+		attempts int
+		failed   bool
+		dead     bool
+	}{
+		{"no policy", nil, -1, errDown, 1, true, false},
+		{"succeeds on retry", &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}, 1, errDown, 2, false, false},
+		{"exhausted", &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}, -1, errDown, 3, true, true},
+		{"single attempt", &RetryPolicy{MaxAttempts: 1}, -1, errDown, 1, true, true},
+		{"permanent", &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}, -1, Permanent(errDown), 1, true, true},
+		{"not retryable", &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, Retryable: never}, -1, errDown, 1, true, true},
+	}
+	for _, c := range cases {
+		d, finished := newTestDispatcher(2)
+		dead := make(chan Task, 10)
+		d.SetDeadLetter(dead)
+		d.Run()
+
+		task := NewTask(failing(c.failures, c.err))
+		task.Retry = c.policy
+		if err := d.SubmitTask(task); err != nil {
+			t.Fatal(err)
+		}
+		task = nextTask(t, finished, 5*time.Second)
+		if task.Attempts != c.attempts || (task.Err != nil) != c.failed {
+			t.Errorf("%s: %d attempts, error %v", c.name, task.Attempts, task.Err)
+		}
+		if got := len(dead); got != btoi(c.dead) {
+			t.Errorf("%s: %d dead letters", c.name, got)
+		}
+		if retried := d.Stats().Retried; retried != uint64(c.attempts-1) {
+			t.Errorf("%s: retried %d times", c.name, retried)
+		}
+		d.Stop()
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//调度器的默认策略, 任务的策略优先
+func TestRetryDefaultPolicy(t *testing.T) {
+	d, finished := newTestDispatcher(1)
+	d.SetRetryPolicy(&RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond})
+	d.Run()
+	defer d.Stop()
+
+	d.SubmitTask(NewTask(failing(-1, errDown)))
+	if task := nextTask(t, finished, 5*time.Second); task.Attempts != 4 {
+		t.Fatalf("%d attempts with the default policy, want 4", task.Attempts)
+	}
+	task := NewTask(failing(-1, errDown))
+	task.Retry = &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+	d.SubmitTask(task)
+	if task := nextTask(t, finished, 5*time.Second); task.Attempts != 2 {
+		t.Fatalf("%d attempts with the task policy, want 2", task.Attempts)
+	}
+}
+
+//退避等待期间任务被取消: 立即结束, 保留最后一次执行的错误, 不作为死信
+func TestRetryCancelDuringBackoff(t *testing.T) {
+	d, finished := newTestDispatcher(1)
+	dead := make(chan Task, 1)
+	d.SetDeadLetter(dead)
+	d.Run()
+	defer d.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task := NewTask(failing(-1, errDown))
+	task.Retry = &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour}
+	if err := d.SubmitTaskWithContext(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return d.Stats().Retried == 1 })
+	cancel()
+	task = nextTask(t, finished, time.Second)
+	if task.Attempts != 1 || task.Err != errDown {
+		t.Fatalf("%d attempts, error %v", task.Attempts, task.Err)
+	}
+	if len(dead) != 0 {
+		t.Fatal("a cancelled task was sent to the dead letters")
+	}
+	if stats := d.Stats(); stats.Cancelled != 1 || stats.Failed != 0 {
+		t.Fatalf("cancelled %d, failed %d", stats.Cancelled, stats.Failed)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if got := p.Backoff(attempt + 1); got != want*time.Millisecond {
+			t.Errorf("attempt %d: backoff %s, want %s", attempt+1, got, want*time.Millisecond)
+		}
+	}
+	p = &RetryPolicy{BaseDelay: 100 * time.Millisecond, Multiplier: 3, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if got := p.Backoff(2); got < 150*time.Millisecond || got > 300*time.Millisecond {
+			t.Fatalf("backoff with jitter %s, want within [150ms, 300ms]", got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+//任务的执行结果, 由消息管道随任务一起上报
+type Result interface{}
+
+//可执行的任务
+type Runnable interface {
+	Run(ctx context.Context) (Result, error)
+}
+
+//反射调用的适配: 按方法名调用任务对象的方法, 兼容CreateTask创建的任务
+type methodRunnable struct {
+	target interface{}
+	method string
+}
+
+//方法的返回值中, 最后一个error作为任务的错误, 其余的作为结果(多个时为[]interface{})
+func (m methodRunnable) Run(ctx context.Context) (Result, error) {
+	out, err := callMethod(ctx, m.target, m.method)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > 0 {
+		if e, ok := out[len(out)-1].(ExeError); ok {
+			return methodResult(out[:len(out)-1]), e
+		}
+		if out[len(out)-1] == nil && isErrorResult(m.target, m.method) {
+			out = out[:len(out)-1]
+		}
+	}
+	return methodResult(out), nil
+}
+
+func methodResult(out []interface{}) Result {
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+		return out[0]
+	}
+	return out
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+//方法的最后一个返回值是否为error
+func isErrorResult(target interface{}, name string) bool {
+	t := reflect.ValueOf(target).MethodByName(name).Type()
+	return t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+}
+
+//通过反射调用方法, 方法的参数为context.Context时传入任务的上下文; 方法不存在或者参数不匹配时返回错误
+func callMethod(ctx context.Context, target interface{}, name string) ([]interface{}, error) {
+	method := reflect.ValueOf(target).MethodByName(name)
+	if !method.IsValid() {
+		return nil, fmt.Errorf("task target %T has no method %q", target, name)
+	}
+	args := []reflect.Value{}
+	switch t := method.Type(); {
+	case t.NumIn() == 0:
+	case t.NumIn() == 1 && t.In(0) == contextType:
+		args = append(args, reflect.ValueOf(ctx))
+	default:
+		return nil, fmt.Errorf("method %T.%s must take no argument or a context.Context", target, name)
+	}
+	out := method.Call(args)
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	outArgs := make([]interface{}, len(out))
+	for i := 0; i < len(outArgs); i++ {
+		outArgs[i] = out[i].Interface()
+	}
+	lastParamter := out[len(out)-1].Interface()
+	//判断最后的返回参数是否为error类型
+	if lastParamter != nil {
+		if e, ok := lastParamter.(error); ok {
+			//最后的返回结果为错误类型,且不为空的情况(可能需要最错误重试)
+			outArgs[len(out)-1] = ExeError{e.Error()}
+		} else {
+			println("final param must be error")
+		}
+	}
+	return outArgs, nil
+}
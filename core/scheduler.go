@@ -0,0 +1,226 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//上一次运行还没有结束时的处理策略
+type OverlapPolicy int
+
+const (
+	OverlapSkip    OverlapPolicy = iota //跳过本次运行
+	OverlapCatchUp                      //上一次运行结束后立即补跑一次(多次错过只补跑一次)
+)
+
+func (p OverlapPolicy) String() string {
+	if p == OverlapCatchUp {
+		return "catchup"
+	}
+	return "skip"
+}
+
+//解析策略名称: skip(默认), catchup
+func ParseOverlapPolicy(name string) (OverlapPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "skip":
+		return OverlapSkip, nil
+	case "catchup", "catch-up":
+		return OverlapCatchUp, nil
+	}
+	return OverlapSkip, fmt.Errorf("unknown overlap policy %q", name)
+}
+
+//一次运行: 通常向调度器提交一组任务并等待完成
+type RunFunc func(ctx context.Context) error
+
+//计划任务的运行状态
+type ScheduleStatus struct {
+	Name         string        `json:"name"`
+	Spec         string        `json:"spec"`
+	Policy       string        `json:"policy"`
+	Running      bool          `json:"running"`
+	Runs         int           `json:"runs"`          //运行次数
+	Skipped      int           `json:"skipped"`       //因为上一次运行未结束而跳过的次数
+	LastRun      time.Time     `json:"last_run"`      //最近一次开始运行的时间
+	LastDuration time.Duration `json:"last_duration"` //最近一次运行的耗时
+	LastError    string        `json:"last_error,omitempty"`
+	NextRun      time.Time     `json:"next_run"` //下一次计划运行的时间
+}
+
+type scheduleEntry struct {
+	name     string
+	spec     string
+	schedule Schedule
+	policy   OverlapPolicy
+	run      RunFunc
+
+	running bool
+	catchUp bool //运行结束后需要补跑
+	status  ScheduleStatus
+}
+
+//计划任务调度: 按cron表达式或者固定间隔运行每组任务
+type Scheduler struct {
+	mutex   sync.Mutex
+	entries []*scheduleEntry
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started bool
+}
+
+func NewScheduler() *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{ctx: ctx, cancel: cancel}
+}
+
+//添加计划任务, spec为cron表达式或者固定间隔(见ParseSchedule); 运行中添加的任务立即开始计划
+func (s *Scheduler) Add(name, spec string, policy OverlapPolicy, run RunFunc) error {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	e := &scheduleEntry{
+		name:     name,
+		spec:     spec,
+		schedule: schedule,
+		policy:   policy,
+		run:      run,
+		status:   ScheduleStatus{Name: name, Spec: spec, Policy: policy.String()},
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, other := range s.entries {
+		if other.name == name {
+			return fmt.Errorf("schedule %q already exists", name)
+		}
+	}
+	s.entries = append(s.entries, e)
+	if s.started {
+		s.wg.Add(1)
+		go s.loop(e)
+	}
+	return nil
+}
+
+//开始按计划运行
+func (s *Scheduler) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, e := range s.entries {
+		s.wg.Add(1)
+		go s.loop(e)
+	}
+}
+
+//停止计划, 取消正在运行的任务的ctx并等待它们返回
+func (s *Scheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+//计划任务的运行状态, 按添加顺序返回
+func (s *Scheduler) Status() []ScheduleStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := make([]ScheduleStatus, 0, len(s.entries))
+	for _, e := range s.entries {
+		st := e.status
+		st.Running = e.running
+		status = append(status, st)
+	}
+	return status
+}
+
+//以JSON格式输出计划任务的运行状态, 用于调试接口
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := json.MarshalIndent(s.Status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(data, '\n'))
+}
+
+//计划循环: 到达计划时间时开始运行, 上一次运行未结束时按策略跳过或者补跑
+func (s *Scheduler) loop(e *scheduleEntry) {
+	defer s.wg.Done()
+	next := e.schedule.Next(time.Now())
+	for {
+		if next.IsZero() {
+			return
+		}
+		s.mutex.Lock()
+		e.status.NextRun = next
+		s.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		s.mutex.Lock()
+		if !e.running {
+			e.running = true
+			s.wg.Add(1)
+			go s.execute(e)
+		} else if e.policy == OverlapCatchUp {
+			e.catchUp = true
+		} else {
+			e.status.Skipped++
+			fmt.Printf("计划任务(%s)上一次运行还没有结束, 跳过本次运行 \n", e.name)
+		}
+		s.mutex.Unlock()
+
+		//固定间隔按计划时间累加, 落后太多(例如系统休眠)时从当前时间重新计算
+		now := time.Now()
+		next = e.schedule.Next(next)
+		if !next.IsZero() && next.Before(now) {
+			next = e.schedule.Next(now)
+		}
+	}
+}
+
+//运行一次, 运行期间错过的计划按策略补跑
+func (s *Scheduler) execute(e *scheduleEntry) {
+	defer s.wg.Done()
+	for {
+		start := time.Now()
+		s.mutex.Lock()
+		e.status.LastRun = start
+		s.mutex.Unlock()
+
+		err := e.run(s.ctx)
+
+		s.mutex.Lock()
+		e.status.Runs++
+		e.status.LastDuration = time.Since(start)
+		e.status.LastError = ""
+		if err != nil {
+			e.status.LastError = err.Error()
+		}
+		if e.catchUp && s.ctx.Err() == nil {
+			e.catchUp = false
+			s.mutex.Unlock()
+			continue
+		}
+		e.catchUp = false
+		e.running = false
+		s.mutex.Unlock()
+		return
+	}
+}
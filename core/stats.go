@@ -0,0 +1,176 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//延迟直方图的桶上限(秒)
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+//直方图的桶: 不大于Le的样本数(累计)
+type HistogramBucket struct {
+	Le    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+//延迟直方图, 超过最大桶上限的样本只计入Count和Sum
+type Histogram struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"` //样本总和(秒)
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{Buckets: make([]HistogramBucket, len(latencyBuckets)), Count: h.count, Sum: h.sum}
+	cumulative := uint64(0)
+	for i, le := range latencyBuckets {
+		cumulative += h.counts[i]
+		s.Buckets[i] = HistogramBucket{Le: le, Count: cumulative}
+	}
+	return s
+}
+
+//调度器的运行统计
+type DispatcherStats struct {
+	QueueDepth    int            `json:"queue_depth"`    //队列中等待分发的任务数
+	QueueDepths   map[string]int `json:"queue_depths"`   //各优先级队列中的任务数
+	Waiting       int            `json:"waiting"`        //等待限流名额的任务数
+	Executors     int            `json:"executors"`      //执行器数量
+	BusyExecutors int            `json:"busy_executors"` //正在执行任务的执行器数量
+	IdleExecutors int            `json:"idle_executors"` //空闲的执行器数量
+	Submitted     uint64         `json:"submitted"`      //提交的任务数
+	Completed     uint64         `json:"completed"`      //执行成功的任务数
+	Failed        uint64         `json:"failed"`         //执行失败的任务数(包含超时)
+	Cancelled     uint64         `json:"cancelled"`      //未执行就被取消的任务数
+	Retried       uint64         `json:"retried"`        //重新排队的次数
+	WaitLatency   Histogram      `json:"wait_latency"`   //从提交到开始执行的等待时间
+	RunLatency    Histogram      `json:"run_latency"`    //每次执行的耗时
+}
+
+//统计计数, 由提交者, 分发协程和执行器并发更新
+type dispatcherStats struct {
+	busy      int64
+	submitted uint64
+	completed uint64
+	failed    uint64
+	cancelled uint64
+	retried   uint64
+
+	mutex       sync.Mutex
+	waitLatency *histogram
+	runLatency  *histogram
+}
+
+func newDispatcherStats() *dispatcherStats {
+	return &dispatcherStats{
+		waitLatency: newHistogram(),
+		runLatency:  newHistogram(),
+	}
+}
+
+//执行器开始执行任务
+func (s *dispatcherStats) begin(task Task, start time.Time) {
+	atomic.AddInt64(&s.busy, 1)
+	if task.submitted.IsZero() {
+		return
+	}
+	s.mutex.Lock()
+	s.waitLatency.observe(start.Sub(task.submitted))
+	s.mutex.Unlock()
+}
+
+//执行器完成一次执行
+func (s *dispatcherStats) end(start time.Time) {
+	atomic.AddInt64(&s.busy, -1)
+	s.mutex.Lock()
+	s.runLatency.observe(time.Since(start))
+	s.mutex.Unlock()
+}
+
+//任务结束(不再重试)
+func (s *dispatcherStats) finish(task Task) {
+	if task.Err != nil {
+		atomic.AddUint64(&s.failed, 1)
+	} else {
+		atomic.AddUint64(&s.completed, 1)
+	}
+}
+
+//调度器的运行统计, 可以在运行中随时调用
+func (dispatcher *Dispatcher) Stats() DispatcherStats {
+	s := dispatcher.stats
+	stats := DispatcherStats{
+		QueueDepth:    dispatcher.taskQueue.len(),
+		QueueDepths:   make(map[string]int),
+		Waiting:       dispatcher.keyLimits.waiting(),
+		BusyExecutors: int(atomic.LoadInt64(&s.busy)),
+		Submitted:     atomic.LoadUint64(&s.submitted),
+		Completed:     atomic.LoadUint64(&s.completed),
+		Failed:        atomic.LoadUint64(&s.failed),
+		Cancelled:     atomic.LoadUint64(&s.cancelled),
+		Retried:       atomic.LoadUint64(&s.retried),
+	}
+	for i, queue := range dispatcher.taskQueue.queues {
+		stats.QueueDepths[(PriorityLow + Priority(i)).String()] = len(queue)
+	}
+	dispatcher.poolMutex.Lock()
+	stats.Executors = dispatcher.maxExecutors
+	dispatcher.poolMutex.Unlock()
+	//减少执行器时, 正在执行任务的执行器可能多于目标数量
+	if stats.IdleExecutors = stats.Executors - stats.BusyExecutors; stats.IdleExecutors < 0 {
+		stats.IdleExecutors = 0
+	}
+	s.mutex.Lock()
+	stats.WaitLatency = s.waitLatency.snapshot()
+	stats.RunLatency = s.runLatency.snapshot()
+	s.mutex.Unlock()
+	return stats
+}
+
+//以JSON格式输出调度器的运行统计, 用于调试接口; POST executors=<n> 调整执行器数量
+func (dispatcher *Dispatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req != nil && req.Method == http.MethodPost {
+		n, err := strconv.Atoi(req.FormValue("executors"))
+		if err == nil {
+			err = dispatcher.Resize(n)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	data, err := json.MarshalIndent(dispatcher.Stats(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(data, '\n'))
+}
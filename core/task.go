@@ -1,5 +1,10 @@
 package core
 
+import (
+	"context"
+	"time"
+)
+
 type TaskType int
 
 //任务类型
@@ -12,12 +17,36 @@ const (
 type Task struct {
 	TaskId     string
 	Type       TaskType
+	Runnable   Runnable //任务执行体, 为空时通过反射调用TargetObj的TargetFunc方法
+	Priority   Priority //优先级, 提交时放入对应的队列
+	Key        string   //限流键(例如设备地址), 相同键的任务共享并发数和速率限制, 为空时不限制
 	TargetObj  *interface{}
 	TargetFunc string
 	StartTime  int64
 	EndTime    int64
+	Timeout    time.Duration //执行超时, 0表示使用调度器的默认值
+	Retry      *RetryPolicy  //重试策略, 为空时使用调度器的默认策略
+	Attempts   int           //已执行的次数
+	Result     Result        //任务的执行结果
+	Err        error         //任务返回的错误, 或者任务被取消、超时的原因
+	ctx        context.Context
+	admitted   bool      //已经占用限流名额
+	submitted  time.Time //提交时间, 用于统计等待时间
+	retire     bool      //通知执行器退出
+	batch      *Batch    //任务所在的组
+}
+
+//创建执行Runnable的任务
+func NewTask(r Runnable) Task {
+	uuid, _ := GenerateUUID()
+	return Task{
+		TaskId:   uuid,
+		Type:     TASK_NORMAL,
+		Runnable: r,
+	}
 }
 
+//创建按方法名反射调用的任务
 func CreateTask(targetObj interface{}, targetFunc string) Task {
 	uuid, _ := GenerateUUID()
 	t := Task{
@@ -39,3 +68,22 @@ func MakeTask(taskType TaskType, targetObj interface{}, targetFunc string) Task
 		TargetFunc: targetFunc,
 	}
 }
+
+//提交任务时传入的上下文
+func (t Task) Context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+//任务的执行体
+func (t Task) runnable() Runnable {
+	if t.Runnable != nil {
+		return t.Runnable
+	}
+	if t.TargetObj == nil {
+		return nil
+	}
+	return methodRunnable{*t.TargetObj, t.TargetFunc}
+}
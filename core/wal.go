@@ -0,0 +1,314 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//可以写入任务日志的执行体: Kind为注册的类型名, 执行体本身以JSON保存;
+//任务日志是明文文件, 执行体应实现json.Marshaler只保存恢复所需的字段, 不保存凭据
+type PersistentRunnable interface {
+	Runnable
+	Kind() string
+}
+
+var (
+	runnableMutex     sync.RWMutex
+	runnableFactories = make(map[string]func() Runnable)
+)
+
+//注册执行体类型, 从任务日志恢复任务时用factory创建执行体再解析JSON; factory应返回指针
+func RegisterRunnable(kind string, factory func() Runnable) {
+	runnableMutex.Lock()
+	defer runnableMutex.Unlock()
+	runnableFactories[kind] = factory
+}
+
+//任务日志的操作
+const (
+	walSubmit = "submit"
+	walStart  = "start"
+	walDone   = "done"
+)
+
+//任务日志记录, 每行一条JSON
+type taskRecord struct {
+	Op       string          `json:"op"`
+	Id       string          `json:"id"`
+	Time     int64           `json:"time"`
+	Kind     string          `json:"kind,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Key      string          `json:"key,omitempty"`
+	Priority Priority        `json:"priority,omitempty"`
+	Timeout  time.Duration   `json:"timeout,omitempty"`
+	Attempts int             `json:"attempts,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+//写入的记录超过该数量并且大部分任务已经完成时压缩日志
+const walCompactRecords = 10000
+
+//任务日志(预写日志): 记录提交, 开始执行和完成的任务, 进程异常退出后重新运行时恢复未完成的任务;
+//只记录执行体实现PersistentRunnable的任务
+type TaskLog struct {
+	mutex     sync.Mutex
+	path      string
+	file      *os.File
+	pending   map[string]*taskRecord //未完成任务的提交记录
+	order     []string               //提交顺序
+	written   int
+	recovered []*taskRecord //打开日志时未完成的任务
+}
+
+//打开任务日志, 读取上次运行未完成的任务并压缩日志
+func OpenTaskLog(path string) (*TaskLog, error) {
+	l := &TaskLog{path: path, pending: make(map[string]*taskRecord)}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	for _, id := range l.order {
+		if r, ok := l.pending[id]; ok {
+			l.recovered = append(l.recovered, r)
+		}
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *TaskLog) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		r := &taskRecord{}
+		//进程退出时没有写完的最后一行
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue
+		}
+		l.apply(r)
+	}
+	return scanner.Err()
+}
+
+//按记录更新未完成的任务
+func (l *TaskLog) apply(r *taskRecord) {
+	switch r.Op {
+	case walSubmit:
+		if _, ok := l.pending[r.Id]; !ok {
+			l.order = append(l.order, r.Id)
+		}
+		l.pending[r.Id] = r
+	case walStart:
+		if p, ok := l.pending[r.Id]; ok {
+			p.Attempts = r.Attempts
+		}
+	case walDone:
+		delete(l.pending, r.Id)
+	}
+}
+
+//只保留未完成任务的提交记录, 重写后继续追加
+func (l *TaskLog) compact() error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	order := []string{}
+	for _, id := range l.order {
+		r, ok := l.pending[id]
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+		order = append(order, id)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, err = os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.order = order
+	l.written = len(order)
+	return nil
+}
+
+//写入一条记录; 每条记录直接写入文件, 进程退出时不会丢失
+func (l *TaskLog) write(r *taskRecord) error {
+	if l.file == nil {
+		return fmt.Errorf("task log %s is closed", l.path)
+	}
+	r.Time = time.Now().Unix()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	l.written++
+	l.apply(r)
+	return nil
+}
+
+//记录提交的任务, 执行体不能持久化或者已经记录过(例如整批提交和恢复的任务)时忽略
+func (l *TaskLog) submit(tasks ...Task) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, task := range tasks {
+		runnable, ok := task.Runnable.(PersistentRunnable)
+		if !ok {
+			continue
+		}
+		if _, ok := l.pending[task.TaskId]; ok {
+			continue
+		}
+		payload, err := json.Marshal(runnable)
+		if err != nil {
+			return err
+		}
+		err = l.write(&taskRecord{
+			Op:       walSubmit,
+			Id:       task.TaskId,
+			Kind:     runnable.Kind(),
+			Payload:  payload,
+			Key:      task.Key,
+			Priority: task.Priority,
+			Timeout:  task.Timeout,
+			Attempts: task.Attempts,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//记录开始执行的任务
+func (l *TaskLog) start(task Task) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.pending[task.TaskId]; !ok {
+		return
+	}
+	if err := l.write(&taskRecord{Op: walStart, Id: task.TaskId, Attempts: task.Attempts}); err != nil {
+		fmt.Printf("写入任务日志失败 : %s \n", err)
+	}
+}
+
+//记录完成的任务(包括重试后仍然失败的任务)
+func (l *TaskLog) done(task Task) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.pending[task.TaskId]; !ok {
+		return
+	}
+	r := &taskRecord{Op: walDone, Id: task.TaskId}
+	if task.Err != nil {
+		r.Error = task.Err.Error()
+	}
+	if err := l.write(r); err != nil {
+		fmt.Printf("写入任务日志失败 : %s \n", err)
+		return
+	}
+	if l.written > walCompactRecords && l.written > 4*len(l.pending) {
+		if err := l.compact(); err != nil {
+			fmt.Printf("压缩任务日志失败 : %s \n", err)
+		}
+	}
+}
+
+//打开日志时上次运行未完成的任务(包括整批提交后还没有排队的任务), 按提交顺序返回; 任务保留原来的TaskId, 重新提交时沿用原来的记录
+func (l *TaskLog) Recovered() ([]Task, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	tasks := []Task{}
+	for _, r := range l.recovered {
+		runnableMutex.RLock()
+		factory, ok := runnableFactories[r.Kind]
+		runnableMutex.RUnlock()
+		if !ok {
+			return tasks, fmt.Errorf("task %s: unknown runnable kind %q", r.Id, r.Kind)
+		}
+		runnable := factory()
+		if err := json.Unmarshal(r.Payload, runnable); err != nil {
+			return tasks, fmt.Errorf("task %s: %s", r.Id, err)
+		}
+		task := NewTask(runnable)
+		task.TaskId = r.Id
+		task.Key = r.Key
+		task.Priority = r.Priority
+		task.Timeout = r.Timeout
+		task.Attempts = r.Attempts
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+//未完成的任务数
+func (l *TaskLog) Pending() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.pending)
+}
+
+//关闭任务日志, 未完成的任务保留到下次打开
+func (l *TaskLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.file.Sync()
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+//设置任务日志, 在Run之前调用; 调度器停止时被取消的任务不记录完成, 下次运行时恢复
+func (dispatcher *Dispatcher) SetTaskLog(l *TaskLog) {
+	dispatcher.taskLog = l
+}
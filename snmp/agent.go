@@ -0,0 +1,696 @@
+package snmp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//响应报文的默认最大长度, 与常见设备的以太网MTU限制一致
+const agentMaxMessageSize = 1472
+
+//故障注入规则: 作用于包含Prefix之下的oid的请求, Prefix为空时作用于全部请求
+type Fault struct {
+	Prefix      Oid
+	PDU         BERType       //只作用于该类型的请求(例如AsnGetBulkRequest模拟不支持GetBulk的设备), 为0时作用于全部请求
+	Drop        float64       //不回复的概率(0-1), 客户端表现为超时
+	Delay       time.Duration //回复前等待的时间
+	ErrorStatus ErrorStatus   //不为NoError时回复该error-status, error-index指向第一个匹配的oid
+}
+
+//计数器增长速度
+type counterRate struct {
+	prefix    Oid
+	perSecond float64
+}
+
+//SNMP代理模拟器: 从snmpwalk格式的文本载入oid树, 在UDP端口上响应v1/v2c的Get, GetNext, GetBulk和Set请求,
+//用SetUsmUser设置USM用户后同时响应v3请求; 用于在没有真实设备时测试和本地开发
+type Agent struct {
+	Community      string //为空时接受任意community
+	MaxMessageSize int    //响应报文的最大长度, 超过时GetBulk截断, 其他请求回复tooBig; 不大于0时为1472
+
+	mutex    sync.Mutex
+	oids     []Oid //按字典序排列
+	values   map[string]interface{}
+	faults   []Fault
+	rates    []counterRate
+	since    time.Time //计数器按速度增长的起始时间
+	requests int
+	usm      *agentUsm //为nil时不响应v3请求
+	conn     *net.UDPConn
+	closed   bool
+}
+
+func NewAgent(community string) *Agent {
+	return &Agent{
+		Community: community,
+		values:    make(map[string]interface{}),
+		since:     time.Now(),
+	}
+}
+
+//载入oid的值, 已经存在的oid被替换
+func (a *Agent) Load(values []SNMPValue) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.settle()
+	for _, v := range values {
+		key := v.Oid.String()
+		if _, ok := a.values[key]; !ok {
+			a.oids = append(a.oids, v.Oid.Copy())
+		}
+		a.values[key] = v.Value
+	}
+	sort.Slice(a.oids, func(i, j int) bool {
+		return a.oids[i].Compare(a.oids[j]) < 0
+	})
+}
+
+//设置一个oid的值
+func (a *Agent) SetValue(oid Oid, value interface{}) {
+	a.Load([]SNMPValue{{oid, value}})
+}
+
+//载入snmpwalk格式的文件, 见ParseWalk
+func (a *Agent) LoadWalkFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	values, err := ParseWalk(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	a.Load(values)
+	return nil
+}
+
+//添加故障注入规则
+func (a *Agent) AddFault(f Fault) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.faults = append(a.faults, f)
+}
+
+//清除全部故障注入规则
+func (a *Agent) ClearFaults() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.faults = nil
+}
+
+//Prefix之下的Counter32/Counter64每秒增加perSecond, 模拟端口流量; 多个规则匹配时使用最长的Prefix
+func (a *Agent) SetCounterRate(prefix Oid, perSecond float64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.settle()
+	for i := range a.rates {
+		if a.rates[i].prefix.Equal(prefix) {
+			a.rates[i].perSecond = perSecond
+			return
+		}
+	}
+	a.rates = append(a.rates, counterRate{prefix.Copy(), perSecond})
+}
+
+//Prefix之下的Counter32/Counter64立即增加delta, Counter32按32位回绕
+func (a *Agent) Increment(prefix Oid, delta uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, oid := range a.oids {
+		if !oid.Within(prefix) {
+			continue
+		}
+		key := oid.String()
+		switch v := a.values[key].(type) {
+		case Counter:
+			a.values[key] = v + Counter(delta)
+		case Counter64:
+			a.values[key] = v + Counter64(delta)
+		}
+	}
+}
+
+//收到的请求数(包括被丢弃的请求)
+func (a *Agent) Requests() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.requests
+}
+
+//计数器的当前值: 载入的值加上按速度增长的部分
+func (a *Agent) grow(oid Oid, value interface{}) interface{} {
+	var rate *counterRate
+	for i := range a.rates {
+		if oid.Within(a.rates[i].prefix) && (rate == nil || len(a.rates[i].prefix) > len(rate.prefix)) {
+			rate = &a.rates[i]
+		}
+	}
+	if rate == nil || rate.perSecond <= 0 {
+		return value
+	}
+	delta := uint64(rate.perSecond * time.Since(a.since).Seconds())
+	switch v := value.(type) {
+	case Counter:
+		return v + Counter(delta)
+	case Counter64:
+		return v + Counter64(delta)
+	}
+	return value
+}
+
+//把已经增长的部分写入计数器, 在修改值或者速度之前调用
+func (a *Agent) settle() {
+	if len(a.rates) > 0 {
+		for _, oid := range a.oids {
+			key := oid.String()
+			a.values[key] = a.grow(oid, a.values[key])
+		}
+	}
+	a.since = time.Now()
+}
+
+//oid的当前值
+func (a *Agent) get(oid Oid) (interface{}, bool) {
+	value, ok := a.values[oid.String()]
+	if !ok {
+		return nil, false
+	}
+	return a.grow(oid, value), true
+}
+
+//字典序在oid之后的第一个oid
+func (a *Agent) next(oid Oid) (Oid, interface{}, bool) {
+	i := sort.Search(len(a.oids), func(i int) bool {
+		return a.oids[i].Compare(oid) > 0
+	})
+	if i >= len(a.oids) {
+		return nil, nil, false
+	}
+	value, _ := a.get(a.oids[i])
+	return a.oids[i], value, true
+}
+
+//监听UDP地址(例如 "127.0.0.1:1161")并阻塞处理请求, Close后返回
+func (a *Agent) Listen(addr string) error {
+	if err := a.bind(addr); err != nil {
+		return err
+	}
+	return a.serve()
+}
+
+//监听UDP地址并在后台处理请求; 端口为0时用Addr取得实际监听的地址
+func (a *Agent) Start(addr string) error {
+	if err := a.bind(addr); err != nil {
+		return err
+	}
+	go a.serve()
+	return nil
+}
+
+//实际监听的地址
+func (a *Agent) Addr() net.Addr {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.conn == nil {
+		return nil
+	}
+	return a.conn.LocalAddr()
+}
+
+func (a *Agent) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.conn == nil || a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.conn.Close()
+}
+
+func (a *Agent) bind(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf(`error listening on ("udp", "%s"): %s`, addr, err)
+	}
+	a.mutex.Lock()
+	a.conn = conn
+	a.mutex.Unlock()
+	return nil
+}
+
+func (a *Agent) serve() error {
+	buf := make([]byte, bufSize)
+	for {
+		n, remote, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			a.mutex.Lock()
+			closed := a.closed
+			a.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		resp, delay := a.handle(buf[:n])
+		if resp == nil {
+			continue
+		}
+		if delay > 0 {
+			time.AfterFunc(delay, func() {
+				a.conn.WriteToUDP(resp, remote)
+			})
+			continue
+		}
+		a.conn.WriteToUDP(resp, remote)
+	}
+}
+
+//处理一个请求报文, 返回响应报文和回复前等待的时间; 报文无法解析, community不匹配或者注入了丢弃时返回nil
+func (a *Agent) handle(packet []byte) ([]byte, time.Duration) {
+	decoded, err := DecodeSequence(packet)
+	if err != nil || len(decoded) < 4 {
+		return nil, 0
+	}
+	version, ok := decoded[1].(int64)
+	if ok && version == int64(SNMPv3) {
+		return a.handleV3(packet)
+	}
+	if !ok || (version != int64(SNMPv1) && version != int64(SNMPv2c)) {
+		return nil, 0
+	}
+	community, _ := decoded[2].(string)
+	if a.Community != "" && community != a.Community {
+		return nil, 0
+	}
+	pdu, ok := decoded[3].([]interface{})
+	if !ok {
+		return nil, 0
+	}
+	return a.reply(version, pdu, communityMessage(version, community))
+}
+
+//把响应PDU封装为v1/v2c报文
+func communityMessage(version int64, community string) func(pdu []interface{}) []byte {
+	return func(pdu []interface{}) []byte {
+		resp, err := EncodeSequence([]interface{}{Sequence, version, community, pdu})
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+}
+
+//处理请求PDU, 返回响应报文和回复前等待的时间; wrap把响应PDU封装为完整的报文, 不回复时返回nil
+func (a *Agent) reply(version int64, pdu []interface{}, wrap func(pdu []interface{}) []byte) ([]byte, time.Duration) {
+	if len(pdu) < 5 {
+		return nil, 0
+	}
+	requestID, _ := pdu[1].(int64)
+	field2, _ := pdu[2].(int64)
+	field3, _ := pdu[3].(int64)
+	request, err := decodeVarbinds(pdu[4])
+	if err != nil {
+		return nil, 0
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.requests++
+
+	//故障注入
+	var delay time.Duration
+	for _, f := range a.faults {
+		index := matchFault(f, pdu[0], request)
+		if index == 0 {
+			continue
+		}
+		if f.Drop > 0 && rand.Float64() < f.Drop {
+			return nil, 0
+		}
+		if f.Delay > delay {
+			delay = f.Delay
+		}
+		if f.ErrorStatus != NoError {
+			return a.response(wrap, requestID, f.ErrorStatus, index, echoVarbinds(request), false), delay
+		}
+	}
+
+	var (
+		status   ErrorStatus
+		index    int
+		varbinds []interface{}
+		truncate bool
+	)
+	switch pdu[0] {
+	case AsnGetRequest:
+		status, index, varbinds = a.doGet(version, request)
+	case AsnGetNextRequest:
+		status, index, varbinds = a.doGetNext(version, request)
+	case AsnGetBulkRequest:
+		if version == int64(SNMPv1) {
+			return nil, 0
+		}
+		varbinds = a.doGetBulk(request, int(field2), int(field3))
+		truncate = true
+	case AsnSetRequest:
+		status, index, varbinds = a.doSet(version, request)
+	default:
+		return nil, 0
+	}
+	if status != NoError {
+		varbinds = echoVarbinds(request)
+	}
+	return a.response(wrap, requestID, status, index, varbinds, truncate), delay
+}
+
+//请求中第一个匹配规则的oid的序号(从1开始), 不匹配时返回0
+func matchFault(f Fault, pduType interface{}, request []SNMPValue) int {
+	if t, ok := pduType.(BERType); f.PDU != 0 && (!ok || t != f.PDU) {
+		return 0
+	}
+	for i, v := range request {
+		if v.Oid.Within(f.Prefix) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+//出错时响应原样返回请求的varbind
+func echoVarbinds(request []SNMPValue) []interface{} {
+	varbinds := make([]interface{}, 0, len(request))
+	for _, v := range request {
+		varbinds = append(varbinds, []interface{}{Sequence, v.Oid, v.Value})
+	}
+	return varbinds
+}
+
+func (a *Agent) doGet(version int64, request []SNMPValue) (ErrorStatus, int, []interface{}) {
+	varbinds := make([]interface{}, 0, len(request))
+	for i, v := range request {
+		value, ok := a.get(v.Oid)
+		if !ok {
+			if version == int64(SNMPv1) {
+				return NoSuchName, i + 1, nil
+			}
+			value = a.exception(v.Oid)
+		}
+		varbinds = append(varbinds, []interface{}{Sequence, v.Oid, value})
+	}
+	return NoError, 0, varbinds
+}
+
+//不存在的oid的异常值: 同一个对象下有其他实例时为noSuchInstance, 否则为noSuchObject
+func (a *Agent) exception(oid Oid) BERType {
+	if len(oid) > 1 {
+		object := oid[:len(oid)-1]
+		i := sort.Search(len(a.oids), func(i int) bool {
+			return a.oids[i].Compare(object) >= 0
+		})
+		if i < len(a.oids) && a.oids[i].Within(object) {
+			return NoSuchInstance
+		}
+	}
+	return NoSuchObject
+}
+
+func (a *Agent) doGetNext(version int64, request []SNMPValue) (ErrorStatus, int, []interface{}) {
+	varbinds := make([]interface{}, 0, len(request))
+	for i, v := range request {
+		oid, value, ok := a.next(v.Oid)
+		if !ok {
+			if version == int64(SNMPv1) {
+				return NoSuchName, i + 1, nil
+			}
+			oid, value = v.Oid, EndOfMibView
+		}
+		varbinds = append(varbinds, []interface{}{Sequence, oid, value})
+	}
+	return NoError, 0, varbinds
+}
+
+//前nonRepeaters个oid取下一个值, 其余的oid各取maxRepetitions个值, 按 重复次数 x oid 的顺序交错排列
+func (a *Agent) doGetBulk(request []SNMPValue, nonRepeaters, maxRepetitions int) []interface{} {
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(request) {
+		nonRepeaters = len(request)
+	}
+	_, _, varbinds := a.doGetNext(int64(SNMPv2c), request[:nonRepeaters])
+
+	repeaters := request[nonRepeaters:]
+	last := make([]Oid, len(repeaters))
+	for i, v := range repeaters {
+		last[i] = v.Oid
+	}
+	for r := 0; r < maxRepetitions && len(last) > 0; r++ {
+		ended := 0
+		for i := range last {
+			oid, value, ok := a.next(last[i])
+			if !ok {
+				oid, value = last[i], EndOfMibView
+				ended++
+			}
+			varbinds = append(varbinds, []interface{}{Sequence, oid, value})
+			last[i] = oid
+		}
+		//全部遍历到结尾时不再重复
+		if ended == len(last) {
+			break
+		}
+	}
+	return varbinds
+}
+
+//全部oid都存在并且类型一致时才写入
+func (a *Agent) doSet(version int64, request []SNMPValue) (ErrorStatus, int, []interface{}) {
+	for i, v := range request {
+		value, ok := a.values[v.Oid.String()]
+		if !ok {
+			if version == int64(SNMPv1) {
+				return NoSuchName, i + 1, nil
+			}
+			return NoCreation, i + 1, nil
+		}
+		if fmt.Sprintf("%T", value) != fmt.Sprintf("%T", v.Value) {
+			if version == int64(SNMPv1) {
+				return BadValue, i + 1, nil
+			}
+			return WrongType, i + 1, nil
+		}
+	}
+	a.settle()
+	for _, v := range request {
+		a.values[v.Oid.String()] = v.Value
+	}
+	return NoError, 0, echoVarbinds(request)
+}
+
+//编码响应报文; 超过最大长度时GetBulk从末尾截断varbind, 其他请求回复tooBig
+func (a *Agent) response(wrap func(pdu []interface{}) []byte, requestID int64, status ErrorStatus, index int, varbinds []interface{}, truncate bool) []byte {
+	maxSize := a.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = agentMaxMessageSize
+	}
+	encode := func(status ErrorStatus, index int, varbinds []interface{}) []byte {
+		return wrap([]interface{}{AsnGetResponse, requestID, int(status), index, append([]interface{}{Sequence}, varbinds...)})
+	}
+
+	resp := encode(status, index, varbinds)
+	for resp != nil && len(resp) > maxSize {
+		if !truncate || len(varbinds) == 0 {
+			return encode(TooBig, 0, nil)
+		}
+		//按比例估算能放下的varbind数量
+		n := len(varbinds) * maxSize / len(resp)
+		if n >= len(varbinds) {
+			n = len(varbinds) - 1
+		}
+		varbinds = varbinds[:n]
+		resp = encode(status, index, varbinds)
+	}
+	return resp
+}
+
+//解析snmpwalk的输出(需要数字形式的oid, 即 snmpwalk -On), 每行的格式为:
+//
+//	.1.3.6.1.2.1.1.5.0 = STRING: "switch-1"
+//	.1.3.6.1.2.1.2.2.1.10.1 = Counter32: 1234
+//
+//Hex-STRING可以跨多行(net-snmp每16个字节换行), 续行只包含十六进制字节;
+//支持STRING, Hex-STRING, INTEGER, Counter32, Counter64, Gauge32, Unsigned32, Timeticks, OID, IpAddress;
+//其他类型按字符串处理, "No Such Object" 等没有值的行被忽略
+func ParseWalk(r io.Reader) ([]SNMPValue, error) {
+	values := []SNMPValue{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	lineNo := 0
+	open := false    //多行字符串尚未结束
+	hexOpen := false //上一个值为Hex-STRING, net-snmp每16个字节换行
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if open {
+			last := &values[len(values)-1]
+			text, closed := unquoteWalkString(line)
+			last.Value = last.Value.(string) + "\n" + text
+			open = !closed
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sep := strings.Index(line, " = ")
+		if sep < 0 && hexOpen {
+			b, err := decodeHexFields(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid Hex-STRING continuation %q", lineNo, line)
+			}
+			last := &values[len(values)-1]
+			last.Value = last.Value.(string) + string(b)
+			continue
+		}
+		hexOpen = false
+		if sep < 0 {
+			return nil, fmt.Errorf("line %d: expected \"<oid> = <type>: <value>\"", lineNo)
+		}
+		oid, err := ParseOid(strings.TrimSpace(line[:sep]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %q is not a numeric oid, use snmpwalk -On", lineNo, line[:sep])
+		}
+		value, skip, closed, err := parseWalkValue(strings.TrimSpace(line[sep+3:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		if skip {
+			continue
+		}
+		values = append(values, SNMPValue{oid, value})
+		open = !closed
+		hexOpen = strings.HasPrefix(strings.TrimSpace(line[sep+3:]), "Hex-STRING:")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+//解析以空白分隔的十六进制字节, 例如 "00 1A 2B"
+func decodeHexFields(text string) ([]byte, error) {
+	return hex.DecodeString(strings.Join(strings.Fields(text), ""))
+}
+
+//解析 "<type>: <value>", 返回值, 是否忽略该行, 字符串是否在本行结束
+func parseWalkValue(text string) (interface{}, bool, bool, error) {
+	if text == `""` {
+		return "", false, true, nil
+	}
+	if text == "NULL" {
+		return nil, false, true, nil
+	}
+	sep := strings.Index(text, ":")
+	if sep < 0 {
+		//No Such Object available on this agent at this OID 等
+		return nil, true, true, nil
+	}
+	kind := text[:sep]
+	raw := strings.TrimSpace(text[sep+1:])
+	field := raw
+	if i := strings.IndexAny(raw, " \t"); i >= 0 {
+		field = raw[:i]
+	}
+
+	switch kind {
+	case "STRING":
+		if !strings.HasPrefix(raw, `"`) {
+			return raw, false, true, nil
+		}
+		s, closed := unquoteWalkString(raw[1:])
+		return s, false, closed, nil
+	case "Hex-STRING":
+		b, err := decodeHexFields(raw)
+		if err != nil {
+			return nil, false, true, fmt.Errorf("invalid Hex-STRING %q", raw)
+		}
+		return string(b), false, true, nil
+	case "INTEGER":
+		//枚举值, 例如 up(1)
+		if i, j := strings.Index(raw, "("), strings.Index(raw, ")"); i >= 0 && j > i {
+			field = raw[i+1 : j]
+		}
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, false, true, fmt.Errorf("invalid INTEGER %q", raw)
+		}
+		return v, false, true, nil
+	case "Counter32", "Gauge32", "Unsigned32", "Counter64":
+		v, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, false, true, fmt.Errorf("invalid %s %q", kind, raw)
+		}
+		switch kind {
+		case "Counter32":
+			return Counter(v), false, true, nil
+		case "Counter64":
+			return Counter64(v), false, true, nil
+		}
+		return Gauge(v), false, true, nil
+	case "Timeticks":
+		//Timeticks: (12345) 0:02:03.45
+		if i, j := strings.Index(raw, "("), strings.Index(raw, ")"); i >= 0 && j > i {
+			field = raw[i+1 : j]
+		}
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, false, true, fmt.Errorf("invalid Timeticks %q", raw)
+		}
+		return time.Duration(v) * 10 * time.Millisecond, false, true, nil
+	case "OID":
+		oid, err := ParseOid(field)
+		if err != nil {
+			return nil, false, true, fmt.Errorf("%q is not a numeric oid, use snmpwalk -On", raw)
+		}
+		return oid, false, true, nil
+	case "IpAddress":
+		ip := net.ParseIP(field).To4()
+		if ip == nil {
+			return nil, false, true, fmt.Errorf("invalid IpAddress %q", raw)
+		}
+		return ip, false, true, nil
+	}
+	return raw, false, true, nil
+}
+
+//去掉字符串结尾的引号并还原转义, 返回字符串是否在本行结束
+func unquoteWalkString(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case s[i] == '"':
+			return b.String(), true
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), false
+}
@@ -0,0 +1,354 @@
+package snmp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	ifHCInOctets  = MustParseOid("1.3.6.1.2.1.31.1.1.1.6")
+	ifHCOutOctets = MustParseOid("1.3.6.1.2.1.31.1.1.1.10")
+	sysName       = MustParseOid("1.3.6.1.2.1.1.5.0")
+)
+
+//ifHCInOctets/ifHCOutOctets各rows行, 出站表位于MIB末尾
+func tableValues(rows int) []SNMPValue {
+	values := []SNMPValue{{Oid: sysName, Value: "switch"}}
+	for i := 1; i <= rows; i++ {
+		values = append(values,
+			SNMPValue{Oid: append(ifHCInOctets.Copy(), i), Value: Counter64(1000 + i)},
+			SNMPValue{Oid: append(ifHCOutOctets.Copy(), i), Value: Counter64(2000 + i)})
+	}
+	return values
+}
+
+func startAgent(t *testing.T, values []SNMPValue) *Agent {
+	return startAgentWithLimit(t, values, 0)
+}
+
+//maxMessageSize为响应报文的最大长度, 0为默认值
+func startAgentWithLimit(t *testing.T, values []SNMPValue, maxMessageSize int) *Agent {
+	a := NewAgent("public")
+	a.MaxMessageSize = maxMessageSize
+	a.Load(values)
+	if err := a.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func newClient(t *testing.T, a *Agent, version SNMPVersion, timeout time.Duration) *WapSNMP {
+	w, err := NewWapSNMP(a.Addr().String(), "public", version, timeout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func checkTable(t *testing.T, table map[string]interface{}, root Oid, rows int, base uint64) {
+	t.Helper()
+	if len(table) != rows {
+		t.Fatalf("%s: %d rows, want %d", root.String(), len(table), rows)
+	}
+	for i := 1; i <= rows; i++ {
+		oid := append(root.Copy(), i).String()
+		if v, ok := table[oid].(Counter64); !ok || uint64(v) != base+uint64(i) {
+			t.Fatalf("%s = %v, want %d", oid, table[oid], base+uint64(i))
+		}
+	}
+}
+
+func TestGetTable(t *testing.T) {
+	a := startAgent(t, tableValues(120))
+	for _, version := range []SNMPVersion{SNMPv1, SNMPv2c} {
+		w := newClient(t, a, version, time.Second)
+		in, err := w.GetTable(ifHCInOctets)
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		checkTable(t, in, ifHCInOctets, 120, 1000)
+		//遍历到MIB末尾
+		out, err := w.GetTable(ifHCOutOctets)
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		checkTable(t, out, ifHCOutOctets, 120, 2000)
+	}
+}
+
+func TestGetTables(t *testing.T) {
+	a := startAgent(t, tableValues(120))
+	for _, version := range []SNMPVersion{SNMPv1, SNMPv2c} {
+		w := newClient(t, a, version, time.Second)
+		tables, err := w.GetTables([]Oid{ifHCInOctets, ifHCOutOctets, ifHCInOctets})
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		if len(tables) != 2 {
+			t.Fatalf("version %d: %d tables, want 2", version, len(tables))
+		}
+		checkTable(t, tables[ifHCInOctets.String()], ifHCInOctets, 120, 1000)
+		checkTable(t, tables[ifHCOutOctets.String()], ifHCOutOctets, 120, 2000)
+	}
+}
+
+//设备拒绝或者丢弃GetBulk时改用GetNext
+func TestGetTablesFallback(t *testing.T) {
+	faults := map[string]Fault{
+		"genErr": {PDU: AsnGetBulkRequest, ErrorStatus: GenErr},
+		"drop":   {PDU: AsnGetBulkRequest, Drop: 1},
+	}
+	for name, f := range faults {
+		a := startAgent(t, tableValues(30))
+		a.AddFault(f)
+		w := newClient(t, a, SNMPv2c, 200*time.Millisecond)
+		in, err := w.GetTable(ifHCInOctets)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		checkTable(t, in, ifHCInOctets, 30, 1000)
+		tables, err := w.GetTables([]Oid{ifHCInOctets, ifHCOutOctets})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		checkTable(t, tables[ifHCInOctets.String()], ifHCInOctets, 30, 1000)
+		checkTable(t, tables[ifHCOutOctets.String()], ifHCOutOctets, 30, 2000)
+	}
+}
+
+//设备按报文长度限制截断GetBulk响应, 以及响应超过客户端接收缓冲区
+func TestGetTableTruncation(t *testing.T) {
+	a := startAgentWithLimit(t, tableValues(200), 600)
+	w := newClient(t, a, SNMPv2c, time.Second)
+	in, err := w.GetTable(ifHCInOctets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTable(t, in, ifHCInOctets, 200, 1000)
+
+	a = startAgent(t, tableValues(200))
+	w = newClient(t, a, SNMPv2c, time.Second)
+	w.SetBufferSize(512)
+	tables, err := w.GetTables([]Oid{ifHCInOctets, ifHCOutOctets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTable(t, tables[ifHCInOctets.String()], ifHCInOctets, 200, 1000)
+	checkTable(t, tables[ifHCOutOctets.String()], ifHCOutOctets, 200, 2000)
+}
+
+//tooBig时减半重复次数, 不改用GetNext
+func TestGetTableTooBig(t *testing.T) {
+	a := startAgent(t, tableValues(10))
+	a.AddFault(Fault{PDU: AsnGetBulkRequest, ErrorStatus: TooBig})
+	w := newClient(t, a, SNMPv2c, time.Second)
+	if _, err := w.GetTable(ifHCInOctets); err == nil {
+		t.Fatal("expected an error")
+	}
+	//50, 25, 12, 6, 3, 1
+	if n := a.Requests(); n != 6 {
+		t.Fatalf("%d requests, want 6", n)
+	}
+
+	a = startAgentWithLimit(t, tableValues(10), 100)
+	w = newClient(t, a, SNMPv2c, time.Second)
+	oids := []Oid{}
+	for i := 1; i <= 10; i++ {
+		oids = append(oids, append(ifHCInOctets.Copy(), i))
+	}
+	_, err := w.GetMultiple(oids)
+	if e, ok := err.(*ResponseError); !ok || e.Status != TooBig {
+		t.Fatalf("GetMultiple error = %v, want tooBig", err)
+	}
+}
+
+func TestBulkSizer(t *testing.T) {
+	b := &bulkSizer{reps: 50}
+	b.adjust(50, 20, 1400, bufSize)
+	if b.reps != 20 || b.limit != 20 {
+		t.Fatalf("after truncation: %+v", *b)
+	}
+	b.adjust(20, 20, 100, bufSize)
+	if b.reps != 20 {
+		t.Fatalf("grew past the limit: %+v", *b)
+	}
+	b = &bulkSizer{reps: 50}
+	if !b.shrink() || b.reps != 25 || b.limit != 49 {
+		t.Fatalf("after shrink: %+v", *b)
+	}
+	b.adjust(25, 25, 100, bufSize)
+	if b.reps != 49 {
+		t.Fatalf("after growth: %+v", *b)
+	}
+	b.adjust(49, 49, bufSize/2, bufSize)
+	if b.reps != 49 {
+		t.Fatalf("grew with a large response: %+v", *b)
+	}
+	b = &bulkSizer{reps: 1}
+	if b.shrink() {
+		t.Fatal("shrank below 1")
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	a := startAgent(t, tableValues(1))
+	a.AddFault(Fault{Prefix: sysName, Drop: 1})
+	w, err := NewWapSNMP(a.Addr().String(), "public", SNMPv2c, 50*time.Millisecond, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, err = w.Get(sysName)
+	e, ok := err.(*RequestError)
+	if !ok || !e.Timeout() || e.Attempts != 2 {
+		t.Fatalf("error = %#v, want a timeout after 2 attempts", err)
+	}
+}
+
+//上一个请求超时后才到达的响应不能作为下一个请求的结果
+func TestGetIgnoresStaleResponse(t *testing.T) {
+	a := startAgent(t, tableValues(1))
+	first := append(ifHCInOctets.Copy(), 1)
+	second := append(ifHCOutOctets.Copy(), 1)
+	a.AddFault(Fault{Prefix: first, Delay: 300 * time.Millisecond})
+	a.AddFault(Fault{Prefix: second, Delay: 150 * time.Millisecond})
+	w := newClient(t, a, SNMPv2c, 250*time.Millisecond)
+	if _, err := w.Get(first); err == nil {
+		t.Fatal("expected a timeout")
+	}
+	value, err := w.Get(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != Counter64(2001) {
+		t.Fatalf("value = %v, want 2001", value)
+	}
+}
+
+//先回复一个请求ID不一致的报文再回复正确的响应; oversized为true时不一致的报文超过客户端的接收缓冲区
+func startMismatchServer(t *testing.T, a *Agent, oversized bool) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, bufSize)
+		for {
+			n, remote, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			decoded, err := DecodeSequence(buf[:n])
+			if err != nil {
+				continue
+			}
+			pdu := decoded[3].([]interface{})
+			requestID := pdu[1].(int64)
+			varbinds := []interface{}{}
+			count := 1
+			if oversized {
+				count = 40
+			}
+			for i := 0; i < count; i++ {
+				varbinds = append(varbinds, []interface{}{Sequence, sysName, "wrong"})
+			}
+			conn.WriteToUDP(a.response(communityMessage(decoded[1].(int64), "public"), requestID+1, NoError, 0, varbinds, false), remote)
+			if resp, _ := a.handle(buf[:n]); resp != nil {
+				conn.WriteToUDP(resp, remote)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestGetIgnoresMismatchedRequestID(t *testing.T) {
+	a := NewAgent("public")
+	a.Load(tableValues(1))
+	for _, oversized := range []bool{false, true} {
+		w, err := NewWapSNMP(startMismatchServer(t, a, oversized), "public", SNMPv2c, time.Second, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.SetBufferSize(512)
+		value, err := w.Get(sysName)
+		w.Close()
+		if err != nil {
+			t.Fatalf("oversized %v: %s", oversized, err)
+		}
+		if value != "switch" {
+			t.Fatalf("oversized %v: value = %v, want switch", oversized, value)
+		}
+	}
+}
+
+//snmpwalk -On 的输出, Hex-STRING超过16个字节时换行
+const walkFixture = `.1.3.6.1.2.1.1.5.0 = STRING: "switch-1"
+.1.3.6.1.2.1.1.1.0 = STRING: "line one
+line two"
+.1.3.6.1.2.1.1.3.0 = Timeticks: (12345) 0:02:03.45
+.1.3.6.1.2.1.2.2.1.6.1 = Hex-STRING: 00 1A 2B 3C 4D 5E 
+.1.3.6.1.2.1.2.2.1.6.2 = Hex-STRING: 00 01 02 03 04 05 06 07 08 09 0A 0B 0C 0D 0E 0F 
+10 11 12 13 14 15 16 17 18 19 1A 1B 1C 1D 1E 1F 
+20 21 
+.1.3.6.1.2.1.2.2.1.8.1 = INTEGER: up(1)
+.1.3.6.1.2.1.31.1.1.1.6.1 = Counter64: 1234567890123
+.1.3.6.1.2.1.4.20.1.1.10.0.0.1 = IpAddress: 10.0.0.1
+.1.3.6.1.2.1.1.9.1.2.1 = OID: .1.3.6.1.6.3.1
+.1.3.6.1.2.1.1.7.0 = No Such Object available on this agent at this OID
+`
+
+func TestParseWalk(t *testing.T) {
+	values, err := ParseWalk(strings.NewReader(walkFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := make([]byte, 34)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	want := []SNMPValue{
+		{MustParseOid("1.3.6.1.2.1.1.5.0"), "switch-1"},
+		{MustParseOid("1.3.6.1.2.1.1.1.0"), "line one\nline two"},
+		{MustParseOid("1.3.6.1.2.1.1.3.0"), 12345 * 10 * time.Millisecond},
+		{MustParseOid("1.3.6.1.2.1.2.2.1.6.1"), "\x00\x1a\x2b\x3c\x4d\x5e"},
+		{MustParseOid("1.3.6.1.2.1.2.2.1.6.2"), string(long)},
+		{MustParseOid("1.3.6.1.2.1.2.2.1.8.1"), int64(1)},
+		{MustParseOid("1.3.6.1.2.1.31.1.1.1.6.1"), Counter64(1234567890123)},
+		{MustParseOid("1.3.6.1.2.1.4.20.1.1.10.0.0.1"), net.IPv4(10, 0, 0, 1).To4()},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.2.1"), MustParseOid("1.3.6.1.6.3.1")},
+	}
+	if len(values) != len(want) {
+		t.Fatalf("%d values, want %d: %v", len(values), len(want), values)
+	}
+	for i, w := range want {
+		got := values[i]
+		if got.Oid.String() != w.Oid.String() {
+			t.Fatalf("value %d: oid %s, want %s", i, got.Oid.String(), w.Oid.String())
+		}
+		if fmt.Sprintf("%#v", got.Value) != fmt.Sprintf("%#v", w.Value) {
+			t.Errorf("%s = %#v, want %#v", w.Oid.String(), got.Value, w.Value)
+		}
+	}
+}
+
+func TestParseWalkErrors(t *testing.T) {
+	for _, text := range []string{
+		"SNMPv2-MIB::sysName.0 = STRING: switch",
+		".1.3.6.1.2.1.1.5.0 STRING: switch",
+		".1.3.6.1.2.1.2.2.1.6.1 = Hex-STRING: 00 1G",
+		".1.3.6.1.2.1.2.2.1.6.1 = Hex-STRING: 00 01\nnot hex",
+		".1.3.6.1.2.1.2.2.1.5.1 = Gauge32: fast",
+		//续行只能跟在Hex-STRING之后
+		".1.3.6.1.2.1.1.5.0 = STRING: switch\n00 01",
+	} {
+		if _, err := ParseWalk(strings.NewReader(text)); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package snmp
+
+import (
+	"bytes"
+	"math/rand"
+	"time"
+)
+
+//时间窗口(RFC 3414 3.2.7): 请求的engineTime与本地相差超过150秒时回复notInTimeWindow
+const usmTimeWindow = 150
+
+//模拟器的权威引擎与USM用户; 创建后不再修改, 重启引擎时替换为新的实例
+type agentUsm struct {
+	params   UsmParams
+	engineID string
+	boots    int64
+	start    time.Time //snmpEngineTime从该时间开始计算
+	keys     *usmKeys
+	reports  map[string]Counter //各usmStats计数器的值, 由Agent.mutex保护
+}
+
+func (u *agentUsm) engineTime() int64 {
+	return int64(time.Since(u.start) / time.Second)
+}
+
+//启用v3: 以engineID作为权威引擎, 接受params描述的USM用户; engineID为空时使用默认值
+func (a *Agent) SetUsmUser(params *UsmParams, engineID string) error {
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	if engineID == "" {
+		//RFC 3411格式: 企业号与文本
+		engineID = "\x80\x00\x1f\x88\x04yoman-agent"
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.usm = &agentUsm{
+		params:   *params,
+		engineID: engineID,
+		boots:    1,
+		start:    time.Now(),
+		keys:     newUsmKeys(params, engineID),
+		reports:  make(map[string]Counter),
+	}
+	return nil
+}
+
+//模拟设备重启: snmpEngineBoots加1, snmpEngineTime从0开始, 客户端缓存的引擎时间随之失效
+func (a *Agent) RestartEngine() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.usm == nil {
+		return
+	}
+	restarted := *a.usm
+	restarted.boots++
+	restarted.start = time.Now()
+	a.usm = &restarted
+}
+
+//处理v3请求: 引擎发现, 认证, 时间窗口检查与解密(RFC 3414 3.2), 失败时回复对应的usmStats Report
+func (a *Agent) handleV3(packet []byte) ([]byte, time.Duration) {
+	msg, err := parseV3Message(append([]byte{}, packet...))
+	if err != nil {
+		return nil, 0
+	}
+	a.mutex.Lock()
+	u := a.usm
+	a.mutex.Unlock()
+	if u == nil {
+		return nil, 0
+	}
+	boots, engineTime := u.boots, u.engineTime()
+
+	level := NoAuthNoPriv
+	switch msg.flags & (flagAuth | flagPriv) {
+	case flagAuth:
+		level = AuthNoPriv
+	case flagAuth | flagPriv:
+		level = AuthPriv
+	case flagPriv:
+		return nil, 0
+	}
+
+	//engineID为空的请求用于发现权威引擎
+	if msg.engineID != u.engineID {
+		return a.report(u, msg, NoAuthNoPriv, usmStatsUnknownEngineIDs), 0
+	}
+	if msg.userName != u.params.UserName {
+		return a.report(u, msg, NoAuthNoPriv, usmStatsUnknownUserNames), 0
+	}
+	if level > u.params.Level() {
+		return a.report(u, msg, NoAuthNoPriv, usmStatsUnsupportedSecLevels), 0
+	}
+
+	if level >= AuthNoPriv {
+		start, end, err := authParamsOffset(msg.raw)
+		if err != nil {
+			return nil, 0
+		}
+		received := append([]byte{}, msg.raw[start:end]...)
+		copy(msg.raw[start:end], make([]byte, end-start))
+		if !bytes.Equal(received, u.keys.authenticate(u.params.AuthProtocol, msg.raw)) {
+			return a.report(u, msg, NoAuthNoPriv, usmStatsWrongDigests), 0
+		}
+		//已认证的notInTimeWindow Report携带当前的boots与time, 客户端据此重新同步
+		if msg.boots != boots || msg.time < engineTime-usmTimeWindow || msg.time > engineTime+usmTimeWindow {
+			return a.report(u, msg, AuthNoPriv, usmStatsNotInTimeWindows), 0
+		}
+	}
+
+	var scoped []interface{}
+	if level == AuthPriv {
+		encrypted, _ := msg.data.(string)
+		plain, err := u.keys.decrypt(u.params.PrivProtocol, []byte(encrypted), []byte(msg.privParams), msg.boots, msg.time)
+		if err == nil {
+			scoped, err = decodeScopedPDU(plain)
+		}
+		if err != nil {
+			return a.report(u, msg, NoAuthNoPriv, usmStatsDecryptionErrors), 0
+		}
+	} else if scoped, err = msg.scopedPDU(); err != nil {
+		return nil, 0
+	}
+	if len(scoped) < 4 {
+		return nil, 0
+	}
+	pdu, ok := scoped[3].([]interface{})
+	if !ok {
+		return nil, 0
+	}
+	//v3使用v2c的PDU语义
+	return a.reply(int64(SNMPv2c), pdu, func(pdu []interface{}) []byte {
+		return u.encode(msg, level, boots, engineTime, pdu)
+	})
+}
+
+//回复Report PDU, 请求没有设置reportable标志时不回复
+func (a *Agent) report(u *agentUsm, msg *v3Message, level SecurityLevel, oid Oid) []byte {
+	a.mutex.Lock()
+	a.requests++
+	u.reports[oid.String()]++
+	count := u.reports[oid.String()]
+	a.mutex.Unlock()
+	if msg.flags&flagReportable == 0 {
+		return nil
+	}
+
+	//明文的请求可以取得request-id, 否则为0
+	var requestID int64
+	if scoped, err := msg.scopedPDU(); err == nil && len(scoped) >= 4 {
+		if pdu, ok := scoped[3].([]interface{}); ok && len(pdu) > 1 {
+			requestID, _ = pdu[1].(int64)
+		}
+	}
+	pdu := []interface{}{AsnReport, requestID, 0, 0, []interface{}{Sequence, []interface{}{Sequence, oid, count}}}
+	return u.encode(msg, level, u.boots, u.engineTime(), pdu)
+}
+
+//编码对msg的回复, msgID与用户名与请求一致, 认证参数在编码完成后回填
+func (u *agentUsm) encode(msg *v3Message, level SecurityLevel, boots, engineTime int64, pdu []interface{}) []byte {
+	var flags byte
+	if level >= AuthNoPriv {
+		flags |= flagAuth
+	}
+	if level == AuthPriv {
+		flags |= flagPriv
+	}
+	scopedPDU := []interface{}{Sequence, u.engineID, u.params.ContextName, pdu}
+
+	var data interface{} = scopedPDU
+	privParams := ""
+	if level == AuthPriv {
+		plain, err := EncodeSequence(scopedPDU)
+		if err != nil {
+			return nil
+		}
+		encrypted, salt, err := u.keys.encrypt(u.params.PrivProtocol, plain, boots, engineTime, uint64(rand.Int63()))
+		if err != nil {
+			return nil
+		}
+		data = string(encrypted)
+		privParams = string(salt)
+	}
+
+	authParams := ""
+	if level >= AuthNoPriv {
+		authParams = string(make([]byte, u.params.AuthProtocol.paramLen()))
+	}
+
+	resp, err := EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, msg.msgID, msgMaxSize, string([]byte{flags}), usmSecurityModel},
+		string(encodeSecParams(u.engineID, boots, engineTime, msg.userName, authParams, privParams)),
+		data})
+	if err != nil {
+		return nil
+	}
+	if level >= AuthNoPriv {
+		start, end, err := authParamsOffset(resp)
+		if err != nil {
+			return nil
+		}
+		copy(resp[start:end], u.keys.authenticate(u.params.AuthProtocol, resp))
+	}
+	return resp
+}
@@ -83,9 +83,14 @@ const (
 	AsnGetNextRequest BERType = 0xa1
 	AsnGetResponse    BERType = 0xa2
 	AsnSetRequest     BERType = 0xa3
+	AsnTrapV1         BERType = 0xa4
 	AsnGetBulkRequest BERType = 0xa5
+	AsnInform         BERType = 0xa6
 	AsnTrapV2         BERType = 0xa7
+	AsnReport         BERType = 0xa8
 
+	// Exception values of a varbind in an SNMPv2 response (RFC 3416).
+	NoSuchObject   BERType = 0x80
 	NoSuchInstance BERType = 0x81
 	EndOfMibView   BERType = 0x82
 )
@@ -100,6 +105,7 @@ type UnsupportedBerType []byte
 const (
 	SNMPv1  SNMPVersion = 0
 	SNMPv2c SNMPVersion = 1
+	SNMPv3  SNMPVersion = 3
 )
 
 // EncodeLength encodes an integer value as a BER compliant length value.
@@ -136,6 +142,9 @@ func EncodeLength(length uint64) []byte {
 func DecodeLength(toparse []byte) (uint64, int, error) {
 	// If the first bit is zero, the rest of the first byte indicates the length. Values up to 127 are encoded this way (unless you're using indefinite length, but we don't support that)
 
+	if len(toparse) == 0 {
+		return 0, 0, fmt.Errorf("missing length")
+	}
 	if toparse[0] == 0x80 {
 		return 0, 0, fmt.Errorf("we don't support indefinite length encoding")
 	}
@@ -180,6 +189,10 @@ func DecodeInteger(toparse []byte) (int64, error) {
 //
 // Will error out if it's longer than 64 bits.
 func DecodeUInt(toparse []byte) (uint64, error) {
+	// A leading zero byte keeps the high bit of a 64 bit value positive.
+	if len(toparse) == 9 && toparse[0] == 0 {
+		toparse = toparse[1:]
+	}
 	if len(toparse) > 8 {
 		return 0, fmt.Errorf("don't support more than 64 bits")
 	}
@@ -208,6 +221,13 @@ func EncodeInteger(toEncode int64) []byte {
 		}
 	}
 
+	// Positive values need a leading zero byte when the high bit is set,
+	// otherwise they are decoded as negative numbers (msgMaxSize, engine
+	// boots/time and request IDs all hit this).
+	if toEncode > 0 && (toEncode>>uint(8*(l-1)))&0x80 != 0 {
+		l++
+	}
+
 	// Now create a byte array of the correct length and copy the value into it.
 	result := make([]byte, l)
 	for i := int64(0); i < l; i++ {
@@ -230,6 +250,12 @@ func EncodeUInt(toEncode uint64) []byte {
 		l++
 	}
 
+	// Add a leading zero byte when the high bit is set, other agents decode
+	// the value as a signed integer.
+	if (toEncode>>uint(8*(l-1)))&0x80 != 0 {
+		l++
+	}
+
 	// Now create a byte array of the correct length and copy the value into it.
 	result := make([]byte, l)
 	for i := int64(0); i < l; i++ {
@@ -265,10 +291,16 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 	// Let's guarantee progress.
 	for idx < len(toparse) && idx > lidx {
 		berType := toparse[idx]
+		if idx+1 >= len(toparse) {
+			return nil, fmt.Errorf("truncated tlv @ idx %v", idx)
+		}
 		berLength, berLenLen, err := DecodeLength(toparse[idx+1:])
 		if err != nil {
 			return nil, fmt.Errorf("length parse error @ idx %v", idx)
 		}
+		if berLength > uint64(len(toparse)-idx-1-berLenLen) {
+			return nil, fmt.Errorf("tlv length %d exceeds packet @ idx %v", berLength, idx)
+		}
 		berValue := toparse[idx+1+berLenLen : idx+1+berLenLen+int(berLength)]
 		berAll := toparse[idx : idx+1+berLenLen+int(berLength)]
 
@@ -329,16 +361,14 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 				return nil, err
 			}
 			result = append(result, pdu)
-		case AsnGetNextRequest, AsnGetRequest, AsnGetResponse, AsnTrapV2:
+		case AsnGetNextRequest, AsnGetRequest, AsnGetResponse, AsnSetRequest, AsnGetBulkRequest, AsnTrapV1, AsnInform, AsnTrapV2, AsnReport:
 			pdu, err := DecodeSequence(berAll)
 			if err != nil {
 				return nil, err
 			}
 			result = append(result, pdu)
-		case NoSuchInstance:
-			return nil, fmt.Errorf("no such instance. Received bytes: %v", toparse)
-		case EndOfMibView:
-			result = append(result, EndOfMibView)
+		case NoSuchObject, NoSuchInstance, EndOfMibView:
+			result = append(result, BERType(berType))
 		default:
 			result = append(result, UnsupportedBerType(berAll))
 		}
@@ -392,6 +422,13 @@ func EncodeSequence(toEncode []interface{}) ([]byte, error) {
 			for _, b := range enc {
 				toEncap = append(toEncap, b)
 			}
+		case Counter64:
+			enc := EncodeUInt(uint64(val))
+			toEncap = append(toEncap, byte(AsnCounter64))
+			toEncap = append(toEncap, byte(len(enc)))
+			for _, b := range enc {
+				toEncap = append(toEncap, b)
+			}
 		case Gauge:
 			enc := EncodeUInt(uint64(val))
 			// TODO encode length ?
@@ -400,6 +437,17 @@ func EncodeSequence(toEncode []interface{}) ([]byte, error) {
 			for _, b := range enc {
 				toEncap = append(toEncap, b)
 			}
+		case time.Duration:
+			enc := EncodeUInt(uint64(val / (10 * time.Millisecond)))
+			toEncap = append(toEncap, byte(AsnTimeticks))
+			toEncap = append(toEncap, byte(len(enc)))
+			for _, b := range enc {
+				toEncap = append(toEncap, b)
+			}
+		case BERType:
+			// Exception values (noSuchInstance, endOfMibView) have no content.
+			toEncap = append(toEncap, byte(val))
+			toEncap = append(toEncap, 0)
 		case string:
 			enc := []byte(val)
 			toEncap = append(toEncap, byte(AsnOctetStr))
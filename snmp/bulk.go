@@ -0,0 +1,58 @@
+package snmp
+
+//未设置重复次数上限时GetBulk的初始重复次数
+const defaultMaxRepetitions = 50
+
+//GetTable的GetBulk重复次数: 设备回复tooBig或者响应超过接收缓冲区时减半,
+//设备截断响应时以实际返回的数量为上限, 响应小于接收缓冲区的1/4时加倍
+type bulkSizer struct {
+	reps  int //下一个请求的重复次数
+	limit int //上限, 0表示不限制
+}
+
+func (w WapSNMP) newBulkSizer() *bulkSizer {
+	if w.maxRepetitions > 0 {
+		return &bulkSizer{reps: w.maxRepetitions, limit: w.maxRepetitions}
+	}
+	return &bulkSizer{reps: defaultMaxRepetitions}
+}
+
+//响应过大, 减半后重试; 已经为1时返回false
+func (b *bulkSizer) shrink() bool {
+	if b.reps <= 1 {
+		return false
+	}
+	//不再增加到失败时的数量
+	b.limit = b.reps - 1
+	b.reps /= 2
+	return true
+}
+
+//按成功的响应调整: requested为请求的varbind数量, returned为返回的数量, size为响应报文的长度
+func (b *bulkSizer) adjust(requested, returned, size, bufferSize int) {
+	if returned < requested {
+		//设备按自身的报文长度限制截断了响应
+		if returned < 1 {
+			returned = 1
+		}
+		b.reps = returned
+		b.limit = returned
+		return
+	}
+	if size*4 >= bufferSize {
+		return
+	}
+	b.reps *= 2
+	if b.limit > 0 && b.reps > b.limit {
+		b.reps = b.limit
+	}
+}
+
+//是否因为响应过大失败
+func isTooBig(err error) bool {
+	if err == ErrResponseTruncated {
+		return true
+	}
+	e, ok := err.(*ResponseError)
+	return ok && e.Status == TooBig
+}
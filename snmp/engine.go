@@ -0,0 +1,422 @@
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrEngineClosed = errors.New("snmp engine is closed")
+
+//套接字的接收缓冲区, 大量设备同时响应时避免丢包
+const engineReadBuffer = 4 << 20
+
+//UDP报文的最大长度, 共享套接字的接收缓冲区不会截断响应
+const maxDatagramSize = 65535
+
+//异步请求的目标(v1/v2c)
+type EngineTarget struct {
+	Addr      string //host或host:port, 默认端口161
+	Community string
+	Version   SNMPVersion
+	Timeout   time.Duration
+	Retries   int
+}
+
+//共享UDP套接字的SNMP引擎: 全部目标的请求复用少量套接字, 按请求ID把响应分发给对应的请求,
+//超时和重试由引擎的定时器处理, 不占用协程; 只支持v1/v2c
+type Engine struct {
+	shards []*engineShard
+	next   uint32
+}
+
+//一个套接字以及在其上等待响应的请求
+type engineShard struct {
+	conn    *net.UDPConn
+	mutex   sync.Mutex
+	pending map[int64]*Future
+	closed  bool
+}
+
+//异步请求的结果
+type Future struct {
+	done     chan struct{}
+	raw      []byte //响应报文, 由等待的调用者解码, 接收协程只解析报文头
+	decode   sync.Once
+	packet   []interface{} //响应PDU
+	err      error
+	callback func(*Response, error)
+
+	shard     *engineShard
+	addr      *net.UDPAddr
+	target    EngineTarget
+	requestID int64
+	req       []byte
+	attempts  int
+	stale     int
+	timer     *time.Timer
+}
+
+//创建引擎, sockets为使用的UDP套接字数量
+func NewEngine(sockets int) (*Engine, error) {
+	if sockets < 1 {
+		sockets = 1
+	}
+	e := &Engine{}
+	for i := 0; i < sockets; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("snmp engine: %s", err)
+		}
+		conn.SetReadBuffer(engineReadBuffer)
+		shard := &engineShard{conn: conn, pending: make(map[int64]*Future)}
+		e.shards = append(e.shards, shard)
+		go shard.receive()
+	}
+	return e, nil
+}
+
+//关闭全部套接字, 等待中的请求返回ErrEngineClosed
+func (e *Engine) Close() error {
+	for _, shard := range e.shards {
+		shard.close()
+	}
+	return nil
+}
+
+//等待响应的请求数
+func (e *Engine) Pending() int {
+	n := 0
+	for _, shard := range e.shards {
+		shard.mutex.Lock()
+		n += len(shard.pending)
+		shard.mutex.Unlock()
+	}
+	return n
+}
+
+//发送请求PDU, 请求ID由引擎分配; 返回的Future在收到响应, 重试后仍然超时或者被取消时完成
+func (e *Engine) Send(target EngineTarget, pdu []interface{}) *Future {
+	return e.send(target, pdu, nil)
+}
+
+//发送请求PDU, 完成时在新的协程中调用callback
+func (e *Engine) SendFunc(target EngineTarget, pdu []interface{}, callback func(*Response, error)) {
+	e.send(target, pdu, callback)
+}
+
+//异步获取多个oid
+func (e *Engine) Get(target EngineTarget, oids ...Oid) *Future {
+	return e.Send(target, requestPDU(AsnGetRequest, 0, 0, oids))
+}
+
+//异步获取多个oid的下一个值
+func (e *Engine) GetNext(target EngineTarget, oids ...Oid) *Future {
+	return e.Send(target, requestPDU(AsnGetNextRequest, 0, 0, oids))
+}
+
+//异步GetBulk, 结果按 重复次数 x oid 的顺序交错排列
+func (e *Engine) GetBulk(target EngineTarget, maxRepetitions int, oids ...Oid) *Future {
+	return e.Send(target, requestPDU(AsnGetBulkRequest, 0, maxRepetitions, oids))
+}
+
+func requestPDU(pduType BERType, nonRepeaters, maxRepetitions int, oids []Oid) []interface{} {
+	varbinds := []interface{}{Sequence}
+	for _, oid := range oids {
+		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
+	}
+	return []interface{}{pduType, 0, nonRepeaters, maxRepetitions, varbinds}
+}
+
+func (e *Engine) send(target EngineTarget, pdu []interface{}, callback func(*Response, error)) *Future {
+	f := &Future{done: make(chan struct{}), callback: callback, target: target}
+	if target.Version == SNMPv3 {
+		f.complete(nil, fmt.Errorf("snmp engine doesn't support SNMPv3"))
+		return f
+	}
+	if len(pdu) < 5 {
+		f.complete(nil, fmt.Errorf("invalid request PDU"))
+		return f
+	}
+	addr, err := net.ResolveUDPAddr("udp", targetAddr(target.Addr))
+	if err != nil {
+		f.complete(nil, err)
+		return f
+	}
+	f.addr = addr
+	if f.target.Timeout <= 0 {
+		f.target.Timeout = time.Second
+	}
+	if len(e.shards) == 0 {
+		f.complete(nil, ErrEngineClosed)
+		return f
+	}
+	f.shard = e.shards[atomic.AddUint32(&e.next, 1)%uint32(len(e.shards))]
+	f.shard.start(f, pdu)
+	return f
+}
+
+//分配请求ID, 编码并发送请求
+func (s *engineShard) start(f *Future, pdu []interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		f.complete(nil, ErrEngineClosed)
+		return
+	}
+	for {
+		f.requestID = int64(rand.Int31())
+		if _, ok := s.pending[f.requestID]; !ok {
+			break
+		}
+	}
+	request := append([]interface{}{}, pdu...)
+	request[1] = f.requestID
+	req, err := EncodeSequence([]interface{}{Sequence, int(f.target.Version), f.target.Community, request})
+	if err != nil {
+		f.complete(nil, err)
+		return
+	}
+	f.req = req
+	s.pending[f.requestID] = f
+	s.transmit(f)
+}
+
+//发送(或者重发)请求并设置超时, 调用时持有mutex
+func (s *engineShard) transmit(f *Future) {
+	f.attempts++
+	if _, err := s.conn.WriteToUDP(f.req, f.addr); err != nil {
+		delete(s.pending, f.requestID)
+		f.complete(nil, &RequestError{RequestID: int(f.requestID), Attempts: f.attempts, Stale: f.stale, Err: err})
+		return
+	}
+	f.timer = time.AfterFunc(f.target.Timeout, func() {
+		s.expire(f)
+	})
+}
+
+//超时: 还有重试次数时重发, 否则以超时错误完成
+func (s *engineShard) expire(f *Future) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pending[f.requestID] != f {
+		return
+	}
+	if f.attempts <= f.target.Retries {
+		s.transmit(f)
+		return
+	}
+	delete(s.pending, f.requestID)
+	f.complete(nil, &RequestError{RequestID: int(f.requestID), Attempts: f.attempts, Stale: f.stale, Err: errEngineTimeout})
+}
+
+//取消等待中的请求
+func (s *engineShard) cancel(f *Future, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pending[f.requestID] != f {
+		return
+	}
+	delete(s.pending, f.requestID)
+	f.timer.Stop()
+	f.complete(nil, err)
+}
+
+//接收响应并按请求ID分发, 来源地址, 版本或者community不一致的报文被丢弃
+func (s *engineShard) receive() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, remote, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+		version, community, requestID, ok := peekHeader(buf[:n])
+		if !ok {
+			continue
+		}
+
+		s.mutex.Lock()
+		f, ok := s.pending[requestID]
+		if ok && (!remote.IP.Equal(f.addr.IP) || remote.Port != f.addr.Port ||
+			version != int64(f.target.Version) || community != f.target.Community) {
+			f.stale++
+			ok = false
+		}
+		if ok {
+			delete(s.pending, requestID)
+			f.timer.Stop()
+		}
+		s.mutex.Unlock()
+		if ok {
+			f.complete(append([]byte{}, buf[:n]...), nil)
+		}
+	}
+}
+
+func (s *engineShard) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.conn.Close()
+	for id, f := range s.pending {
+		delete(s.pending, id)
+		f.timer.Stop()
+		f.complete(nil, ErrEngineClosed)
+	}
+}
+
+//解析报文头: 版本, community与请求ID, 不解码varbind; 报文可以被截断
+func peekHeader(packet []byte) (int64, string, int64, bool) {
+	fields, err := berPrefix(packet, 0, 3)
+	if err != nil || fields[0].tag != byte(AsnInteger) || fields[1].tag != byte(AsnOctetStr) || fields[1].end > len(packet) {
+		return 0, "", 0, false
+	}
+	pduFields, err := berPrefix(packet, fields[2].start, 1)
+	if err != nil || pduFields[0].tag != byte(AsnInteger) || pduFields[0].end > len(packet) {
+		return 0, "", 0, false
+	}
+	version, err := DecodeInteger(packet[fields[0].valueStart:fields[0].end])
+	if err != nil {
+		return 0, "", 0, false
+	}
+	requestID, err := DecodeInteger(packet[pduFields[0].valueStart:pduFields[0].end])
+	if err != nil {
+		return 0, "", 0, false
+	}
+	return version, string(packet[fields[1].valueStart:fields[1].end]), requestID, true
+}
+
+func (f *Future) complete(raw []byte, err error) {
+	f.raw = raw
+	f.err = err
+	close(f.done)
+	if f.callback != nil {
+		go func() {
+			f.callback(f.Wait())
+		}()
+	}
+}
+
+//请求完成时关闭的chan
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//等待请求完成, 设备返回错误时返回*ResponseError
+func (f *Future) Wait() (*Response, error) {
+	packet, err := f.wait()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := parseResponse(packet)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+//等待请求完成并返回未解析的响应PDU
+func (f *Future) wait() ([]interface{}, error) {
+	<-f.done
+	f.decode.Do(func() {
+		if f.err != nil {
+			return
+		}
+		decoded, err := DecodeSequence(f.raw)
+		if err != nil {
+			f.err = err
+			return
+		}
+		if len(decoded) < 4 {
+			f.err = fmt.Errorf("response is too short")
+			return
+		}
+		pdu, ok := decoded[3].([]interface{})
+		if !ok {
+			f.err = fmt.Errorf("response doesn't contain a PDU")
+			return
+		}
+		f.packet = pdu
+	})
+	return f.packet, f.err
+}
+
+//取消请求, 请求已经完成时不起作用
+func (f *Future) Cancel() {
+	if f.shard != nil {
+		f.shard.cancel(f, errRequestCancelled)
+	}
+}
+
+var errRequestCancelled = errors.New("snmp request cancelled")
+
+//引擎的超时错误, 与net.Conn的超时一样实现net.Error
+type engineTimeoutError struct{}
+
+func (engineTimeoutError) Error() string   { return "i/o timeout" }
+func (engineTimeoutError) Timeout() bool   { return true }
+func (engineTimeoutError) Temporary() bool { return true }
+
+var errEngineTimeout net.Error = engineTimeoutError{}
+
+//使用共享引擎的客户端会话, Close时取消正在进行的请求
+type engineSession struct {
+	engine *Engine
+	closed chan struct{}
+	once   sync.Once
+}
+
+//创建使用共享引擎的SNMP客户端(v1/v2c), 不单独占用套接字
+func NewWapSNMPOnEngine(target, community string, version SNMPVersion, timeout time.Duration, retries int, engine *Engine) (*WapSNMP, error) {
+	if version == SNMPv3 {
+		return nil, fmt.Errorf("snmp engine doesn't support SNMPv3")
+	}
+	return &WapSNMP{
+		Target:    target,
+		Community: community,
+		Version:   version,
+		timeout:   timeout,
+		retries:   retries,
+		session:   &engineSession{engine: engine, closed: make(chan struct{})},
+	}, nil
+}
+
+func (s *engineSession) exchange(w WapSNMP, pdu []interface{}) ([]interface{}, int, error) {
+	f := s.engine.Send(EngineTarget{
+		Addr:      w.Target,
+		Community: w.Community,
+		Version:   w.Version,
+		Timeout:   w.timeout,
+		Retries:   w.retries,
+	}, pdu)
+	select {
+	case <-f.Done():
+	case <-s.closed:
+		f.Cancel()
+	}
+	packet, err := f.wait()
+	return packet, len(f.raw), err
+}
+
+func (s *engineSession) close() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+}
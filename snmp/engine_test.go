@@ -0,0 +1,94 @@
+package snmp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+//多个设备的请求共享一个套接字, 响应按请求ID分发给对应的请求
+func TestEngineDemultiplex(t *testing.T) {
+	engine, err := NewEngine(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	agents := []*Agent{}
+	for i := 0; i < 5; i++ {
+		a := startAgent(t, []SNMPValue{{Oid: sysName, Value: fmt.Sprintf("switch-%d", i)}})
+		//不同的延迟使响应乱序到达
+		a.AddFault(Fault{Prefix: sysName, Delay: time.Duration(5-i) * 10 * time.Millisecond})
+		agents = append(agents, a)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for n := 0; n < 10; n++ {
+		for i, a := range agents {
+			wg.Add(1)
+			go func(i int, addr string) {
+				defer wg.Done()
+				resp, err := engine.Get(EngineTarget{Addr: addr, Community: "public", Version: SNMPv2c, Timeout: time.Second}, sysName).Wait()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if want := fmt.Sprintf("switch-%d", i); len(resp.Varbinds) != 1 || resp.Varbinds[0].Value != want {
+					errs <- fmt.Errorf("agent %d: %v, want %s", i, resp.Varbinds, want)
+				}
+			}(i, a.Addr().String())
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := engine.Pending(); n != 0 {
+		t.Fatalf("%d requests still pending", n)
+	}
+}
+
+func TestEngineTimeout(t *testing.T) {
+	engine, err := NewEngine(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	a := startAgent(t, tableValues(1))
+	a.AddFault(Fault{Prefix: sysName, Drop: 1})
+
+	_, err = engine.Get(EngineTarget{Addr: a.Addr().String(), Community: "public", Version: SNMPv2c, Timeout: 50 * time.Millisecond, Retries: 1}, sysName).Wait()
+	e, ok := err.(*RequestError)
+	if !ok || !e.Timeout() || e.Attempts != 2 {
+		t.Fatalf("error = %#v, want a timeout after 2 attempts", err)
+	}
+	if n := a.Requests(); n != 2 {
+		t.Fatalf("%d requests, want 2", n)
+	}
+}
+
+//使用共享引擎的客户端遍历表
+func TestEngineGetTables(t *testing.T) {
+	engine, err := NewEngine(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	a := startAgentWithLimit(t, tableValues(100), 600)
+	for _, version := range []SNMPVersion{SNMPv1, SNMPv2c} {
+		w, err := NewWapSNMPOnEngine(a.Addr().String(), "public", version, time.Second, 0, engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables, err := w.GetTables([]Oid{ifHCInOctets, ifHCOutOctets})
+		w.Close()
+		if err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		checkTable(t, tables[ifHCInOctets.String()], ifHCInOctets, 100, 1000)
+		checkTable(t, tables[ifHCOutOctets.String()], ifHCOutOctets, 100, 2000)
+	}
+}
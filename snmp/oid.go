@@ -125,3 +125,34 @@ func (o Oid) Within(other Oid) bool {
 	}
 	return true
 }
+
+func (o Oid) Equal(other Oid) bool {
+	if len(o) != len(other) {
+		return false
+	}
+	for idx, val := range other {
+		if o[idx] != val {
+			return false
+		}
+	}
+	return true
+}
+
+//按字典序比较, o在other之前时返回-1, 相等返回0, 之后返回1
+func (o Oid) Compare(other Oid) int {
+	for idx := 0; idx < len(o) && idx < len(other); idx++ {
+		if o[idx] < other[idx] {
+			return -1
+		}
+		if o[idx] > other[idx] {
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package snmp
+
+import (
+	"fmt"
+)
+
+//响应PDU的error-status (RFC 3416)
+type ErrorStatus int
+
+const (
+	NoError             ErrorStatus = 0
+	TooBig              ErrorStatus = 1
+	NoSuchName          ErrorStatus = 2 //仅v1: oid不存在
+	BadValue            ErrorStatus = 3 //仅v1
+	ReadOnly            ErrorStatus = 4 //仅v1
+	GenErr              ErrorStatus = 5
+	NoAccess            ErrorStatus = 6
+	WrongType           ErrorStatus = 7
+	WrongLength         ErrorStatus = 8
+	WrongEncoding       ErrorStatus = 9
+	WrongValue          ErrorStatus = 10
+	NoCreation          ErrorStatus = 11
+	InconsistentValue   ErrorStatus = 12
+	ResourceUnavailable ErrorStatus = 13
+	CommitFailed        ErrorStatus = 14
+	UndoFailed          ErrorStatus = 15
+	AuthorizationError  ErrorStatus = 16
+	NotWritable         ErrorStatus = 17
+	InconsistentName    ErrorStatus = 18
+)
+
+var errorStatusNames = []string{
+	"noError",
+	"tooBig",
+	"noSuchName",
+	"badValue",
+	"readOnly",
+	"genErr",
+	"noAccess",
+	"wrongType",
+	"wrongLength",
+	"wrongEncoding",
+	"wrongValue",
+	"noCreation",
+	"inconsistentValue",
+	"resourceUnavailable",
+	"commitFailed",
+	"undoFailed",
+	"authorizationError",
+	"notWritable",
+	"inconsistentName",
+}
+
+func (s ErrorStatus) String() string {
+	if s >= 0 && int(s) < len(errorStatusNames) {
+		return errorStatusNames[s]
+	}
+	return fmt.Sprintf("errorStatus(%d)", int(s))
+}
+
+//设备在响应中返回的错误(error-status不为noError)
+type ResponseError struct {
+	Status ErrorStatus
+	Index  int //出错的varbind序号, 从1开始, 0表示不针对某个varbind
+	Oid    Oid //出错的oid, 响应中没有对应的varbind时为空
+}
+
+func (e *ResponseError) Error() string {
+	if e.Oid != nil {
+		return fmt.Sprintf("snmp error %s at varbind %d (%s)", e.Status, e.Index, e.Oid.String())
+	}
+	if e.Index > 0 {
+		return fmt.Sprintf("snmp error %s at varbind %d", e.Status, e.Index)
+	}
+	return fmt.Sprintf("snmp error %s", e.Status)
+}
+
+//请求的oid在设备上不存在: v2c响应中的异常值
+type NoSuchError struct {
+	Oid       Oid
+	Exception BERType //NoSuchObject, NoSuchInstance 或 EndOfMibView
+}
+
+func (e *NoSuchError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Oid.String(), exceptionName(e.Exception))
+}
+
+func exceptionName(t BERType) string {
+	switch t {
+	case NoSuchObject:
+		return "no such object"
+	case NoSuchInstance:
+		return "no such instance"
+	case EndOfMibView:
+		return "end of mib view"
+	}
+	return fmt.Sprintf("exception 0x%x", uint8(t))
+}
+
+//varbind的值是否为异常值(noSuchObject, noSuchInstance, endOfMibView)
+func IsException(v interface{}) bool {
+	t, ok := v.(BERType)
+	return ok && (t == NoSuchObject || t == NoSuchInstance || t == EndOfMibView)
+}
+
+//错误是否表示oid不存在(v2c的异常值或者v1的noSuchName), 用于区分设备错误
+func IsNoSuch(err error) bool {
+	switch e := err.(type) {
+	case *NoSuchError:
+		return true
+	case *ResponseError:
+		return e.Status == NoSuchName
+	}
+	return false
+}
+
+//解码后的响应PDU
+type Response struct {
+	RequestID   int64
+	ErrorStatus ErrorStatus
+	ErrorIndex  int
+	Varbinds    []SNMPValue
+	size        int //响应报文的长度
+}
+
+//校验响应PDU的结构, 不会因为报文不完整而panic
+func parseResponse(respPacket []interface{}) (*Response, error) {
+	if len(respPacket) < 5 {
+		return nil, fmt.Errorf("response PDU is too short")
+	}
+	if t, ok := respPacket[0].(BERType); !ok || t != AsnGetResponse {
+		return nil, fmt.Errorf("unexpected PDU type %v in response", respPacket[0])
+	}
+	requestID, ok1 := respPacket[1].(int64)
+	status, ok2 := respPacket[2].(int64)
+	index, ok3 := respPacket[3].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("malformed response PDU header")
+	}
+	varbinds, err := decodeVarbinds(respPacket[4])
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		RequestID:   requestID,
+		ErrorStatus: ErrorStatus(status),
+		ErrorIndex:  int(index),
+		Varbinds:    varbinds,
+	}, nil
+}
+
+//error-status不为noError时返回*ResponseError
+func (r *Response) Err() error {
+	if r.ErrorStatus == NoError {
+		return nil
+	}
+	e := &ResponseError{Status: r.ErrorStatus, Index: r.ErrorIndex}
+	if r.ErrorIndex > 0 && r.ErrorIndex <= len(r.Varbinds) {
+		e.Oid = r.Varbinds[r.ErrorIndex-1].Oid
+	}
+	return e
+}
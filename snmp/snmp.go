@@ -1,10 +1,11 @@
 package snmp
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
-	"reflect"
+	"strings"
 	"time"
 )
 
@@ -15,6 +16,11 @@ type WapSNMP struct {
 	timeout   time.Duration
 	retries   int
 	conn      net.Conn
+	usm       *usmState      //SNMPv3会话状态
+	session   *engineSession //使用共享引擎时的会话, conn为空
+
+	maxRepetitions int //GetTable每个GetBulk请求的重复次数上限, 0表示自动调整
+	bufferSize     int //接收缓冲区大小, 0表示使用bufSize
 }
 
 type SNMPValue struct {
@@ -26,19 +32,71 @@ const (
 	bufSize int = 16384
 )
 
-//创建SNMP客户端
+//响应超过接收缓冲区时报文被截断
+var ErrResponseTruncated = errors.New("snmp response exceeds the receive buffer")
+
+//创建SNMP客户端, target可以带端口(例如 127.0.0.1:1161), 默认为161
 func NewWapSNMP(target, community string, version SNMPVersion, timeout time.Duration, retries int) (*WapSNMP, error) {
-	targetPort := fmt.Sprintf("%s:161", target)
+	targetPort := targetAddr(target)
 	conn, err := net.DialTimeout("udp", targetPort, timeout)
 	if err != nil {
 		return nil, fmt.Errorf(`error connecting to ("udp", "%s"): %s`, targetPort, err)
 	}
-	return &WapSNMP{target, community, version, timeout, retries, conn}, nil
+	return NewWapSNMPOnConn(target, community, version, timeout, retries, conn), nil
 }
 
 //创建自定义连接的SNMP客户端
 func NewWapSNMPOnConn(target, community string, version SNMPVersion, timeout time.Duration, retries int, conn net.Conn) *WapSNMP {
-	return &WapSNMP{target, community, version, timeout, retries, conn}
+	return &WapSNMP{
+		Target:    target,
+		Community: community,
+		Version:   version,
+		timeout:   timeout,
+		retries:   retries,
+		conn:      conn,
+	}
+}
+
+//解析配置中的SNMP版本: v1, v2c(默认), v3
+func ParseVersion(name string) (SNMPVersion, error) {
+	switch strings.TrimPrefix(strings.ToLower(name), "v") {
+	case "1":
+		return SNMPv1, nil
+	case "", "2", "2c":
+		return SNMPv2c, nil
+	case "3":
+		return SNMPv3, nil
+	}
+	return SNMPv2c, fmt.Errorf("unknown snmp version %q", name)
+}
+
+//目标地址没有端口时使用161
+func targetAddr(target string) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(target, "161")
+}
+
+//设置GetTable/GetTables每个GetBulk请求的重复次数上限, 出现tooBig时仍然会降低; 不大于0时自动调整
+func (w *WapSNMP) SetMaxRepetitions(n int) {
+	w.maxRepetitions = n
+}
+
+//设置接收缓冲区大小, 用于响应较大的设备; 不大于0时为16384; 使用共享引擎时不起作用
+func (w *WapSNMP) SetBufferSize(n int) {
+	w.bufferSize = n
+}
+
+//使用共享引擎时接收缓冲区固定为报文的最大长度, bufferSize只作用于单独的套接字
+func (w WapSNMP) receiveBufferSize() int {
+	if w.session != nil {
+		return maxDatagramSize
+	}
+	if w.bufferSize > 0 {
+		return w.bufferSize
+	}
+	return bufSize
 }
 
 //生成随机的请求ID
@@ -46,106 +104,191 @@ func RandomRequestID() int {
 	return int(rand.Int31())
 }
 
-//轮训请求
-func poll(conn net.Conn, toSend []byte, respondBuffer []byte, retries int, timeout time.Duration) (int, error) {
-	var err error
+//请求失败, 错误中包含请求ID便于排查
+type RequestError struct {
+	RequestID int
+	Attempts  int //发送次数
+	Stale     int //丢弃的不匹配的报文数
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	msg := fmt.Sprintf("request %d: no response after %d attempts", e.RequestID, e.Attempts)
+	if e.Stale > 0 {
+		msg += fmt.Sprintf(" (%d stale responses discarded)", e.Stale)
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Err)
+}
+
+//是否因为超时失败
+func (e *RequestError) Timeout() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+//轮训请求: 读取到与match匹配的响应为止, 不匹配的报文(例如上一个请求超时后才到达的响应)被丢弃;
+//重试时发送相同的请求(相同的请求ID), 任意一次发送的响应都可以作为结果;
+//报文填满接收缓冲区时已经被截断, owns根据报文头判断是本次请求的响应时返回ErrResponseTruncated
+func poll(conn net.Conn, toSend []byte, respondBuffer []byte, retries int, timeout time.Duration, requestID int, owns func(packet []byte) bool, match func(packet []byte) bool) (int, error) {
+	reqErr := &RequestError{RequestID: requestID}
 	for i := 0; i < retries+1; i++ {
 
 		if i >= 1 {
 			fmt.Printf("正在进行snmp的第%d次重试.\n", i)
 		}
+		reqErr.Attempts++
 
 		deadline := time.Now().Add(timeout)
 
-		if err = conn.SetWriteDeadline(deadline); err != nil {
-			fmt.Errorf("Couldn't set write deadline. Retrying. Retry %d/%d\n", i, retries)
+		if reqErr.Err = conn.SetWriteDeadline(deadline); reqErr.Err != nil {
 			continue
 		}
-		if _, err = conn.Write(toSend); err != nil {
-			fmt.Errorf("Couldn't write. Retrying. Retry %d/%d\n", i, retries)
+		if _, reqErr.Err = conn.Write(toSend); reqErr.Err != nil {
 			continue
 		}
 		//超时
 		deadline = time.Now().Add(timeout)
-		if err = conn.SetReadDeadline(deadline); err != nil {
-			fmt.Errorf("Couldn't set read deadline. Retrying. Retry %d/%d\n", i, retries)
+		if reqErr.Err = conn.SetReadDeadline(deadline); reqErr.Err != nil {
 			continue
 		}
 
-		numRead := 0
-		if numRead, err = conn.Read(respondBuffer); err != nil {
-			fmt.Errorf("Couldn't read. Retrying. Retry %d/%d\n", i, retries)
-			continue
+		for {
+			numRead, err := conn.Read(respondBuffer)
+			if err != nil {
+				reqErr.Err = err
+				break
+			}
+			//其他请求的过大响应与不匹配的报文一样丢弃, 不影响本次请求
+			if numRead >= len(respondBuffer) {
+				if owns(respondBuffer[:numRead]) {
+					return numRead, ErrResponseTruncated
+				}
+				reqErr.Stale++
+				continue
+			}
+			if match(respondBuffer[:numRead]) {
+				return numRead, nil
+			}
+			reqErr.Stale++
 		}
-
-		return numRead, nil
 	}
-	return 0, err
+	return 0, reqErr
 }
 
-//请求获取
-func (w WapSNMP) Get(oid Oid) (interface{}, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetRequest, requestID, 0, 0,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
+//发送请求PDU并返回响应PDU与响应报文的长度, 按版本选择community或USM安全模型;
+//只接受版本, community与请求ID都一致的响应
+func (w WapSNMP) exchange(pdu []interface{}) ([]interface{}, int, error) {
+	if w.Version == SNMPv3 {
+		return w.usm.exchange(w, pdu)
+	}
+	if w.session != nil {
+		return w.session.exchange(w, pdu)
+	}
+
+	requestID, _ := pdu[1].(int)
+	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community, pdu})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+	owns := func(packet []byte) bool {
+		version, community, id, ok := peekHeader(packet)
+		return ok && version == int64(w.Version) && community == w.Community && id == int64(requestID)
+	}
+	var respPacket []interface{}
+	match := func(packet []byte) bool {
+		decoded, err := DecodeSequence(packet)
+		if err != nil || len(decoded) < 4 {
+			return false
+		}
+		if version, ok := decoded[1].(int64); !ok || version != int64(w.Version) {
+			return false
+		}
+		if community, ok := decoded[2].(string); !ok || community != w.Community {
+			return false
+		}
+		pdu, ok := decoded[3].([]interface{})
+		if !ok || len(pdu) < 2 {
+			return false
+		}
+		if id, ok := pdu[1].(int64); !ok || id != int64(requestID) {
+			return false
+		}
+		respPacket = pdu
+		return true
+	}
+
+	response := make([]byte, w.receiveBufferSize())
+	numRead, err := poll(w.conn, req, response, w.retries, w.timeout, requestID, owns, match)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	return respPacket, numRead, nil
+}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+//发送请求并校验响应PDU, 设备返回错误时返回*ResponseError
+func (w WapSNMP) request(pdu []interface{}) (*Response, error) {
+	respPacket, size, err := w.exchange(pdu)
 	if err != nil {
 		return nil, err
 	}
-
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})[2]
-
-	return result, nil
+	resp, err := parseResponse(respPacket)
+	if err != nil {
+		return nil, err
+	}
+	resp.size = size
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
-//接收多个OID的合并处理
-func (w WapSNMP) GetMultiple(oids []Oid) (map[string]interface{}, error) {
-	requestID := RandomRequestID()
-
-	varbinds := []interface{}{Sequence}
-	for _, oid := range oids {
-		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
+//只请求一个oid时取得响应中的varbind
+func (r *Response) first() (SNMPValue, error) {
+	if len(r.Varbinds) < 1 {
+		return SNMPValue{}, fmt.Errorf("response doesn't contain a varbind")
 	}
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetRequest, requestID, 0, 0, varbinds}})
+	return r.Varbinds[0], nil
+}
 
+//请求获取, oid不存在时返回*NoSuchError(v1为noSuchName的*ResponseError), 可以用IsNoSuch判断
+func (w WapSNMP) Get(oid Oid) (interface{}, error) {
+	requestID := RandomRequestID()
+	resp, err := w.request([]interface{}{AsnGetRequest, requestID, 0, 0,
+		[]interface{}{Sequence,
+			[]interface{}{Sequence, oid, nil}}})
 	if err != nil {
 		return nil, err
 	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+	v, err := resp.first()
 	if err != nil {
 		return nil, err
 	}
+	if IsException(v.Value) {
+		return nil, &NoSuchError{oid, v.Value.(BERType)}
+	}
+	return v.Value, nil
+}
+
+//接收多个OID的合并处理, 不存在的oid不包含在结果中
+func (w WapSNMP) GetMultiple(oids []Oid) (map[string]interface{}, error) {
+	requestID := RandomRequestID()
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	varbinds := []interface{}{Sequence}
+	for _, oid := range oids {
+		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
+	}
+	resp, err := w.request([]interface{}{AsnGetRequest, requestID, 0, 0, varbinds})
 	if err != nil {
 		return nil, err
 	}
 
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
 	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	for _, v := range resp.Varbinds {
+		if IsException(v.Value) {
+			continue
+		}
+		result[v.Oid.String()] = v.Value
 	}
 
 	return result, nil
@@ -153,30 +296,17 @@ func (w WapSNMP) GetMultiple(oids []Oid) (map[string]interface{}, error) {
 
 func (w WapSNMP) Set(oid Oid, value interface{}) (interface{}, error) {
 	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnSetRequest, requestID, 0, 0,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, value}}}})
-	if err != nil {
-		return nil, err
-	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+	resp, err := w.request([]interface{}{AsnSetRequest, requestID, 0, 0,
+		[]interface{}{Sequence,
+			[]interface{}{Sequence, oid, value}}})
 	if err != nil {
 		return nil, err
 	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	v, err := resp.first()
 	if err != nil {
 		return nil, err
 	}
-
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})[2]
-
-	return result, nil
+	return v.Value, nil
 }
 
 func (w WapSNMP) SetMultiple(toset map[string]interface{}) (map[string]interface{}, error) {
@@ -184,165 +314,217 @@ func (w WapSNMP) SetMultiple(toset map[string]interface{}) (map[string]interface
 
 	varbinds := []interface{}{Sequence}
 	for oid, value := range toset {
-		varbinds = append(varbinds, []interface{}{Sequence, oid, value})
-	}
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetRequest, requestID, 0, 0, varbinds}})
-
-	if err != nil {
-		return nil, err
-	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
-	if err != nil {
-		return nil, err
+		parsed, err := ParseOid(oid)
+		if err != nil {
+			return nil, err
+		}
+		varbinds = append(varbinds, []interface{}{Sequence, parsed, value})
 	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	resp, err := w.request([]interface{}{AsnSetRequest, requestID, 0, 0, varbinds})
 	if err != nil {
 		return nil, err
 	}
 
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
 	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	for _, v := range resp.Varbinds {
+		result[v.Oid.String()] = v.Value
 	}
 
 	return result, nil
 }
 
-//获取下一个
+//获取下一个, 遍历结束时值为EndOfMibView(v1返回noSuchName的*ResponseError)
 func (w WapSNMP) GetNext(oid Oid) (*Oid, interface{}, error) {
 	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetNextRequest, requestID, 0, 0,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
-	if err != nil {
-		return nil, nil, err
-	}
-
-	response := make([]byte, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+	resp, err := w.request([]interface{}{AsnGetNextRequest, requestID, 0, 0,
+		[]interface{}{Sequence,
+			[]interface{}{Sequence, oid, nil}}})
 	if err != nil {
 		return nil, nil, err
 	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	v, err := resp.first()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})
-
-	resultOid := result[1].(Oid)
-	resultVal := result[2]
-
-	return &resultOid, resultVal, nil
+	return &v.Oid, v.Value, nil
 }
 
+//结果中包含异常值(例如EndOfMibView), 调用者需要用IsException过滤
 func (w WapSNMP) GetBulk(oid Oid, maxRepetitions int) (map[string]interface{}, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetBulkRequest, requestID, 0, maxRepetitions,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
-	if err != nil {
-		return nil, err
-	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
-	if err != nil {
-		return nil, err
-	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	results, err := w.GetBulkArray(oid, maxRepetitions)
 	if err != nil {
 		return nil, err
 	}
 
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
 	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] {
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	for _, v := range results {
+		result[v.Oid.String()] = v.Value
 	}
 
 	return result, nil
 }
 
 func (w WapSNMP) GetBulkArray(oid Oid, maxRepetitions int) ([]SNMPValue, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetBulkRequest, requestID, 0, maxRepetitions,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
-	if err != nil {
-		return nil, err
-	}
+	return w.GetBulkArrayMultiple([]Oid{oid}, maxRepetitions)
+}
 
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+//多个oid合并为一个GetBulk请求, 结果按 重复次数 x oid 的顺序交错排列
+func (w WapSNMP) GetBulkArrayMultiple(oids []Oid, maxRepetitions int) ([]SNMPValue, error) {
+	resp, err := w.getBulk(oids, maxRepetitions)
 	if err != nil {
 		return nil, err
 	}
+	return resp.Varbinds, nil
+}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
-	if err != nil {
-		return nil, fmt.Errorf("error during sequence decoding: %v", err)
+func (w WapSNMP) getBulk(oids []Oid, maxRepetitions int) (*Response, error) {
+	if w.Version == SNMPv1 {
+		return nil, fmt.Errorf("GetBulk is not supported by SNMPv1")
 	}
+	requestID := RandomRequestID()
 
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
-	result := make([]SNMPValue, 0, len(respVarbinds[1:]))
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid)
-		value := v.([]interface{})[2]
-		result = append(result, SNMPValue{oid, value})
+	varbinds := []interface{}{Sequence}
+	for _, oid := range oids {
+		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
 	}
-
-	return result, nil
+	return w.request([]interface{}{AsnGetBulkRequest, requestID, 0, maxRepetitions, varbinds})
 }
 
-//请求的结果形成Table的形式并返回
+//请求的结果形成Table的形式并返回, 每个GetBulk请求的重复次数按响应自动调整;
+//v1或者设备拒绝GetBulk时改用GetNext遍历
 func (w WapSNMP) GetTable(oid Oid) (map[string]interface{}, error) {
+	if w.Version == SNMPv1 {
+		return w.walkTable(oid)
+	}
 	result := make(map[string]interface{})
+	sizer := w.newBulkSizer()
 	lastOid := oid.Copy()
-	for lastOid.Within(oid) {
-		results, err := w.GetBulkArray(lastOid, 50)
+	for {
+		resp, err := w.getBulk([]Oid{lastOid}, sizer.reps)
+		if isTooBig(err) && sizer.shrink() {
+			continue
+		}
+		if bulkFailed(err, len(result) == 0) {
+			return w.walkTable(oid)
+		}
 		if err != nil {
 			//return nil, fmt.Errorf("received GetBulk error => %v\n", err)
 			return nil, fmt.Errorf("oid(%s) received GetBulk error => %v\n", lastOid.String(), err)
 		}
-		newLastOid := lastOid.Copy()
-		for _, v := range results {
-			if v.Oid.Within(oid) {
-				result[v.Oid.String()] = v.Value
+
+		ended := len(resp.Varbinds) == 0
+		newLastOid := lastOid
+		for _, v := range resp.Varbinds {
+			//遍历结束的varbind的oid是请求的oid, 不能作为结果
+			if IsException(v.Value) || !v.Oid.Within(oid) {
+				ended = true
+				break
 			}
+			result[v.Oid.String()] = v.Value
 			newLastOid = v.Oid
 		}
-
-		if reflect.DeepEqual(lastOid, newLastOid) {
+		if ended {
 			break
 		}
+		//设备返回的oid没有递增, 继续请求会死循环
+		if newLastOid.Compare(lastOid) <= 0 {
+			return nil, &LoopError{Oid: newLastOid, Previous: lastOid}
+		}
+		sizer.adjust(sizer.reps, len(resp.Varbinds), resp.size, w.receiveBufferSize())
 		lastOid = newLastOid
 	}
 	return result, nil
 }
 
+//在同一个会话中同时遍历多个表(列), 每个GetBulk请求包含全部未遍历完的列, 返回以请求oid为键的结果;
+//v1或者设备拒绝GetBulk时改用GetNext遍历
+func (w WapSNMP) GetTables(oids []Oid) (map[string]map[string]interface{}, error) {
+	if w.Version == SNMPv1 {
+		return w.walkTables(oids)
+	}
+	result := make(map[string]map[string]interface{})
+	roots := []Oid{}
+	last := []Oid{}
+	for _, oid := range oids {
+		if _, ok := result[oid.String()]; ok {
+			continue
+		}
+		result[oid.String()] = make(map[string]interface{})
+		roots = append(roots, oid)
+		last = append(last, oid.Copy())
+	}
+
+	//sizer.reps为每个请求的varbind总数, 平均分配给未遍历完的列
+	sizer := w.newBulkSizer()
+	first := true
+	for len(roots) > 0 {
+		maxRepetitions := sizer.reps / len(roots)
+		if maxRepetitions < 1 {
+			maxRepetitions = 1
+		}
+		resp, err := w.getBulk(last, maxRepetitions)
+		if isTooBig(err) && sizer.shrink() {
+			continue
+		}
+		if bulkFailed(err, first) {
+			return w.walkTables(oids)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("oid(%s) received GetBulk error => %v", last[0].String(), err)
+		}
+		first = false
+		results := resp.Varbinds
+		if len(results) == 0 {
+			break
+		}
+
+		done := make([]bool, len(roots))
+		received := make([]bool, len(roots))
+		next := make([]Oid, len(roots))
+		copy(next, last)
+		ended := false
+		for i, v := range results {
+			col := i % len(roots)
+			if done[col] {
+				continue
+			}
+			received[col] = true
+			if IsException(v.Value) || !v.Oid.Within(roots[col]) {
+				done[col] = true
+				ended = true
+				continue
+			}
+			result[roots[col].String()][v.Oid.String()] = v.Value
+			next[col] = v.Oid
+		}
+		//有列遍历完时响应变短不是因为截断
+		if !ended {
+			sizer.adjust(maxRepetitions*len(roots), len(results), resp.size, w.receiveBufferSize())
+		}
+
+		//遍历完的列不再请求; 设备截断了响应而没有返回的列下一轮继续
+		activeRoots := roots[:0]
+		activeLast := last[:0]
+		for col := range roots {
+			if done[col] {
+				continue
+			}
+			if received[col] && next[col].Compare(last[col]) <= 0 {
+				return nil, &LoopError{Oid: next[col], Previous: last[col]}
+			}
+			activeRoots = append(activeRoots, roots[col])
+			activeLast = append(activeLast, next[col])
+		}
+		roots, last = activeRoots, activeLast
+	}
+	return result, nil
+}
+
 func (w WapSNMP) Close() error {
+	if w.session != nil {
+		w.session.close()
+		return nil
+	}
 	return w.conn.Close()
 }
@@ -0,0 +1,511 @@
+package snmp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	usmSecurityModel = 3
+	msgMaxSize       = 65507
+
+	flagAuth       byte = 0x01
+	flagPriv       byte = 0x02
+	flagReportable byte = 0x04
+)
+
+//USM统计OID, 出现在Report PDU中用于说明请求被拒绝的原因
+var (
+	usmStatsUnsupportedSecLevels = MustParseOid("1.3.6.1.6.3.15.1.1.1.0")
+	usmStatsNotInTimeWindows     = MustParseOid("1.3.6.1.6.3.15.1.1.2.0")
+	usmStatsUnknownUserNames     = MustParseOid("1.3.6.1.6.3.15.1.1.3.0")
+	usmStatsUnknownEngineIDs     = MustParseOid("1.3.6.1.6.3.15.1.1.4.0")
+	usmStatsWrongDigests         = MustParseOid("1.3.6.1.6.3.15.1.1.5.0")
+	usmStatsDecryptionErrors     = MustParseOid("1.3.6.1.6.3.15.1.1.6.0")
+)
+
+//v3会话状态: 权威引擎信息与本地化密钥
+type usmState struct {
+	mutex    sync.Mutex
+	params   UsmParams
+	engineID string
+	boots    int64
+	time     int64
+	synced   time.Time //最近一次同步引擎时间的本地时间
+	keys     *usmKeys
+	salt     uint64
+}
+
+func newUsmState(params *UsmParams) *usmState {
+	return &usmState{
+		params: *params,
+		salt:   uint64(rand.Int63()),
+	}
+}
+
+//创建SNMPv3客户端, 权威引擎在首次请求时自动发现
+func NewWapSNMPv3(target string, params *UsmParams, timeout time.Duration, retries int) (*WapSNMP, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	targetPort := targetAddr(target)
+	conn, err := net.DialTimeout("udp", targetPort, timeout)
+	if err != nil {
+		return nil, fmt.Errorf(`error connecting to ("udp", "%s"): %s`, targetPort, err)
+	}
+	return NewWapSNMPv3OnConn(target, params, timeout, retries, conn), nil
+}
+
+//创建自定义连接的SNMPv3客户端
+func NewWapSNMPv3OnConn(target string, params *UsmParams, timeout time.Duration, retries int, conn net.Conn) *WapSNMP {
+	return &WapSNMP{
+		Target:  target,
+		Version: SNMPv3,
+		timeout: timeout,
+		retries: retries,
+		conn:    conn,
+		usm:     newUsmState(params),
+	}
+}
+
+//引擎当前时间的估算值
+func (u *usmState) engineTime() int64 {
+	if u.synced.IsZero() {
+		return u.time
+	}
+	return u.time + int64(time.Since(u.synced)/time.Second)
+}
+
+func (u *usmState) sync(engineID string, boots, engineTime int64) {
+	if engineID != u.engineID || u.keys == nil {
+		u.engineID = engineID
+		u.keys = newUsmKeys(&u.params, engineID)
+	}
+	u.boots = boots
+	u.time = engineTime
+	u.synced = time.Now()
+}
+
+//发现权威引擎的engineID, boots与time (RFC 3414 4)
+func (u *usmState) discover(w WapSNMP) error {
+	msgID := RandomRequestID()
+	req, err := EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, msgID, msgMaxSize, string([]byte{flagReportable}), usmSecurityModel},
+		string(encodeSecParams("", 0, 0, "", "", "")),
+		[]interface{}{Sequence, "", "",
+			[]interface{}{AsnGetRequest, RandomRequestID(), 0, 0, []interface{}{Sequence}}}})
+	if err != nil {
+		return err
+	}
+
+	var msg *v3Message
+	response := make([]byte, w.receiveBufferSize())
+	if _, err := poll(w.conn, req, response, w.retries, w.timeout, msgID, ownsV3(msgID), matchV3(msgID, &msg)); err != nil {
+		return err
+	}
+	if msg.engineID == "" {
+		return fmt.Errorf("usm: engine discovery of %s returned an empty engine ID", w.Target)
+	}
+	u.sync(msg.engineID, msg.boots, msg.time)
+	return nil
+}
+
+//v3请求: 封装scoped PDU, 按安全级别认证与加密, 处理时间窗口并返回响应PDU
+func (u *usmState) exchange(w WapSNMP, pdu []interface{}) ([]interface{}, int, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.keys == nil {
+		if err := u.discover(w); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	//时间窗口外或引擎重启后重新同步并重试一次
+	for attempt := 0; ; attempt++ {
+		req, msgID, err := u.encode(pdu)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var msg *v3Message
+		response := make([]byte, w.receiveBufferSize())
+		numRead, err := poll(w.conn, req, response, w.retries, w.timeout, msgID, ownsV3(msgID), matchV3(msgID, &msg))
+		if err != nil {
+			return nil, 0, err
+		}
+		respPacket, err := u.open(msg)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if respPacket[0] != AsnReport {
+			return respPacket, numRead, nil
+		}
+		reportOid := reportedOid(respPacket)
+		resync := reportOid.Equal(usmStatsNotInTimeWindows) || reportOid.Equal(usmStatsUnknownEngineIDs)
+		if !resync || attempt > 0 {
+			return nil, 0, reportError(reportOid)
+		}
+		u.sync(msg.engineID, msg.boots, msg.time)
+	}
+}
+
+//只根据报文头判断是否为msgID的响应, 报文可以被截断
+func ownsV3(msgID int) func(packet []byte) bool {
+	return func(packet []byte) bool {
+		fields, err := berPrefix(packet, 0, 2)
+		if err != nil || fields[0].tag != byte(AsnInteger) || fields[0].end > len(packet) {
+			return false
+		}
+		version, err := DecodeInteger(packet[fields[0].valueStart:fields[0].end])
+		if err != nil || version != int64(SNMPv3) {
+			return false
+		}
+		global, err := berPrefix(packet, fields[1].start, 1)
+		if err != nil || global[0].tag != byte(AsnInteger) || global[0].end > len(packet) {
+			return false
+		}
+		id, err := DecodeInteger(packet[global[0].valueStart:global[0].end])
+		return err == nil && id == int64(msgID)
+	}
+}
+
+//只接受msgID与请求一致的v3响应, 解析后的报文写入msg
+func matchV3(msgID int, msg **v3Message) func(packet []byte) bool {
+	return func(packet []byte) bool {
+		m, err := parseV3Message(append([]byte{}, packet...))
+		if err != nil || m.msgID != int64(msgID) {
+			return false
+		}
+		*msg = m
+		return true
+	}
+}
+
+//编码v3请求报文, 认证参数在编码完成后回填
+func (u *usmState) encode(pdu []interface{}) ([]byte, int, error) {
+	msgID := RandomRequestID()
+	level := u.params.Level()
+	flags := flagReportable
+	if level >= AuthNoPriv {
+		flags |= flagAuth
+	}
+	if level == AuthPriv {
+		flags |= flagPriv
+	}
+
+	boots, engineTime := u.boots, u.engineTime()
+	scopedPDU := []interface{}{Sequence, u.engineID, u.params.ContextName, pdu}
+
+	var data interface{} = scopedPDU
+	privParams := ""
+	if level == AuthPriv {
+		plain, err := EncodeSequence(scopedPDU)
+		if err != nil {
+			return nil, 0, err
+		}
+		u.salt++
+		encrypted, salt, err := u.keys.encrypt(u.params.PrivProtocol, plain, boots, engineTime, u.salt)
+		if err != nil {
+			return nil, 0, err
+		}
+		data = string(encrypted)
+		privParams = string(salt)
+	}
+
+	authParams := ""
+	if level >= AuthNoPriv {
+		authParams = string(make([]byte, u.params.AuthProtocol.paramLen()))
+	}
+
+	req, err := EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, msgID, msgMaxSize, string([]byte{flags}), usmSecurityModel},
+		string(encodeSecParams(u.engineID, boots, engineTime, u.params.UserName, authParams, privParams)),
+		data})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if level >= AuthNoPriv {
+		start, end, err := authParamsOffset(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		copy(req[start:end], u.keys.authenticate(u.params.AuthProtocol, req))
+	}
+	return req, msgID, nil
+}
+
+//校验并解密v3响应, 返回其中的PDU
+func (u *usmState) open(msg *v3Message) ([]interface{}, error) {
+	if msg.flags&flagAuth != 0 {
+		if u.params.AuthProtocol == NoAuth {
+			return nil, fmt.Errorf("usm: unexpected authenticated response")
+		}
+		if msg.engineID != u.engineID {
+			return nil, fmt.Errorf("usm: response from unknown engine %x", msg.engineID)
+		}
+		start, end, err := authParamsOffset(msg.raw)
+		if err != nil {
+			return nil, err
+		}
+		received := append([]byte{}, msg.raw[start:end]...)
+		zeroed := append([]byte{}, msg.raw...)
+		copy(zeroed[start:end], make([]byte, end-start))
+		if !bytes.Equal(received, u.keys.authenticate(u.params.AuthProtocol, zeroed)) {
+			return nil, fmt.Errorf("usm: response authentication failed")
+		}
+		//已认证的响应可以用来更新引擎时间
+		if msg.boots > u.boots || (msg.boots == u.boots && msg.time > u.time) {
+			u.sync(msg.engineID, msg.boots, msg.time)
+		}
+	} else if u.params.Level() > NoAuthNoPriv {
+		//只有Report PDU允许以低于请求的安全级别返回
+		if pdu, err := msg.scopedPDU(); err != nil || len(pdu) < 4 || !isPDUType(pdu[3], AsnReport) {
+			return nil, fmt.Errorf("usm: unauthenticated response to an authenticated request")
+		}
+	}
+
+	var scoped []interface{}
+	if msg.flags&flagPriv != 0 {
+		encrypted, ok := msg.data.(string)
+		if !ok {
+			return nil, fmt.Errorf("usm: encrypted PDU is not an octet string")
+		}
+		plain, err := u.keys.decrypt(u.params.PrivProtocol, []byte(encrypted), []byte(msg.privParams), msg.boots, msg.time)
+		if err != nil {
+			return nil, err
+		}
+		if scoped, err = decodeScopedPDU(plain); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if scoped, err = msg.scopedPDU(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(scoped) < 4 {
+		return nil, fmt.Errorf("usm: scoped PDU is too short")
+	}
+	respPacket, ok := scoped[3].([]interface{})
+	if !ok || len(respPacket) < 1 {
+		return nil, fmt.Errorf("usm: scoped PDU doesn't contain a PDU")
+	}
+	return respPacket, nil
+}
+
+//解码解密后的scoped PDU; DES会填充到块大小, 按BER长度截断
+func decodeScopedPDU(plain []byte) ([]interface{}, error) {
+	if len(plain) < 2 {
+		return nil, fmt.Errorf("usm: decrypted PDU is too short")
+	}
+	length, lenLen, err := DecodeLength(plain[1:])
+	if err != nil || 1+lenLen+int(length) > len(plain) {
+		return nil, fmt.Errorf("usm: decryption failed, wrong privacy key?")
+	}
+	return DecodeSequence(plain[:1+lenLen+int(length)])
+}
+
+func isPDUType(v interface{}, t BERType) bool {
+	pdu, ok := v.([]interface{})
+	return ok && len(pdu) > 0 && pdu[0] == t
+}
+
+//Report PDU中第一个varbind的OID
+func reportedOid(respPacket []interface{}) Oid {
+	if len(respPacket) < 5 {
+		return nil
+	}
+	varbinds, ok := respPacket[4].([]interface{})
+	if !ok || len(varbinds) < 2 {
+		return nil
+	}
+	varbind, ok := varbinds[1].([]interface{})
+	if !ok || len(varbind) < 2 {
+		return nil
+	}
+	oid, _ := varbind[1].(Oid)
+	return oid
+}
+
+func reportError(oid Oid) error {
+	switch {
+	case oid.Equal(usmStatsUnsupportedSecLevels):
+		return fmt.Errorf("usm: unsupported security level")
+	case oid.Equal(usmStatsNotInTimeWindows):
+		return fmt.Errorf("usm: not in time window")
+	case oid.Equal(usmStatsUnknownUserNames):
+		return fmt.Errorf("usm: unknown user name")
+	case oid.Equal(usmStatsUnknownEngineIDs):
+		return fmt.Errorf("usm: unknown engine ID")
+	case oid.Equal(usmStatsWrongDigests):
+		return fmt.Errorf("usm: wrong digest, check the authentication passphrase")
+	case oid.Equal(usmStatsDecryptionErrors):
+		return fmt.Errorf("usm: decryption error, check the privacy passphrase")
+	}
+	return fmt.Errorf("usm: report received (%s)", oid.String())
+}
+
+//UsmSecurityParameters
+func encodeSecParams(engineID string, boots, engineTime int64, userName, authParams, privParams string) []byte {
+	enc, _ := EncodeSequence([]interface{}{Sequence, engineID, boots, engineTime, userName, authParams, privParams})
+	return enc
+}
+
+//解码后的v3报文
+type v3Message struct {
+	raw        []byte
+	msgID      int64
+	flags      byte
+	engineID   string
+	boots      int64
+	time       int64
+	userName   string
+	privParams string
+	data       interface{} //明文为scoped PDU序列, 密文为字符串
+}
+
+func (m *v3Message) scopedPDU() ([]interface{}, error) {
+	scoped, ok := m.data.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("usm: scoped PDU is not a sequence")
+	}
+	return scoped, nil
+}
+
+func parseV3Message(raw []byte) (*v3Message, error) {
+	decoded, err := DecodeSequence(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < 5 {
+		return nil, fmt.Errorf("usm: message is too short")
+	}
+	if version, ok := decoded[1].(int64); !ok || version != int64(SNMPv3) {
+		return nil, fmt.Errorf("usm: not a SNMPv3 message")
+	}
+	global, ok := decoded[2].([]interface{})
+	if !ok || len(global) < 5 {
+		return nil, fmt.Errorf("usm: invalid msgGlobalData")
+	}
+	msgID, _ := global[1].(int64)
+	flags, _ := global[3].(string)
+	if len(flags) != 1 {
+		return nil, fmt.Errorf("usm: invalid msgFlags")
+	}
+	if model, _ := global[4].(int64); model != usmSecurityModel {
+		return nil, fmt.Errorf("usm: unsupported security model %d", model)
+	}
+
+	secRaw, ok := decoded[3].(string)
+	if !ok {
+		return nil, fmt.Errorf("usm: invalid msgSecurityParameters")
+	}
+	sec, err := DecodeSequence([]byte(secRaw))
+	if err != nil {
+		return nil, err
+	}
+	if len(sec) < 7 {
+		return nil, fmt.Errorf("usm: msgSecurityParameters is too short")
+	}
+
+	m := &v3Message{raw: raw, msgID: msgID, flags: flags[0], data: decoded[4]}
+	m.engineID, _ = sec[1].(string)
+	m.boots, _ = sec[2].(int64)
+	m.time, _ = sec[3].(int64)
+	m.userName, _ = sec[4].(string)
+	m.privParams, _ = sec[6].(string)
+	return m, nil
+}
+
+//定位msgAuthenticationParameters在整个报文中的位置
+func authParamsOffset(msg []byte) (int, int, error) {
+	fields, err := berChildren(msg, 0)
+	if err != nil || len(fields) < 4 {
+		return 0, 0, fmt.Errorf("usm: malformed message")
+	}
+	secFields, err := berChildren(msg, fields[2].valueStart)
+	if err != nil || len(secFields) < 6 {
+		return 0, 0, fmt.Errorf("usm: malformed msgSecurityParameters")
+	}
+	return secFields[4].valueStart, secFields[4].end, nil
+}
+
+//TLV字段位置
+type berField struct {
+	tag        byte
+	start      int
+	valueStart int
+	end        int
+}
+
+//解析b[offset:]处的构造类型TLV的前n个子字段, 用于读取被截断的报文的报文头:
+//构造类型本身和最后一个子字段可以超出b, 调用者使用子字段的值之前需要检查end
+func berPrefix(b []byte, offset int, n int) ([]berField, error) {
+	if offset+2 > len(b) {
+		return nil, fmt.Errorf("tlv out of range")
+	}
+	_, lenLen, err := DecodeLength(b[offset+1:])
+	if err != nil {
+		return nil, err
+	}
+	var fields []berField
+	idx := offset + 1 + lenLen
+	for len(fields) < n {
+		if idx+2 > len(b) {
+			return nil, fmt.Errorf("truncated tlv")
+		}
+		l, ll, err := DecodeLength(b[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(maxDatagramSize) {
+			return nil, fmt.Errorf("tlv length exceeds datagram")
+		}
+		f := berField{tag: b[idx], start: idx, valueStart: idx + 1 + ll, end: idx + 1 + ll + int(l)}
+		fields = append(fields, f)
+		idx = f.end
+	}
+	return fields, nil
+}
+
+//解析b[offset:]处的构造类型TLV, 返回子字段在b中的位置
+func berChildren(b []byte, offset int) ([]berField, error) {
+	if offset+2 > len(b) {
+		return nil, fmt.Errorf("tlv out of range")
+	}
+	length, lenLen, err := DecodeLength(b[offset+1:])
+	if err != nil {
+		return nil, err
+	}
+	end := offset + 1 + lenLen + int(length)
+	if end > len(b) {
+		return nil, fmt.Errorf("tlv length exceeds buffer")
+	}
+
+	var fields []berField
+	idx := offset + 1 + lenLen
+	for idx < end {
+		if idx+2 > end {
+			return nil, fmt.Errorf("truncated tlv")
+		}
+		l, ll, err := DecodeLength(b[idx+1 : end])
+		if err != nil {
+			return nil, err
+		}
+		f := berField{tag: b[idx], start: idx, valueStart: idx + 1 + ll, end: idx + 1 + ll + int(l)}
+		if f.end > end {
+			return nil, fmt.Errorf("tlv length exceeds parent")
+		}
+		fields = append(fields, f)
+		idx = f.end
+	}
+	return fields, nil
+}
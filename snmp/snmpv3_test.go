@@ -0,0 +1,130 @@
+package snmp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//启用v3的模拟器
+func startV3Agent(t *testing.T, user *UsmParams) *Agent {
+	a := startAgent(t, tableValues(30))
+	if err := a.SetUsmUser(user, ""); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func newV3Client(t *testing.T, a *Agent, params *UsmParams) *WapSNMP {
+	w, err := NewWapSNMPv3(a.Addr().String(), params, 200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+//Report的次数
+func reports(a *Agent, oid Oid) Counter {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.usm.reports[oid.String()]
+}
+
+//引擎发现后按各安全级别完成Get与表遍历
+func TestV3RoundTrip(t *testing.T) {
+	users := []UsmParams{
+		{UserName: "noauth"},
+		{UserName: "md5", AuthProtocol: AuthMD5, AuthPassphrase: "md5-passphrase"},
+		{UserName: "sha-aes", AuthProtocol: AuthSHA, AuthPassphrase: "sha-passphrase", PrivProtocol: PrivAES, PrivPassphrase: "aes-passphrase"},
+		{UserName: "md5-des", AuthProtocol: AuthMD5, AuthPassphrase: "md5-passphrase", PrivProtocol: PrivDES, PrivPassphrase: "des-passphrase"},
+		{UserName: "sha256-aes256", AuthProtocol: AuthSHA256, AuthPassphrase: "sha256-passphrase", PrivProtocol: PrivAES256, PrivPassphrase: "aes256-passphrase"},
+	}
+	for _, user := range users {
+		a := startV3Agent(t, &user)
+		w := newV3Client(t, a, &user)
+
+		v, err := w.Get(sysName)
+		if err != nil {
+			t.Fatalf("%s: %s", user.UserName, err)
+		}
+		if v != "switch" {
+			t.Fatalf("%s: sysName = %v", user.UserName, v)
+		}
+		if w.usm.engineID != a.usm.engineID || w.usm.boots != 1 {
+			t.Fatalf("%s: discovered engine %x boots %d", user.UserName, w.usm.engineID, w.usm.boots)
+		}
+		if n := reports(a, usmStatsUnknownEngineIDs); n != 1 {
+			t.Fatalf("%s: %d discovery reports, want 1", user.UserName, n)
+		}
+
+		table, err := w.GetTable(ifHCInOctets)
+		if err != nil {
+			t.Fatalf("%s: %s", user.UserName, err)
+		}
+		checkTable(t, table, ifHCInOctets, 30, 1000)
+	}
+}
+
+//凭据与代理不一致时返回对应的Report错误
+func TestV3Rejected(t *testing.T) {
+	user := UsmParams{UserName: "admin", AuthProtocol: AuthSHA, AuthPassphrase: "auth-passphrase", PrivProtocol: PrivAES, PrivPassphrase: "priv-passphrase"}
+	cases := []struct {
+		name   string
+		params UsmParams
+		report Oid
+	}{
+		{"wrong user", UsmParams{UserName: "guest", AuthProtocol: AuthSHA, AuthPassphrase: "auth-passphrase"}, usmStatsUnknownUserNames},
+		{"wrong auth", UsmParams{UserName: "admin", AuthProtocol: AuthSHA, AuthPassphrase: "wrong-passphrase"}, usmStatsWrongDigests},
+		{"wrong priv", UsmParams{UserName: "admin", AuthProtocol: AuthSHA, AuthPassphrase: "auth-passphrase", PrivProtocol: PrivAES, PrivPassphrase: "wrong-passphrase"}, usmStatsDecryptionErrors},
+	}
+	for _, c := range cases {
+		a := startV3Agent(t, &user)
+		w := newV3Client(t, a, &c.params)
+		_, err := w.Get(sysName)
+		if err == nil || err.Error() != reportError(c.report).Error() {
+			t.Fatalf("%s: error = %v, want %v", c.name, err, reportError(c.report))
+		}
+		if n := reports(a, c.report); n != 1 {
+			t.Fatalf("%s: %d reports, want 1", c.name, n)
+		}
+	}
+
+	//安全级别高于用户的配置
+	a := startV3Agent(t, &UsmParams{UserName: "admin", AuthProtocol: AuthSHA, AuthPassphrase: "auth-passphrase"})
+	w := newV3Client(t, a, &user)
+	if _, err := w.Get(sysName); err == nil || !strings.Contains(err.Error(), "unsupported security level") {
+		t.Fatalf("error = %v, want unsupported security level", err)
+	}
+}
+
+//引擎重启或本地缓存的时间过期后, 收到notInTimeWindow Report重新同步并重试一次
+func TestV3NotInTimeWindow(t *testing.T) {
+	user := UsmParams{UserName: "admin", AuthProtocol: AuthSHA, AuthPassphrase: "auth-passphrase", PrivProtocol: PrivAES, PrivPassphrase: "priv-passphrase"}
+	a := startV3Agent(t, &user)
+	w := newV3Client(t, a, &user)
+	if _, err := w.Get(sysName); err != nil {
+		t.Fatal(err)
+	}
+
+	a.RestartEngine()
+	if v, err := w.Get(sysName); err != nil || v != "switch" {
+		t.Fatalf("after restart: %v, %v", v, err)
+	}
+	if w.usm.boots != 2 {
+		t.Fatalf("boots = %d after restart, want 2", w.usm.boots)
+	}
+
+	//本地估算的引擎时间超出时间窗口
+	w.usm.time -= 2 * usmTimeWindow
+	if v, err := w.Get(sysName); err != nil || v != "switch" {
+		t.Fatalf("after drift: %v, %v", v, err)
+	}
+	if n := reports(a, usmStatsNotInTimeWindows); n != 2 {
+		t.Fatalf("%d notInTimeWindow reports, want 2", n)
+	}
+	//发现1次, 每次Get 1次, 重新同步后的重试2次
+	if n := a.Requests(); n != 6 {
+		t.Fatalf("%d requests, want 6", n)
+	}
+}
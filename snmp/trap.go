@@ -0,0 +1,310 @@
+package snmp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//标准trap的snmpTrapOID (RFC 3418)
+var (
+	snmpTrapOID      = MustParseOid("1.3.6.1.6.3.1.1.4.1.0")
+	sysUpTimeOID     = MustParseOid("1.3.6.1.2.1.1.3.0")
+	standardTraps    = MustParseOid("1.3.6.1.6.3.1.1.5")
+	genericTrapNames = []string{
+		"coldStart",
+		"warmStart",
+		"linkDown",
+		"linkUp",
+		"authenticationFailure",
+		"egpNeighborLoss",
+		"enterpriseSpecific",
+	}
+)
+
+//接收到的trap/inform事件
+type Trap struct {
+	Source       string
+	Version      SNMPVersion
+	Community    string
+	Type         BERType //AsnTrapV1, AsnTrapV2 或 AsnInform
+	RequestID    int64
+	Enterprise   Oid    //仅v1
+	AgentAddr    net.IP //仅v1
+	GenericTrap  int    //仅v1
+	SpecificTrap int    //仅v1
+	Uptime       time.Duration
+	TrapOid      Oid
+	Name         string //coldStart, linkDown, linkUp 等, 非标准trap为空
+	Varbinds     []SNMPValue
+}
+
+//trap处理回调
+type TrapHandler func(trap *Trap)
+
+//trap处理协程数和队列长度的默认值
+const (
+	defaultTrapWorkers   = 4
+	defaultTrapQueueSize = 1024
+)
+
+//trap/inform接收器: 读取报文的协程只负责解码和回复inform, 回调由Workers个协程从队列中取出执行,
+//回调较慢(例如每个trap一次HTTP请求)时不会阻塞读取; 队列满时丢弃trap并计数
+type TrapListener struct {
+	Handler      TrapHandler
+	ErrorHandler func(source string, err error) //报文解析失败时回调, 可为空
+	Workers      int                            //执行回调的协程数, 不大于0时为4
+	QueueSize    int                            //等待执行回调的trap数上限, 不大于0时为1024
+	mutex        sync.Mutex
+	conn         *net.UDPConn
+	closed       bool
+	dropped      uint64
+}
+
+func NewTrapListener(handler TrapHandler) *TrapListener {
+	return &TrapListener{Handler: handler}
+}
+
+//监听UDP地址(例如 ":162")并阻塞处理接收到的报文, Close后等待队列中的trap处理完成再返回
+func (t *TrapListener) Listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf(`error listening on ("udp", "%s"): %s`, addr, err)
+	}
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		return conn.Close()
+	}
+	t.conn = conn
+	t.mutex.Unlock()
+
+	workers := t.Workers
+	if workers <= 0 {
+		workers = defaultTrapWorkers
+	}
+	queueSize := t.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultTrapQueueSize
+	}
+	queue := make(chan *Trap, queueSize)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for trap := range queue {
+				if t.Handler != nil {
+					t.Handler(trap)
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(queue)
+		wg.Wait()
+	}()
+
+	buf := make([]byte, bufSize)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if t.isClosed() {
+				return nil
+			}
+			return err
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		trap, err := t.handlePacket(packet, remote)
+		if err != nil {
+			if t.ErrorHandler != nil {
+				t.ErrorHandler(remote.String(), err)
+			}
+			continue
+		}
+		select {
+		case queue <- trap:
+		default:
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+}
+
+//队列满时丢弃的trap数
+func (t *TrapListener) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+func (t *TrapListener) isClosed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.closed
+}
+
+//停止接收, 可以在Listen之前调用
+func (t *TrapListener) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.Close()
+}
+
+//解码报文, inform需要回复Response PDU
+func (t *TrapListener) handlePacket(packet []byte, remote *net.UDPAddr) (*Trap, error) {
+	trap, err := DecodeTrap(packet)
+	if err != nil {
+		return nil, err
+	}
+	trap.Source = remote.IP.String()
+	if trap.Type == AsnInform {
+		resp, err := informResponse(packet)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.conn.WriteToUDP(resp, remote); err != nil {
+			return nil, fmt.Errorf("inform acknowledgement to %s failed: %v", remote, err)
+		}
+	}
+	return trap, nil
+}
+
+//解码v1 trap, v2c trap与inform报文
+func DecodeTrap(packet []byte) (*Trap, error) {
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < 4 {
+		return nil, fmt.Errorf("trap message is too short")
+	}
+	version, ok := decoded[1].(int64)
+	if !ok || (version != int64(SNMPv1) && version != int64(SNMPv2c)) {
+		return nil, fmt.Errorf("unsupported trap version %v", decoded[1])
+	}
+	community, _ := decoded[2].(string)
+	pdu, ok := decoded[3].([]interface{})
+	if !ok || len(pdu) < 1 {
+		return nil, fmt.Errorf("trap message doesn't contain a PDU")
+	}
+
+	trap := &Trap{
+		Version:   SNMPVersion(version),
+		Community: community,
+	}
+	switch pdu[0] {
+	case AsnTrapV1:
+		err = trap.decodeV1(pdu)
+	case AsnTrapV2, AsnInform:
+		err = trap.decodeV2(pdu)
+	default:
+		err = fmt.Errorf("unexpected PDU type 0x%x", pdu[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return trap, nil
+}
+
+//Trap-PDU: enterprise, agent-addr, generic-trap, specific-trap, time-stamp, variable-bindings
+func (trap *Trap) decodeV1(pdu []interface{}) error {
+	if len(pdu) < 7 {
+		return fmt.Errorf("v1 trap PDU is too short")
+	}
+	trap.Type = AsnTrapV1
+	trap.Enterprise, _ = pdu[1].(Oid)
+	trap.AgentAddr, _ = pdu[2].(net.IP)
+	generic, _ := pdu[3].(int64)
+	specific, _ := pdu[4].(int64)
+	trap.GenericTrap = int(generic)
+	trap.SpecificTrap = int(specific)
+	trap.Uptime, _ = pdu[5].(time.Duration)
+
+	//按RFC 3584 3.1转换为v2的snmpTrapOID
+	if trap.GenericTrap >= 0 && trap.GenericTrap < 6 {
+		trap.TrapOid = append(standardTraps.Copy(), trap.GenericTrap+1)
+	} else {
+		trap.TrapOid = append(trap.Enterprise.Copy(), 0, trap.SpecificTrap)
+	}
+	if trap.GenericTrap >= 0 && trap.GenericTrap < len(genericTrapNames) {
+		trap.Name = genericTrapNames[trap.GenericTrap]
+	}
+
+	varbinds, err := decodeVarbinds(pdu[6])
+	if err != nil {
+		return err
+	}
+	trap.Varbinds = varbinds
+	return nil
+}
+
+//SNMPv2-Trap-PDU / InformRequest-PDU: request-id, 0, 0, variable-bindings(sysUpTime.0, snmpTrapOID.0, ...)
+func (trap *Trap) decodeV2(pdu []interface{}) error {
+	if len(pdu) < 5 {
+		return fmt.Errorf("v2 trap PDU is too short")
+	}
+	trap.Type = pdu[0].(BERType)
+	trap.RequestID, _ = pdu[1].(int64)
+	varbinds, err := decodeVarbinds(pdu[4])
+	if err != nil {
+		return err
+	}
+	trap.Varbinds = varbinds
+	for _, v := range varbinds {
+		if v.Oid.Equal(sysUpTimeOID) {
+			trap.Uptime, _ = v.Value.(time.Duration)
+		} else if v.Oid.Equal(snmpTrapOID) {
+			trap.TrapOid, _ = v.Value.(Oid)
+		}
+	}
+	if trap.TrapOid == nil {
+		return fmt.Errorf("trap doesn't contain snmpTrapOID.0")
+	}
+	if len(trap.TrapOid) == len(standardTraps)+1 && trap.TrapOid.Within(standardTraps) {
+		if generic := trap.TrapOid[len(standardTraps)] - 1; generic >= 0 && generic < 6 {
+			trap.Name = genericTrapNames[generic]
+		}
+	}
+	return nil
+}
+
+func decodeVarbinds(raw interface{}) ([]SNMPValue, error) {
+	varbinds, ok := raw.([]interface{})
+	if !ok || len(varbinds) < 1 {
+		return nil, fmt.Errorf("invalid variable-bindings")
+	}
+	result := make([]SNMPValue, 0, len(varbinds)-1)
+	for _, v := range varbinds[1:] { // First element is just a sequence
+		varbind, ok := v.([]interface{})
+		if !ok || len(varbind) < 3 {
+			return nil, fmt.Errorf("invalid variable-binding")
+		}
+		oid, ok := varbind[1].(Oid)
+		if !ok {
+			return nil, fmt.Errorf("variable-binding name is not an oid")
+		}
+		result = append(result, SNMPValue{oid, varbind[2]})
+	}
+	return result, nil
+}
+
+//inform的应答: 除PDU类型外与请求完全一致(相同的request-id与varbinds, error-status为0)
+func informResponse(packet []byte) ([]byte, error) {
+	fields, err := berChildren(packet, 0)
+	if err != nil || len(fields) < 3 {
+		return nil, fmt.Errorf("malformed inform message")
+	}
+	resp := make([]byte, len(packet))
+	copy(resp, packet)
+	resp[fields[2].start] = byte(AsnGetResponse)
+	return resp, nil
+}
@@ -0,0 +1,215 @@
+package snmp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+//手工编码的报文, 与编码器无关
+const (
+	//v1 linkDown: enterprise 1.3.6.1.4.1.9.1.1, agent-addr 10.0.0.1, time-stamp 12345, ifIndex.3 = 3
+	v1TrapFixture = "303a02010004067075626c6963a42d06082b0601040109010140040a000001020102020100430230393011300f060a2b060102010202010103020103"
+	//v1 enterpriseSpecific 17, 没有varbind
+	v1SpecificTrapFixture = "302902010004067075626c6963a41c06082b0601040109010140040a000001020106020111430230393000"
+	//v2c linkUp: request-id 1234, sysUpTime.0 = 500, ifIndex.3 = 3
+	v2TrapFixture = "305302010104067075626c6963a746020204d2020100020100303a300e06082b06010201010300430201f43017060a2b060106030101040100" +
+		"06092b0601060301010504300f060a2b060102010202010103020103"
+	//inform: request-id 99, snmpTrapOID.0 = 1.3.6.1.4.1.9.9.41.2.0.1
+	informFixture = "305402010104067075626c6963a647020163020100020100303c300e06082b06010201010300430201f43019060a2b060106030101040100" +
+		"060b2b06010401090929020001300f060a2b060102010202010103020103"
+	//inform的应答: 只有PDU类型变为GetResponse
+	informAckFixture = "305402010104067075626c6963a247020163020100020100303c300e06082b06010201010300430201f43019060a2b060106030101040100" +
+		"060b2b06010401090929020001300f060a2b060102010202010103020103"
+)
+
+var ifIndex3 = MustParseOid("1.3.6.1.2.1.2.2.1.1.3")
+
+func decodeFixture(t *testing.T, fixture string) *Trap {
+	t.Helper()
+	trap, err := DecodeTrap(mustHex(t, fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trap
+}
+
+func checkVarbind(t *testing.T, v SNMPValue, oid Oid, value interface{}) {
+	t.Helper()
+	if !v.Oid.Equal(oid) || v.Value != value {
+		t.Fatalf("varbind %s = %v, want %s = %v", v.Oid.String(), v.Value, oid.String(), value)
+	}
+}
+
+//v1 trap按RFC 3584 3.1转换为snmpTrapOID
+func TestDecodeTrapV1(t *testing.T) {
+	trap := decodeFixture(t, v1TrapFixture)
+	if trap.Version != SNMPv1 || trap.Type != AsnTrapV1 || trap.Community != "public" {
+		t.Fatalf("trap %+v", trap)
+	}
+	if trap.Enterprise.String() != ".1.3.6.1.4.1.9.1.1" || !trap.AgentAddr.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("enterprise %s agent-addr %s", trap.Enterprise.String(), trap.AgentAddr)
+	}
+	if trap.GenericTrap != 2 || trap.SpecificTrap != 0 || trap.Uptime != 123450*time.Millisecond {
+		t.Fatalf("generic %d specific %d uptime %s", trap.GenericTrap, trap.SpecificTrap, trap.Uptime)
+	}
+	if trap.TrapOid.String() != ".1.3.6.1.6.3.1.1.5.3" || trap.Name != "linkDown" {
+		t.Fatalf("trap oid %s name %s", trap.TrapOid.String(), trap.Name)
+	}
+	if len(trap.Varbinds) != 1 {
+		t.Fatalf("%d varbinds", len(trap.Varbinds))
+	}
+	checkVarbind(t, trap.Varbinds[0], ifIndex3, int64(3))
+
+	//企业自定义trap: enterprise.0.specific-trap
+	trap = decodeFixture(t, v1SpecificTrapFixture)
+	if trap.TrapOid.String() != ".1.3.6.1.4.1.9.1.1.0.17" || trap.Name != "enterpriseSpecific" || len(trap.Varbinds) != 0 {
+		t.Fatalf("trap oid %s name %s, %d varbinds", trap.TrapOid.String(), trap.Name, len(trap.Varbinds))
+	}
+}
+
+func TestDecodeTrapV2(t *testing.T) {
+	trap := decodeFixture(t, v2TrapFixture)
+	if trap.Version != SNMPv2c || trap.Type != AsnTrapV2 || trap.RequestID != 1234 {
+		t.Fatalf("trap %+v", trap)
+	}
+	if trap.Uptime != 5*time.Second || trap.TrapOid.String() != ".1.3.6.1.6.3.1.1.5.4" || trap.Name != "linkUp" {
+		t.Fatalf("uptime %s trap oid %s name %s", trap.Uptime, trap.TrapOid.String(), trap.Name)
+	}
+	if len(trap.Varbinds) != 3 {
+		t.Fatalf("%d varbinds", len(trap.Varbinds))
+	}
+	checkVarbind(t, trap.Varbinds[2], ifIndex3, int64(3))
+
+	inform := decodeFixture(t, informFixture)
+	if inform.Type != AsnInform || inform.RequestID != 99 || inform.TrapOid.String() != ".1.3.6.1.4.1.9.9.41.2.0.1" || inform.Name != "" {
+		t.Fatalf("inform %+v", inform)
+	}
+}
+
+func TestDecodeTrapErrors(t *testing.T) {
+	//GetRequest, v3报文和缺少snmpTrapOID.0的v2 trap
+	getRequest, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetRequest, 1, 0, 0, []interface{}{Sequence}}})
+	v3, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv3), "public",
+		[]interface{}{AsnTrapV2, 1, 0, 0, []interface{}{Sequence}}})
+	noTrapOid, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnTrapV2, 1, 0, 0, []interface{}{Sequence, []interface{}{Sequence, sysUpTimeOID, time.Second}}}})
+	for i, packet := range [][]byte{getRequest, v3, noTrapOid, mustHex(t, v2TrapFixture)[:40]} {
+		if _, err := DecodeTrap(packet); err == nil {
+			t.Fatalf("packet %d: expected an error", i)
+		}
+	}
+}
+
+//编码器输出与手工编码的报文一致
+func TestEncodeTrap(t *testing.T) {
+	varbinds := []interface{}{Sequence,
+		[]interface{}{Sequence, sysUpTimeOID, 5 * time.Second},
+		[]interface{}{Sequence, snmpTrapOID, MustParseOid("1.3.6.1.6.3.1.1.5.4")},
+		[]interface{}{Sequence, ifIndex3, 3}}
+	v2, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public", []interface{}{AsnTrapV2, 1234, 0, 0, varbinds}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v2, mustHex(t, v2TrapFixture)) {
+		t.Fatalf("v2 trap %x", v2)
+	}
+
+	v1, err := EncodeSequence([]interface{}{Sequence, int(SNMPv1), "public", []interface{}{AsnTrapV1,
+		MustParseOid("1.3.6.1.4.1.9.1.1"), net.IPv4(10, 0, 0, 1), 2, 0, 123450 * time.Millisecond,
+		[]interface{}{Sequence, []interface{}{Sequence, ifIndex3, 3}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v1, mustHex(t, v1TrapFixture)) {
+		t.Fatalf("v1 trap %x", v1)
+	}
+}
+
+//inform的应答只改写PDU类型
+func TestInformResponse(t *testing.T) {
+	resp, err := informResponse(mustHex(t, informFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, mustHex(t, informAckFixture)) {
+		t.Fatalf("ack %x", resp)
+	}
+	if _, err := informResponse([]byte{0x30, 0x03, 0x02, 0x01, 0x01}); err == nil {
+		t.Fatal("expected an error for a message without a PDU")
+	}
+}
+
+//接收器回复inform并把trap交给回调, 无法解析的报文交给ErrorHandler
+func TestTrapListener(t *testing.T) {
+	received := make(chan *Trap, 3)
+	failures := make(chan error, 1)
+	l := NewTrapListener(func(trap *Trap) { received <- trap })
+	l.ErrorHandler = func(source string, err error) { failures <- err }
+	done := make(chan error, 1)
+	go func() { done <- l.Listen("127.0.0.1:0") }()
+	defer func() {
+		l.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var addr net.Addr
+	for i := 0; addr == nil && i < 100; i++ {
+		l.mutex.Lock()
+		if l.conn != nil {
+			addr = l.conn.LocalAddr()
+		}
+		l.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr == nil {
+		t.Fatal("listener didn't start")
+	}
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, fixture := range []string{v1TrapFixture, v2TrapFixture, informFixture} {
+		if _, err := conn.Write(mustHex(t, fixture)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	ack := make([]byte, bufSize)
+	n, err := conn.Read(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ack[:n], mustHex(t, informAckFixture)) {
+		t.Fatalf("ack %x", ack[:n])
+	}
+
+	names := map[BERType]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case trap := <-received:
+			if trap.Source != "127.0.0.1" {
+				t.Fatalf("source %s", trap.Source)
+			}
+			names[trap.Type] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d traps, want 3", i)
+		}
+	}
+	if !names[AsnTrapV1] || !names[AsnTrapV2] || !names[AsnInform] {
+		t.Fatalf("received types %v", names)
+	}
+
+	conn.Write([]byte{0x30, 0x00})
+	select {
+	case <-failures:
+	case <-time.After(2 * time.Second):
+		t.Fatal("malformed packet not reported")
+	}
+}
@@ -0,0 +1,342 @@
+package snmp
+
+/* This file implements the crypto parts of the SNMPv3 User-based Security
+Model (USM).
+
+References : RFC 3414 (USM, HMAC-MD5-96 / HMAC-SHA-96, CBC-DES),
+RFC 3826 (CFB128-AES-128), RFC 7860 (HMAC-SHA-2) and
+draft-blumenthal-aes-usm-04 for the AES-192/AES-256 key extension.
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// AuthProtocol is the USM authentication protocol.
+type AuthProtocol uint8
+
+// PrivProtocol is the USM privacy protocol.
+type PrivProtocol uint8
+
+// SecurityLevel is the USM security level derived from the protocols in use.
+type SecurityLevel uint8
+
+// Supported authentication protocols.
+const (
+	NoAuth AuthProtocol = iota
+	AuthMD5
+	AuthSHA
+	AuthSHA224
+	AuthSHA256
+	AuthSHA384
+	AuthSHA512
+)
+
+// Supported privacy protocols.
+const (
+	NoPriv PrivProtocol = iota
+	PrivDES
+	PrivAES
+	PrivAES192
+	PrivAES256
+)
+
+// Security levels.
+const (
+	NoAuthNoPriv SecurityLevel = iota
+	AuthNoPriv
+	AuthPriv
+)
+
+// UsmParams holds the USM credentials of a SNMPv3 user.
+type UsmParams struct {
+	UserName       string
+	AuthProtocol   AuthProtocol
+	AuthPassphrase string
+	PrivProtocol   PrivProtocol
+	PrivPassphrase string
+	ContextName    string
+}
+
+// Level returns the security level implied by the configured protocols.
+func (p *UsmParams) Level() SecurityLevel {
+	if p.AuthProtocol == NoAuth {
+		return NoAuthNoPriv
+	}
+	if p.PrivProtocol == NoPriv {
+		return AuthNoPriv
+	}
+	return AuthPriv
+}
+
+// Validate checks that the parameters describe a usable USM user.
+func (p *UsmParams) Validate() error {
+	if p.UserName == "" {
+		return fmt.Errorf("usm: user name is empty")
+	}
+	if p.AuthProtocol == NoAuth && p.PrivProtocol != NoPriv {
+		return fmt.Errorf("usm: privacy requires an authentication protocol")
+	}
+	if p.AuthProtocol != NoAuth && p.AuthPassphrase == "" {
+		return fmt.Errorf("usm: authentication passphrase is empty")
+	}
+	if p.PrivProtocol != NoPriv && p.PrivPassphrase == "" {
+		return fmt.Errorf("usm: privacy passphrase is empty")
+	}
+	return nil
+}
+
+// ParseAuthProtocol converts a protocol name such as "md5" or "sha256" to an AuthProtocol.
+// An empty name means no authentication.
+func ParseAuthProtocol(name string) (AuthProtocol, error) {
+	switch strings.ToLower(strings.Replace(name, "-", "", -1)) {
+	case "", "none", "noauth":
+		return NoAuth, nil
+	case "md5":
+		return AuthMD5, nil
+	case "sha", "sha1":
+		return AuthSHA, nil
+	case "sha224":
+		return AuthSHA224, nil
+	case "sha256":
+		return AuthSHA256, nil
+	case "sha384":
+		return AuthSHA384, nil
+	case "sha512":
+		return AuthSHA512, nil
+	}
+	return NoAuth, fmt.Errorf("usm: unknown authentication protocol %q", name)
+}
+
+// ParsePrivProtocol converts a protocol name such as "des" or "aes" to a PrivProtocol.
+// An empty name means no privacy.
+func ParsePrivProtocol(name string) (PrivProtocol, error) {
+	switch strings.ToLower(strings.Replace(name, "-", "", -1)) {
+	case "", "none", "nopriv":
+		return NoPriv, nil
+	case "des":
+		return PrivDES, nil
+	case "aes", "aes128":
+		return PrivAES, nil
+	case "aes192":
+		return PrivAES192, nil
+	case "aes256":
+		return PrivAES256, nil
+	}
+	return NoPriv, fmt.Errorf("usm: unknown privacy protocol %q", name)
+}
+
+func (a AuthProtocol) newHash() hash.Hash {
+	switch a {
+	case AuthMD5:
+		return md5.New()
+	case AuthSHA:
+		return sha1.New()
+	case AuthSHA224:
+		return sha256.New224()
+	case AuthSHA256:
+		return sha256.New()
+	case AuthSHA384:
+		return sha512.New384()
+	case AuthSHA512:
+		return sha512.New()
+	}
+	return nil
+}
+
+// paramLen is the length of the truncated HMAC carried in msgAuthenticationParameters.
+func (a AuthProtocol) paramLen() int {
+	switch a {
+	case AuthMD5, AuthSHA:
+		return 12
+	case AuthSHA224:
+		return 16
+	case AuthSHA256:
+		return 24
+	case AuthSHA384:
+		return 32
+	case AuthSHA512:
+		return 48
+	}
+	return 0
+}
+
+func (p PrivProtocol) keyLen() int {
+	switch p {
+	case PrivDES, PrivAES:
+		return 16
+	case PrivAES192:
+		return 24
+	case PrivAES256:
+		return 32
+	}
+	return 0
+}
+
+// Ku is expensive to compute (1MB of hashing), cache it per protocol and passphrase.
+var (
+	kuMutex sync.Mutex
+	kuCache = make(map[string][]byte)
+)
+
+// passwordToKey implements the password to key algorithm of RFC 3414 A.2.
+func passwordToKey(a AuthProtocol, password string) []byte {
+	cacheKey := fmt.Sprintf("%d:%s", a, password)
+	kuMutex.Lock()
+	defer kuMutex.Unlock()
+	if ku, ok := kuCache[cacheKey]; ok {
+		return ku
+	}
+
+	h := a.newHash()
+	pw := []byte(password)
+	buf := make([]byte, 64)
+	idx := 0
+	for count := 0; count < 1048576; count += 64 {
+		for i := range buf {
+			buf[i] = pw[idx%len(pw)]
+			idx++
+		}
+		h.Write(buf)
+	}
+	ku := h.Sum(nil)
+	kuCache[cacheKey] = ku
+	return ku
+}
+
+// localizeKey binds a key to an authoritative engine: H(Ku || engineID || Ku).
+func localizeKey(a AuthProtocol, ku []byte, engineID string) []byte {
+	h := a.newHash()
+	h.Write(ku)
+	h.Write([]byte(engineID))
+	h.Write(ku)
+	return h.Sum(nil)
+}
+
+// extendKey stretches a localized key to the length needed by AES-192/256 (Blumenthal).
+func extendKey(a AuthProtocol, key []byte, length int) []byte {
+	result := append([]byte{}, key...)
+	for len(result) < length {
+		h := a.newHash()
+		h.Write(result)
+		result = append(result, h.Sum(nil)...)
+	}
+	return result[:length]
+}
+
+// usmKeys are the localized keys for one user at one authoritative engine.
+type usmKeys struct {
+	auth []byte
+	priv []byte
+}
+
+func newUsmKeys(p *UsmParams, engineID string) *usmKeys {
+	keys := &usmKeys{}
+	if p.AuthProtocol == NoAuth {
+		return keys
+	}
+	keys.auth = localizeKey(p.AuthProtocol, passwordToKey(p.AuthProtocol, p.AuthPassphrase), engineID)
+	if p.PrivProtocol == NoPriv {
+		return keys
+	}
+	priv := localizeKey(p.AuthProtocol, passwordToKey(p.AuthProtocol, p.PrivPassphrase), engineID)
+	if len(priv) < p.PrivProtocol.keyLen() {
+		priv = extendKey(p.AuthProtocol, priv, p.PrivProtocol.keyLen())
+	}
+	keys.priv = priv[:p.PrivProtocol.keyLen()]
+	return keys
+}
+
+// authenticate computes the truncated HMAC of a whole message.
+func (k *usmKeys) authenticate(a AuthProtocol, msg []byte) []byte {
+	mac := hmac.New(a.newHash, k.auth)
+	mac.Write(msg)
+	return mac.Sum(nil)[:a.paramLen()]
+}
+
+// encrypt encrypts a scoped PDU and returns the ciphertext and msgPrivacyParameters.
+func (k *usmKeys) encrypt(p PrivProtocol, plain []byte, boots, engineTime int64, salt uint64) ([]byte, []byte, error) {
+	privParams := make([]byte, 8)
+	switch p {
+	case PrivDES:
+		binary.BigEndian.PutUint32(privParams[:4], uint32(boots))
+		binary.BigEndian.PutUint32(privParams[4:], uint32(salt))
+		block, err := des.NewCipher(k.priv[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = k.priv[8+i] ^ privParams[i]
+		}
+		if pad := len(plain) % des.BlockSize; pad != 0 {
+			plain = append(plain, make([]byte, des.BlockSize-pad)...)
+		}
+		ciphertext := make([]byte, len(plain))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plain)
+		return ciphertext, privParams, nil
+	case PrivAES, PrivAES192, PrivAES256:
+		binary.BigEndian.PutUint64(privParams, salt)
+		block, err := aes.NewCipher(k.priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		ciphertext := make([]byte, len(plain))
+		cipher.NewCFBEncrypter(block, aesIV(boots, engineTime, privParams)).XORKeyStream(ciphertext, plain)
+		return ciphertext, privParams, nil
+	}
+	return nil, nil, fmt.Errorf("usm: unsupported privacy protocol %d", p)
+}
+
+// decrypt decrypts an encryptedPDU using the boots/time of the received message.
+func (k *usmKeys) decrypt(p PrivProtocol, ciphertext, privParams []byte, boots, engineTime int64) ([]byte, error) {
+	if len(privParams) != 8 {
+		return nil, fmt.Errorf("usm: invalid privacy parameters length %d", len(privParams))
+	}
+	switch p {
+	case PrivDES:
+		if len(ciphertext)%des.BlockSize != 0 {
+			return nil, fmt.Errorf("usm: DES ciphertext is not a multiple of the block size")
+		}
+		block, err := des.NewCipher(k.priv[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = k.priv[8+i] ^ privParams[i]
+		}
+		plain := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+		return plain, nil
+	case PrivAES, PrivAES192, PrivAES256:
+		block, err := aes.NewCipher(k.priv)
+		if err != nil {
+			return nil, err
+		}
+		plain := make([]byte, len(ciphertext))
+		cipher.NewCFBDecrypter(block, aesIV(boots, engineTime, privParams)).XORKeyStream(plain, ciphertext)
+		return plain, nil
+	}
+	return nil, fmt.Errorf("usm: unsupported privacy protocol %d", p)
+}
+
+func aesIV(boots, engineTime int64, privParams []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv[:4], uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:8], uint32(engineTime))
+	copy(iv[8:], privParams)
+	return iv
+}
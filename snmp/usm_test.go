@@ -0,0 +1,110 @@
+package snmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//RFC 3414 A.3.1/A.3.2 与 RFC 7860 A.2 的密钥本地化向量
+func TestLocalizeKey(t *testing.T) {
+	engineID := string([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2})
+	cases := []struct {
+		auth AuthProtocol
+		ku   string
+		kul  string
+	}{
+		{AuthMD5, "9faf3283884e92834ebc9847d8edd963", "526f5eed9fcce26f8964c2930787d82b"},
+		{AuthSHA, "9fb5cc0381497b3793528939ff788d5d79145211", "6695febc9288e36282235fc7151f128497b38f3f"},
+		{AuthSHA256, "ab51014d1e077f6017df2b12bee5f5aa72993177e9bb569c4dff5a4ca0b4afac",
+			"8982e0e549e866db361a6b625d84cccc11162d453ee8ce3a6445c2d6776f0f8b"},
+	}
+	for _, c := range cases {
+		ku := passwordToKey(c.auth, "maplesyrup")
+		if !bytes.Equal(ku, mustHex(t, c.ku)) {
+			t.Errorf("auth %d: Ku = %x, want %s", c.auth, ku, c.ku)
+		}
+		kul := localizeKey(c.auth, ku, engineID)
+		if !bytes.Equal(kul, mustHex(t, c.kul)) {
+			t.Errorf("auth %d: Kul = %x, want %s", c.auth, kul, c.kul)
+		}
+	}
+}
+
+//FIPS 81 的DES-CBC向量: IV为预IV与msgPrivacyParameters(boots, salt均为0)的异或
+func TestEncryptDES(t *testing.T) {
+	keys := &usmKeys{priv: mustHex(t, "0123456789abcdef1234567890abcdef")}
+	plain := []byte("Now is the time for all ")
+	want := mustHex(t, "e5c7cdde872bf27c43e934008c389c0f683788499a7c05f6")
+
+	ciphertext, privParams, err := keys.encrypt(PrivDES, append([]byte{}, plain...), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ciphertext, want) {
+		t.Fatalf("ciphertext = %x, want %x", ciphertext, want)
+	}
+	decrypted, err := keys.decrypt(PrivDES, ciphertext, privParams, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Fatalf("decrypted = %q, want %q", decrypted, plain)
+	}
+}
+
+//NIST SP 800-38A F.3.13/F.3.17 的AES-CFB128向量: IV为 boots|engineTime|salt
+func TestEncryptAES(t *testing.T) {
+	cases := []struct {
+		priv PrivProtocol
+		key  string
+		want string
+	}{
+		{PrivAES, "2b7e151628aed2a6abf7158809cf4f3c", "3b3fd92eb72dad20333449f8e83cfb4a"},
+		{PrivAES256, "603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4", "dc7e84bfda79164b7ecd8486985d3860"},
+	}
+	plain := mustHex(t, "6bc1bee22e409f96e93d7e117393172a")
+	for _, c := range cases {
+		keys := &usmKeys{priv: mustHex(t, c.key)}
+		ciphertext, privParams, err := keys.encrypt(c.priv, plain, 0x00010203, 0x04050607, 0x08090a0b0c0d0e0f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ciphertext, mustHex(t, c.want)) {
+			t.Errorf("priv %d: ciphertext = %x, want %s", c.priv, ciphertext, c.want)
+		}
+		decrypted, err := keys.decrypt(c.priv, ciphertext, privParams, 0x00010203, 0x04050607)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plain) {
+			t.Errorf("priv %d: decrypted = %x, want %x", c.priv, decrypted, plain)
+		}
+	}
+}
+
+//AES-256需要的密钥长度超过SHA-1的摘要长度, 按Blumenthal方法扩展
+func TestNewUsmKeysExtendsPrivKey(t *testing.T) {
+	keys := newUsmKeys(&UsmParams{
+		UserName:       "user",
+		AuthProtocol:   AuthSHA,
+		AuthPassphrase: "maplesyrup",
+		PrivProtocol:   PrivAES256,
+		PrivPassphrase: "maplesyrup",
+	}, string([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}))
+	kul := mustHex(t, "6695febc9288e36282235fc7151f128497b38f3f")
+	if len(keys.priv) != 32 || !bytes.Equal(keys.priv[:20], kul) {
+		t.Fatalf("priv key = %x", keys.priv)
+	}
+	if !bytes.Equal(keys.auth, kul) {
+		t.Fatalf("auth key = %x", keys.auth)
+	}
+}
@@ -0,0 +1,101 @@
+package snmp
+
+import (
+	"fmt"
+)
+
+//遍历时设备返回的oid没有递增(设备实现错误), 继续请求会死循环
+type LoopError struct {
+	Oid      Oid //本次返回的oid
+	Previous Oid //上一次请求的oid
+}
+
+func (e *LoopError) Error() string {
+	return fmt.Sprintf("oid not increasing: %s after %s", e.Oid.String(), e.Previous.String())
+}
+
+//GetBulk失败时是否改用GetNext: 设备回复了错误(tooBig除外), 或者第一个GetBulk请求超时(有的设备直接丢弃GetBulk请求);
+//只接受v1报文的设备同样会丢弃v2c的GetNext请求, 需要在配置中设置版本为v1
+func bulkFailed(err error, first bool) bool {
+	switch e := err.(type) {
+	case *ResponseError:
+		return e.Status != TooBig
+	case *RequestError:
+		return first && e.Timeout()
+	}
+	return false
+}
+
+//一个GetNext请求获取多个oid的下一个值, v1也支持
+func (w WapSNMP) getNext(oids []Oid) (*Response, error) {
+	requestID := RandomRequestID()
+
+	varbinds := []interface{}{Sequence}
+	for _, oid := range oids {
+		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
+	}
+	return w.request([]interface{}{AsnGetNextRequest, requestID, 0, 0, varbinds})
+}
+
+//使用GetNext遍历表
+func (w WapSNMP) walkTable(oid Oid) (map[string]interface{}, error) {
+	tables, err := w.walkTables([]Oid{oid})
+	if err != nil {
+		return nil, err
+	}
+	return tables[oid.String()], nil
+}
+
+//使用GetNext同时遍历多个表(列), 每个请求包含全部未遍历完的列
+func (w WapSNMP) walkTables(oids []Oid) (map[string]map[string]interface{}, error) {
+	result := make(map[string]map[string]interface{})
+	roots := []Oid{}
+	last := []Oid{}
+	for _, oid := range oids {
+		if _, ok := result[oid.String()]; ok {
+			continue
+		}
+		result[oid.String()] = make(map[string]interface{})
+		roots = append(roots, oid)
+		last = append(last, oid.Copy())
+	}
+
+	for len(roots) > 0 {
+		resp, err := w.getNext(last)
+		if e, ok := err.(*ResponseError); ok && e.Status == NoSuchName {
+			//v1到达MIB末尾时回复noSuchName, error-index指出遍历完的列
+			col := e.Index - 1
+			if len(roots) == 1 {
+				col = 0
+			}
+			if col < 0 || col >= len(roots) {
+				return nil, fmt.Errorf("oid(%s) received GetNext error => %v", last[0].String(), err)
+			}
+			roots = append(roots[:col], roots[col+1:]...)
+			last = append(last[:col], last[col+1:]...)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("oid(%s) received GetNext error => %v", last[0].String(), err)
+		}
+		if len(resp.Varbinds) != len(roots) {
+			return nil, fmt.Errorf("oid(%s) GetNext returned %d varbinds for %d oids", last[0].String(), len(resp.Varbinds), len(roots))
+		}
+
+		activeRoots := roots[:0]
+		activeLast := last[:0]
+		for col, v := range resp.Varbinds {
+			if IsException(v.Value) || !v.Oid.Within(roots[col]) {
+				continue
+			}
+			if v.Oid.Compare(last[col]) <= 0 {
+				return nil, &LoopError{Oid: v.Oid, Previous: last[col]}
+			}
+			result[roots[col].String()][v.Oid.String()] = v.Value
+			activeRoots = append(activeRoots, roots[col])
+			activeLast = append(activeLast, v.Oid)
+		}
+		roots, last = activeRoots, activeLast
+	}
+	return result, nil
+}